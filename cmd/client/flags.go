@@ -0,0 +1,15 @@
+package main
+
+import "strings"
+
+// listFlag collects the values of a flag repeated on the command line
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"flag"
 	"github.com/denismitr/antiddos/internal/bootstrap"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/tlsconfig"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -15,6 +18,19 @@ func main() {
 	port := flag.Int("port", 3333, "server port")
 	zeroes := flag.Uint("zeroes", 3, "number of zeroes in hash")
 	maxDuration := flag.Uint("max-duration", 30, "maximum duration of challenge in seconds")
+	useTLS := flag.Bool("tls", false, "connect over TLS")
+	tlsCA := flag.String("tls-ca", "", "CA bundle verifying the server certificate, system pool when empty")
+	tlsServerName := flag.String("tls-server-name", "", "server name to verify the certificate against, host when empty")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version")
+	var tlsPins listFlag
+	flag.Var(&tlsPins, "tls-pin", "base64 SHA-256 of a pinned server public key (SPKI), repeat for several")
+	tlsCert := flag.String("tls-cert", "", "client certificate file for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "private key file of the client certificate")
+	useUDP := flag.Bool("udp", false, "exchange datagrams with the UDP listener at host and port")
+	wsURL := flag.String("ws", "", "ws:// or wss:// URL of the WebSocket endpoint to connect to instead of host and port")
+	hello := flag.Bool("hello", false, "negotiate the protocol version and algorithm with a Hello on connect")
+	maxZeroes := flag.Uint("max-zeroes", 0, "largest number of zeroes to solve, advertised in the Hello, any when 0")
+	resume := flag.Bool("resume", false, "open a session and resume it after reconnecting when the connection drops, TCP only")
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -28,6 +44,32 @@ func main() {
 	}()
 
 	c := bootstrap.TcpClient(uint8(*zeroes), uint64(*maxDuration), *host, *port)
+	if *useUDP {
+		c = bootstrap.UdpClient(uint8(*zeroes), uint64(*maxDuration), *host, *port)
+	}
+	if *wsURL != "" {
+		c = bootstrap.WebSocketClient(uint8(*zeroes), uint64(*maxDuration), *wsURL)
+	}
+
+	if *useTLS || strings.HasPrefix(*wsURL, "wss://") {
+		// over wss:// the host of the URL is verified when no name is given
+		serverName := *tlsServerName
+		if serverName == "" && *wsURL == "" {
+			serverName = *host
+		}
+
+		cfg, err := tlsconfig.Client(*tlsCA, serverName, *tlsMinVersion, tlsPins, *tlsCert, *tlsKey)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		c.SetTLSConfig(cfg)
+	}
+
+	c.SetResumable(*resume)
+	if *hello {
+		c.SetOffer(protocol.NewOffer(uint8(*maxZeroes)))
+	}
 
 	slog.Info("starting client")
 	if err := c.Run(ctx); err != nil {
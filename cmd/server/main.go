@@ -2,42 +2,530 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
 	"github.com/denismitr/antiddos/internal/bootstrap"
+	"github.com/denismitr/antiddos/internal/gateway"
+	"github.com/denismitr/antiddos/internal/httpapi"
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/proxy"
+	"github.com/denismitr/antiddos/internal/server"
+	"github.com/denismitr/antiddos/internal/tlsconfig"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/denismitr/antiddos/internal/upgrade"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// httpReadHeaderTimeout bounds reading request headers of the HTTP front end
+const httpReadHeaderTimeout = 5 * time.Second
+
+// gatewayCookie names the cookie letting clients through the gateway
+const gatewayCookie = "antiddos_pow"
+
+// envSecret holds the hex encoded key challenges are signed with, the key is handed
+// to the upgraded process through a pipe so that outstanding challenges stay valid
+const envSecret = "ANTIDDOS_SECRET"
+
 func main() {
 	host := flag.String("host", "127.0.0.1", "server host")
 	port := flag.Int("port", 3333, "server port")
 	zeroes := flag.Uint("zeroes", 3, "number of zeroes in hash")
 	maxDuration := flag.Uint("max-duration", 30, "maximum duration of challenge in seconds")
+	upgradeTimeout := flag.Duration("upgrade-timeout", 10*time.Second, "how long to wait for the upgraded process to get ready")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long to wait for connections to finish after an upgrade")
+	reusePort := flag.Int("reuseport", 0, "number of SO_REUSEPORT listeners with their own accept loops, linux only")
+	maxConns := flag.Int64("max-conns", 0, "maximum number of connections served at once, 0 means unlimited")
+	metricsAddr := flag.String("metrics", "", "address to serve metrics on at /debug/vars, disabled when empty")
+	ticketUses := flag.Uint64("ticket-uses", 0, "number of requests a ticket issued along with an accepted solution lets in, tickets are not issued when 0")
+	ticketTTL := flag.Duration("ticket-ttl", 5*time.Second, "lifetime of a ticket per zero of the solved challenge, capped by max-duration")
+	var listen listFlag
+	flag.Var(&listen, "listen", "address to listen on, host:port or unix:/path.sock, repeat for several addresses, overrides host and port")
+	var trustedProxies listFlag
+	flag.Var(&trustedProxies, "trusted-proxy", "CIDR or address of a proxy sending PROXY protocol headers, repeat for several")
+	tlsCert := flag.String("tls-cert", "", "certificate file, serves TLS when set together with tls-key")
+	tlsKey := flag.String("tls-key", "", "private key file of the certificate")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA bundle verifying client certificates, turns on mutual TLS")
+	epollWorkers := flag.Int("epoll-workers", 0, "serve connections with an epoll event loop and that many workers, linux only")
+	httpAddr := flag.String("http", "", "address of the HTTP front end with GET /challenge and POST /solve, disabled when empty")
+	var wsOrigins listFlag
+	flag.Var(&wsOrigins, "ws-origin", "origin of other sites whose pages may open WebSocket connections as scheme://host[:port] or *, repeat for several")
+	gatewayAddr := flag.String("gateway", "", "address of the HTTP gateway to -gateway-backend, disabled when empty")
+	gatewayBackend := flag.String("gateway-backend", "", "URL of the HTTP backend behind the gateway")
+	gatewayCookieTTL := flag.Duration("gateway-cookie-ttl", time.Hour, "how long the cookie lets a client through the gateway once it solves a challenge")
+	gatewaySecureCookie := flag.Bool("gateway-secure-cookie", false, "mark the gateway cookie Secure even on plain HTTP requests, e.g. behind a load balancer terminating TLS")
+	var gatewayDifficulty listFlag
+	flag.Var(&gatewayDifficulty, "gateway-difficulty", "number of zeroes of the paths with the given prefix as /prefix=zeroes, repeat for several")
+	udpAddr := flag.String("udp", "", "address of the UDP listener, disabled when empty")
+	var proxyBackends listFlag
+	flag.Var(&proxyBackends, "proxy-backend", "address of a TCP backend to splice clients with once they solve the challenge, repeat for a pool, quotes are served when none")
+	proxyBalancing := flag.String("proxy-balancing", "round-robin", "how a backend is picked for a client: round-robin, least-conn or hash of the client address")
+	proxyDialTimeout := flag.Duration("proxy-dial-timeout", 5*time.Second, "how long to wait for a connection to the backend")
+	proxyCheckInterval := flag.Duration("proxy-check-interval", 5*time.Second, "how often the backends are health checked")
+	proxyCheckTimeout := flag.Duration("proxy-check-timeout", 2*time.Second, "how long a backend may take to accept a health check connection")
+	proxyMaxStreams := flag.Int("proxy-max-streams", 100, "number of streams a connection may have open at once with -proxy-mux")
+	proxyMux := flag.Bool("proxy-mux", false, "proxy the streams of a connection to a backend connection each instead of the connection as a whole")
+	var sniRoutes listFlag
+	flag.Var(&sniRoutes, "sni-route", "proxy clients naming a TLS server to their own backends as name=addr,addr, *.domain matches subdomains, repeat for several")
+	var sniDifficulty listFlag
+	flag.Var(&sniDifficulty, "sni-difficulty", "number of zeroes of the clients naming a TLS server as name=zeroes, zeroes when not given")
+	sessionGrace := flag.Duration("session-grace", 0, "how long a client may take to reconnect and resume its session, sessions are disabled when 0")
+	maxSessions := flag.Int("max-sessions", 100_000, "number of sessions kept at once, both held by connections and waiting to be resumed")
+	maxChallenges := flag.Int("max-challenges", 1, "number of challenges a connection may hold at once, the state of connections is not kept when 0")
+	pingInterval := flag.Duration("ping-interval", 30*time.Second, "how long a connection may stay silent before it is pinged, connections are not pinged when 0 or with epoll-workers")
+	pingTimeout := flag.Duration("ping-timeout", 10*time.Second, "how long a pinged connection has to answer before it is closed")
+	pipeline := flag.Int("pipeline", 8, "number of tagged requests handled at once on a connection, tagged requests are handled one at a time when 0")
+	sniff := flag.Bool("sniff", false, "serve the HTTP front end on the listeners of the server too, telling protocols apart by their first bytes")
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	s, err := bootstrap.TcpServer(ctx, uint64(*maxDuration), uint8(*zeroes), *host, *port)
+	secret, err := loadSecret()
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	go func() {
-		terminate := make(chan os.Signal, 1)
-		signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
-		<-terminate
-		cancel()
-	}()
+	p, err := bootstrap.Protocol(ctx, uint64(*maxDuration), uint8(*zeroes), secret)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 
-	slog.Info("starting server")
-	if err := s.Run(ctx); err != nil {
+	if *ticketUses > 0 {
+		tickets, err := bootstrap.Tickets(ctx, uint64(*maxDuration), secret, *ticketUses, *ticketTTL)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		p.SetTickets(tickets)
+	}
+
+	s := server.New(fmt.Sprintf("%s:%d", *host, *port), p)
+
+	reg := metrics.NewRegistry()
+	s.SetMetrics(reg)
+	if len(listen) > 0 {
+		s.SetAddrs(listen)
+	}
+
+	proxies, err := trust.ParseNetworks(trustedProxies)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	s.SetTrustedProxies(proxies)
+
+	var tlsCfg *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsCfg, err = tlsconfig.Server(*tlsCert, *tlsKey, *tlsMinVersion, *tlsClientCA)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		s.SetTLSConfig(tlsCfg)
+	}
+	s.SetReusePort(*reusePort)
+	s.SetMaxConns(*maxConns)
+	s.SetEpoll(*epollWorkers)
+	s.SetMaxChallenges(*maxChallenges)
+	s.SetChallengeTTL(time.Duration(*maxDuration) * time.Second)
+	s.SetPipeline(*pipeline)
+	if *epollWorkers == 0 {
+		s.SetHeartbeat(*pingInterval, *pingTimeout)
+	}
+	if *sessionGrace > 0 {
+		s.SetSessionGrace(*sessionGrace)
+		s.SetMaxSessions(*maxSessions)
+	}
+
+	balancing, err := proxy.ParseBalancing(*proxyBalancing)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	newUpstream := func(backends []string) *proxy.Proxy {
+		up := proxy.New(backends[0])
+		up.SetBackends(backends)
+		up.SetBalancing(balancing)
+		up.SetDialTimeout(*proxyDialTimeout)
+		up.SetHealthCheck(*proxyCheckInterval, *proxyCheckTimeout)
+		up.SetMetrics(reg)
+		go up.Run(ctx)
+		return up
+	}
+
+	if len(proxyBackends) > 0 {
+		// the backend is reached by the work of the client alone, never by the one of the server
+		p.SetStrict(true)
+		s.SetUpstream(newUpstream(proxyBackends))
+	}
+	s.SetMultiplexing(*proxyMux)
+	s.SetMaxStreams(*proxyMaxStreams)
+
+	if err := addSNIRoutes(ctx, s, sniRoutes, sniDifficulty, uint64(*maxDuration), uint8(*zeroes), secret, newUpstream); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if *metricsAddr != "" {
+		expvar.Publish("antiddos", expvar.Func(reg.Snapshot))
+		go func() {
+			slog.With("addr", *metricsAddr).Info("serving metrics")
+			if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+				slog.With("error", err.Error()).Error("metrics server stopped")
+			}
+		}()
+	}
+
+	inherited, err := upgrade.Inherited()
+	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	slog.Info("server stopped")
+	h := httpapi.New(p)
+	h.SetTrustedProxies(proxies)
+	h.SetAllowedOrigins(wsOrigins)
+	h.SetMaxChallenges(*maxChallenges)
+	h.SetChallengeTTL(time.Duration(*maxDuration) * time.Second)
+	if *sniff {
+		s.SetHTTPHandler(h)
+	}
+
+	// the listeners of the HTTP front end and of the gateway are handed over
+	// after the ones of the server, in this order
+	var handedOver []net.Listener
+	if n := countEnabled(*httpAddr, *gatewayAddr); len(inherited) >= n {
+		inherited, handedOver = inherited[:len(inherited)-n], inherited[len(inherited)-n:]
+	}
+	openListener := func(addr string) net.Listener {
+		if len(handedOver) > 0 {
+			l := handedOver[0]
+			handedOver = handedOver[1:]
+			return l
+		}
+
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		return l
+	}
+
+	var frontEnds []*httpServer
+	if *httpAddr != "" {
+		hs := serveHTTP(openListener(*httpAddr), h, tlsCfg)
+		hs.srv.RegisterOnShutdown(h.CloseSockets)
+		frontEnds = append(frontEnds, hs)
+	}
+
+	if *gatewayAddr != "" {
+		gw, err := newGateway(ctx, *gatewayBackend, uint64(*maxDuration), uint8(*zeroes), secret, *gatewayCookieTTL, *gatewaySecureCookie, gatewayDifficulty, proxies)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		frontEnds = append(frontEnds, serveHTTP(openListener(*gatewayAddr), gw, tlsCfg))
+	}
+
+	if len(inherited) > 0 {
+		slog.Info("taking over listeners from the parent process")
+		s.SetListeners(inherited)
+	}
+
+	// the UDP socket is not handed over on upgrade, it is bound with SO_REUSEPORT
+	// next to the one of the parent, which is closed once the upgrade is done
+	stopUDP := func() {}
+	var udpReady <-chan struct{}
+	if *udpAddr != "" {
+		us, err := bootstrap.UdpServer(ctx, uint64(*maxDuration), uint8(*zeroes), secret, *udpAddr)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		us.SetMetrics(reg)
+		udpReady = us.Ready()
+
+		var udpCtx context.Context
+		udpCtx, stopUDP = context.WithCancel(ctx)
+		go func() {
+			if err := us.Run(udpCtx); err != nil && !errors.Is(err, context.Canceled) {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	notifyUpgrade(signals)
+
+	slog.Info("starting server")
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Run(ctx)
+	}()
+
+	ready := s.Ready()
+	for {
+		select {
+		case <-ready:
+			ready = nil
+			if udpReady != nil {
+				<-udpReady
+			}
+			if err := upgrade.Ready(); err != nil {
+				slog.Error(err.Error())
+			}
+		case sig := <-signals:
+			if !isUpgrade(sig) {
+				cancel()
+				continue
+			}
+
+			if err := upgradeServer(ctx, s, frontEnds, stopUDP, secret, *upgradeTimeout, *drainTimeout); err != nil {
+				slog.With("error", err.Error()).Error("upgrade failed, keep on serving")
+			}
+		case err := <-errCh:
+			if err != nil && !errors.Is(err, server.ErrServerClosed) && !errors.Is(err, context.Canceled) {
+				slog.Error(err.Error())
+				os.Exit(1)
+			}
+
+			for _, hs := range frontEnds {
+				hs.shutdown(context.Background(), *drainTimeout)
+			}
+
+			slog.Info("server stopped")
+			return
+		}
+	}
+}
+
+// upgradeServer hands the listeners over to a freshly started copy of the binary
+// and drains the connections of the current process once the copy is ready
+func upgradeServer(
+	ctx context.Context,
+	s *server.Server,
+	frontEnds []*httpServer,
+	stopUDP func(),
+	secret []byte,
+	upgradeTimeout, drainTimeout time.Duration,
+) error {
+	slog.Info("upgrading server")
+
+	u, err := upgrade.New(upgradeTimeout)
+	if err != nil {
+		return err
+	}
+	u.SetSecret(secret)
+
+	listeners := s.Listeners()
+	listeners = listeners[:len(listeners):len(listeners)]
+	for _, hs := range frontEnds {
+		listeners = append(listeners, hs.l)
+	}
+
+	if err := u.Upgrade(ctx, listeners); err != nil {
+		return err
+	}
+
+	slog.Info("upgraded process is ready, draining connections")
+	stopUDP()
+
+	drainCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+
+	for _, hs := range frontEnds {
+		go hs.shutdown(ctx, drainTimeout)
+	}
+
+	if err := s.Shutdown(drainCtx); err != nil {
+		slog.With("error", err.Error()).Error("some connections were closed forcibly")
+	}
+
+	return nil
+}
+
+// httpServer is the HTTP front end running next to the server
+type httpServer struct {
+	srv *http.Server
+	l   net.Listener
+}
+
+func serveHTTP(l net.Listener, h http.Handler, tlsCfg *tls.Config) *httpServer {
+	hs := &httpServer{
+		srv: &http.Server{
+			Handler:           h,
+			ReadHeaderTimeout: httpReadHeaderTimeout,
+			TLSConfig:         tlsCfg,
+		},
+		l: l,
+	}
+
+	go func() {
+		slog.With("addr", l.Addr().String()).Info("serving HTTP front end")
+
+		var err error
+		if tlsCfg != nil {
+			err = hs.srv.ServeTLS(l, "", "")
+		} else {
+			err = hs.srv.Serve(l)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.With("error", err.Error()).Error("HTTP front end stopped")
+		}
+	}()
+
+	return hs
+}
+
+func (hs *httpServer) shutdown(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := hs.srv.Shutdown(ctx); err != nil {
+		slog.With("error", err.Error()).Error("some HTTP connections were closed forcibly")
+	}
+}
+
+// newGateway creates the gateway to the backend, difficulty entries
+// give path prefixes their own number of zeroes as /prefix=zeroes
+func newGateway(
+	ctx context.Context,
+	backend string,
+	maxDuration uint64,
+	zeroes uint8,
+	secret []byte,
+	cookieTTL time.Duration,
+	secureCookie bool,
+	difficulty []string,
+	proxies trust.Networks,
+) (*gateway.Gateway, error) {
+	u, err := url.Parse(backend)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid gateway backend URL %q", backend)
+	}
+
+	g, err := bootstrap.Gate(ctx, maxDuration, secret)
+	if err != nil {
+		return nil, err
+	}
+	g.SetTrustedProxies(proxies)
+	g.SetTokenTTL(cookieTTL)
+	g.SetCookie(gatewayCookie)
+	g.SetSecureCookie(secureCookie)
+
+	gw := gateway.New(g, u, zeroes)
+	for _, d := range difficulty {
+		prefix, n, ok := strings.Cut(d, "=")
+		z, err := strconv.ParseUint(n, 10, 8)
+		if !ok || err != nil || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid gateway difficulty %q, expected /prefix=zeroes", d)
+		}
+		gw.SetDifficulty(prefix, uint8(z))
+	}
+
+	return gw, nil
+}
+
+// addSNIRoutes gives every server name of routes its own backends and protocol,
+// the protocol asks for the zeroes of the name in difficulty or for the default ones
+func addSNIRoutes(
+	ctx context.Context,
+	s *server.Server,
+	routes, difficulty []string,
+	maxDuration uint64,
+	zeroes uint8,
+	secret []byte,
+	newUpstream func(backends []string) *proxy.Proxy,
+) error {
+	zeroesOf := make(map[string]uint8, len(difficulty))
+	for _, d := range difficulty {
+		name, n, ok := strings.Cut(d, "=")
+		z, err := strconv.ParseUint(n, 10, 8)
+		if !ok || err != nil || name == "" {
+			return fmt.Errorf("invalid SNI difficulty %q, expected name=zeroes", d)
+		}
+		zeroesOf[name] = uint8(z)
+	}
+
+	for _, rt := range routes {
+		name, backends, ok := strings.Cut(rt, "=")
+		if !ok || name == "" || backends == "" {
+			return fmt.Errorf("invalid SNI route %q, expected name=addr,addr", rt)
+		}
+
+		z, ok := zeroesOf[name]
+		if !ok {
+			z = zeroes
+		}
+
+		p, err := bootstrap.Protocol(ctx, maxDuration, z, secret)
+		if err != nil {
+			return err
+		}
+		p.SetStrict(true)
+
+		s.AddRoute(name, p, newUpstream(strings.Split(backends, ",")))
+		slog.With("server name", name).With("backends", backends).With("zeroes", z).Info("routing by SNI")
+	}
+
+	return nil
+}
+
+// countEnabled counts the non-empty addresses
+func countEnabled(addrs ...string) int {
+	n := 0
+	for _, addr := range addrs {
+		if addr != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// loadSecret returns the key handed over by the parent process on an upgrade,
+// the one from envSecret or a generated one, which is never exported
+func loadSecret() ([]byte, error) {
+	inherited, err := upgrade.Secret()
+	if err != nil {
+		return nil, err
+	}
+	if inherited != nil {
+		return inherited, nil
+	}
+
+	if v, ok := os.LookupEnv(envSecret); ok {
+		secret, err := hex.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envSecret, err)
+		}
+		return secret, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+
+	return secret, nil
 }
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// notifyUpgrade does nothing, there is no signal to ask for an upgrade
+func notifyUpgrade(_ chan<- os.Signal) {}
+
+func isUpgrade(_ os.Signal) bool {
+	return false
+}
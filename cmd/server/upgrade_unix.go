@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyUpgrade relays SIGUSR2, which asks for a zero-downtime upgrade, to c
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// isUpgrade tells whether the signal asks for an upgrade
+func isUpgrade(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
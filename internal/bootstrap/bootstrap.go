@@ -2,36 +2,134 @@ package bootstrap
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/denismitr/antiddos/internal/challenge"
 	"github.com/denismitr/antiddos/internal/client"
+	"github.com/denismitr/antiddos/internal/powhttp"
 	"github.com/denismitr/antiddos/internal/protocol"
 	"github.com/denismitr/antiddos/internal/quotes"
 	"github.com/denismitr/antiddos/internal/server"
 	"github.com/denismitr/antiddos/internal/store/adapters/embedded"
 	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"time"
 )
 
+// Protocol wires the protocol with its challenge and store,
+// a single instance is shared by all the transports of a process
+func Protocol(
+	ctx context.Context,
+	maxDuration uint64,
+	zeroes uint8,
+	secret []byte,
+) (*protocol.Protocol, error) {
+	store, err := embedded.New(ctx, maxDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	c := challenge.New(store, zeroes, maxDuration)
+	if len(secret) > 0 {
+		c.SetSigner(challenge.NewSigner(secret))
+	}
+
+	return protocol.New(c, quotes.New()), nil
+}
+
+// Gate wires proof of work for HTTP handlers with its own store,
+// challenges and access tokens are signed with secret
+func Gate(ctx context.Context, maxDuration uint64, secret []byte) (*powhttp.Gate, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("bootstrap.Gate requires a secret to sign challenges and tokens")
+	}
+
+	store, err := embedded.New(ctx, maxDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	g := powhttp.New(store, maxDuration)
+	g.SetSigner(challenge.NewSigner(secret))
+	return g, nil
+}
+
+// Tickets issues tickets valid for the given number of uses and for ttl per zero of
+// the solved challenge, but no longer than maxDuration, which is how long the counts are kept
+func Tickets(
+	ctx context.Context,
+	maxDuration uint64,
+	secret []byte,
+	uses uint64,
+	ttl time.Duration,
+) (*challenge.Tickets, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("bootstrap.Tickets requires a secret to sign tickets")
+	}
+
+	store, err := embedded.New(ctx, maxDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	maxTTL := time.Duration(maxDuration) * time.Second
+	return challenge.NewTickets(store, challenge.NewSigner(secret), uses, ttl, maxTTL), nil
+}
+
 func TcpServer(
 	ctx context.Context,
 	maxDuration uint64,
 	zeroes uint8,
+	secret []byte,
 	host string, port int,
 ) (*server.Server, error) {
-	store, err := embedded.New(ctx, maxDuration)
+	p, err := Protocol(ctx, maxDuration, zeroes, secret)
 	if err != nil {
 		return nil, err
 	}
 
-	c := challenge.New(store, zeroes, maxDuration)
-	p := protocol.New(c, quotes.New())
 	addr := fmt.Sprintf("%s:%d", host, port)
 	return server.New(addr, p), nil
 }
 
+// UdpServer serves a strict protocol of its own over UDP, the challenges
+// must be signed since the server keeps no state per peer
+func UdpServer(
+	ctx context.Context,
+	maxDuration uint64,
+	zeroes uint8,
+	secret []byte,
+	addr string,
+) (*server.UDPServer, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("bootstrap.UdpServer requires a secret to sign challenges")
+	}
+
+	p, err := Protocol(ctx, maxDuration, zeroes, secret)
+	if err != nil {
+		return nil, err
+	}
+	p.SetStrict(true)
+
+	return server.NewUDP(addr, p), nil
+}
+
 func TcpClient(zeroes uint8, maxDuration uint64, host string, port int) *client.Client {
 	addr := fmt.Sprintf("%s:%d", host, port)
 	clientSideValidator := nope.Nope{}
 	solver := challenge.New(clientSideValidator, zeroes, maxDuration)
 	return client.New(addr, solver)
 }
+
+func UdpClient(zeroes uint8, maxDuration uint64, host string, port int) *client.Client {
+	addr := fmt.Sprintf("udp://%s:%d", host, port)
+	clientSideValidator := nope.Nope{}
+	solver := challenge.New(clientSideValidator, zeroes, maxDuration)
+	return client.New(addr, solver)
+}
+
+// WebSocketClient connects to the /ws endpoint of the HTTP front end, e.g. ws://127.0.0.1:8080/ws
+func WebSocketClient(zeroes uint8, maxDuration uint64, url string) *client.Client {
+	clientSideValidator := nope.Nope{}
+	solver := challenge.New(clientSideValidator, zeroes, maxDuration)
+	return client.New(url, solver)
+}
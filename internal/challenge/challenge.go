@@ -1,6 +1,7 @@
 package challenge
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -14,6 +15,12 @@ import (
 var (
 	ErrInvalidHeader             = errors.New("invalid header")
 	ErrChallengeDurationExceeded = errors.New("challenge duration exceeded")
+	ErrInvalidSignature          = errors.New("invalid signature")
+	ErrNotSolved                 = errors.New("challenge is not solved")
+	ErrResourceMismatch          = errors.New("challenge was issued for another resource")
+	ErrReplayed                  = errors.New("challenge was already used")
+	ErrWrongDifficulty           = errors.New("amount of zeroes does not match the config")
+	ErrUnknownChallenge          = errors.New("challenge was not issued")
 )
 
 const (
@@ -24,6 +31,7 @@ const (
 type validator interface {
 	Validate(key string) bool
 	Remember(key string)
+	Spend(key string) bool
 }
 
 type Challenge struct {
@@ -34,6 +42,7 @@ type Challenge struct {
 	now           func() time.Time
 	randomizer    func() int
 	validator     validator
+	signer        *Signer
 }
 
 func createDefaultRandomizer() func() int {
@@ -70,11 +79,21 @@ func (c *Challenge) SetMaxIterations(maxIterations uint64) {
 	c.maxIterations = maxIterations
 }
 
+// SetSigner makes challenges stateless: instead of remembering the rand value
+// in the store, it is signed along with the rest of the header and the signature
+// is verified on solve. Challenges stay valid for any process sharing the key.
+func (c *Challenge) SetSigner(s *Signer) {
+	c.signer = s
+}
+
+// Zeroes returns the number of zeroes the challenges are issued with
+func (c *Challenge) Zeroes() uint8 {
+	return c.zeroes
+}
+
 func (c *Challenge) Create(resource string) (string, error) {
 	random := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d", c.randomizer())))
 
-	c.validator.Remember(random)
-
 	hc := hashcash{
 		Ver:      1,
 		Bits:     c.zeroes,
@@ -84,10 +103,23 @@ func (c *Challenge) Create(resource string) (string, error) {
 		Counter:  0,
 	}
 
+	if c.signer != nil {
+		hc.Rand = random + SignatureDelimiter + c.signer.Sign(hc.signedParts(random)...)
+	} else {
+		c.validator.Remember(random)
+	}
+
 	return hc.Header(), nil
 }
 
+// Solve finds the counter of the header on behalf of the client,
+// every challenge is solved only once, like it passes Verify only once
 func (c *Challenge) Solve(header string) (string, error) {
+	return c.SolveContext(context.Background(), header)
+}
+
+// SolveContext is Solve giving up once ctx is done
+func (c *Challenge) SolveContext(ctx context.Context, header string) (string, error) {
 	hc, err := c.headerToHashcash(header)
 	if err != nil {
 		return "", err
@@ -97,25 +129,64 @@ func (c *Challenge) Solve(header string) (string, error) {
 		return "", err
 	}
 
+	// a challenge is solved only once, a replay fails before any work is done
+	if !c.validator.Spend(hc.Rand) {
+		return "", ErrReplayed
+	}
+
 	iterations := hc.Counter
 	if iterations == 0 {
 		iterations = c.maxIterations
 	}
 
-	if err := hc.Bruteforce(iterations); err != nil {
+	if err := hc.bruteforce(ctx, iterations); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", fmt.Errorf("failed to solve hashcash: %w", ctxErr)
+		}
 		return "", fmt.Errorf("%w failed to solve hashcash: %v", ErrTooManyIterations, err)
 	}
 
 	return hc.Header(), nil
 }
 
+// Verify checks a header solved by the client for the given resource. Unlike Solve
+// it never does the work on behalf of the client, and every challenge passes only once.
+func (c *Challenge) Verify(header, resource string) error {
+	hc, err := c.headerToHashcash(header)
+	if err != nil {
+		return err
+	}
+
+	if err := c.validate(hc); err != nil {
+		return err
+	}
+
+	if hc.Resource != resource {
+		return ErrResourceMismatch
+	}
+
+	if !validateZeroBits(hc.Hash(), hc.Bits) {
+		return ErrNotSolved
+	}
+
+	if !c.validator.Spend(hc.Rand) {
+		return ErrReplayed
+	}
+
+	return nil
+}
+
 func (c *Challenge) validate(hc *hashcash) error {
-	if !c.validator.Validate(hc.Rand) {
-		return fmt.Errorf("header seems to be milicious")
+	if c.signer != nil {
+		if err := c.verifySignature(hc); err != nil {
+			return err
+		}
+	} else if !c.validator.Validate(hc.Rand) {
+		return fmt.Errorf("%w: header seems to be milicious", ErrUnknownChallenge)
 	}
 
 	if c.zeroes != hc.Bits {
-		return fmt.Errorf("amount of zeroes does not match the config")
+		return fmt.Errorf("%w: expected %d but got %d", ErrWrongDifficulty, c.zeroes, hc.Bits)
 	}
 
 	if uint64(c.now().Unix())-hc.Date > c.maxDuration {
@@ -125,6 +196,30 @@ func (c *Challenge) validate(hc *hashcash) error {
 	return nil
 }
 
+func (c *Challenge) verifySignature(hc *hashcash) error {
+	random, signature, found := strings.Cut(hc.Rand, SignatureDelimiter)
+	if !found {
+		return fmt.Errorf("%w: rand is not signed", ErrInvalidSignature)
+	}
+
+	if !c.signer.Verify(signature, hc.signedParts(random)...) {
+		return fmt.Errorf("%w: header seems to be milicious", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+// Nonce returns the random part of the header, which tells a challenge apart
+// from the others whatever the counter of the solution
+func Nonce(header string) (string, error) {
+	segments := strings.Split(header, HeaderDelimiter)
+	if len(segments) != 6 {
+		return "", fmt.Errorf("%w: expected 6 segments in header but got %s", ErrInvalidHeader, header)
+	}
+
+	return segments[4], nil
+}
+
 func (c *Challenge) headerToHashcash(header string) (*hashcash, error) {
 	segments := strings.Split(header, HeaderDelimiter)
 	if len(segments) != 6 {
@@ -1,10 +1,13 @@
 package challenge_test
 
 import (
+	"context"
 	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/store/adapters/embedded"
 	"github.com/denismitr/antiddos/internal/store/adapters/nope"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 	"time"
 )
@@ -35,3 +38,105 @@ func TestChallenge_Solve(t *testing.T) {
 		assert.Equal(t, "1|3|1702740115|hello world!|NTAwMA==|0", header)
 	})
 }
+
+func TestChallenge_Signed(t *testing.T) {
+	now := func() time.Time {
+		return time.Unix(1702740115, 0)
+	}
+
+	issuer := challenge.New(nope.Nope{}, 3, 30)
+	issuer.SetNow(now)
+	issuer.SetSigner(challenge.NewSigner([]byte("secret")))
+
+	header, err := issuer.Create("127.0.0.1:52374")
+	require.NoError(t, err)
+
+	solver := challenge.New(nope.Nope{}, 3, 30)
+	solver.SetNow(now)
+	solved, err := solver.Solve(header)
+	require.NoError(t, err)
+
+	t.Run("verified by another instance sharing the key", func(t *testing.T) {
+		verifier := challenge.New(nope.Nope{}, 3, 30)
+		verifier.SetNow(now)
+		verifier.SetSigner(challenge.NewSigner([]byte("secret")))
+
+		confirmed, err := verifier.Solve(solved)
+		require.NoError(t, err)
+		assert.Equal(t, solved, confirmed)
+	})
+
+	t.Run("rejected with another key", func(t *testing.T) {
+		verifier := challenge.New(nope.Nope{}, 3, 30)
+		verifier.SetNow(now)
+		verifier.SetSigner(challenge.NewSigner([]byte("another secret")))
+
+		_, err := verifier.Solve(solved)
+		assert.ErrorIs(t, err, challenge.ErrInvalidSignature)
+	})
+
+	t.Run("rejected when the resource is tampered with", func(t *testing.T) {
+		tampered := strings.Replace(solved, "127.0.0.1:52374", "127.0.0.2:52374", 1)
+
+		_, err := issuer.Solve(tampered)
+		assert.ErrorIs(t, err, challenge.ErrInvalidSignature)
+	})
+
+	t.Run("solved only once", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		store, err := embedded.New(ctx, 30)
+		require.NoError(t, err)
+
+		verifier := challenge.New(store, 3, 30)
+		verifier.SetNow(now)
+		verifier.SetSigner(challenge.NewSigner([]byte("secret")))
+
+		_, err = verifier.Solve(solved)
+		require.NoError(t, err)
+		_, err = verifier.Solve(solved)
+		assert.ErrorIs(t, err, challenge.ErrReplayed)
+		_, err = verifier.Solve(header)
+		assert.ErrorIs(t, err, challenge.ErrReplayed, "the counter does not tell challenges apart")
+	})
+}
+
+func TestChallenge_Verify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := embedded.New(ctx, 30)
+	require.NoError(t, err)
+
+	c := challenge.New(store, 3, 30)
+	c.SetNow(func() time.Time {
+		return time.Unix(1702740115, 0)
+	})
+	c.SetRandomizer(func() int {
+		return 5000
+	})
+
+	header, err := c.Create("127.0.0.1")
+	require.NoError(t, err)
+
+	t.Run("unsolved challenge", func(t *testing.T) {
+		assert.ErrorIs(t, c.Verify(header, "127.0.0.1"), challenge.ErrNotSolved)
+	})
+
+	solver := challenge.New(nope.Nope{}, 3, 30)
+	solver.SetNow(func() time.Time {
+		return time.Unix(1702740115, 0)
+	})
+	solved, err := solver.Solve(header)
+	require.NoError(t, err)
+
+	t.Run("another resource", func(t *testing.T) {
+		assert.ErrorIs(t, c.Verify(solved, "127.0.0.2"), challenge.ErrResourceMismatch)
+	})
+
+	t.Run("solved challenge passes once", func(t *testing.T) {
+		require.NoError(t, c.Verify(solved, "127.0.0.1"))
+		assert.ErrorIs(t, c.Verify(solved, "127.0.0.1"), challenge.ErrReplayed)
+	})
+}
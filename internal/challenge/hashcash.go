@@ -1,11 +1,16 @@
 package challenge
 
 import (
+	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"strconv"
 )
 
+// ctxCheckInterval is how many hashes are computed between checks of the context
+const ctxCheckInterval = 1 << 12
+
 var (
 	ErrTooManyIterations = errors.New("too many iterations")
 )
@@ -41,6 +46,18 @@ func (hc *hashcash) Header() string {
 	)
 }
 
+// signedParts lists everything a signature of the challenge covers,
+// the counter is left out since it is what the client is looking for
+func (hc *hashcash) signedParts(random string) []string {
+	return []string{
+		strconv.Itoa(int(hc.Ver)),
+		strconv.Itoa(int(hc.Bits)),
+		strconv.FormatUint(hc.Date, 10),
+		hc.Resource,
+		random,
+	}
+}
+
 func (hc *hashcash) Hash() string {
 	hasher := sha1.New()
 	hasher.Write([]byte(hc.Header()))
@@ -64,7 +81,16 @@ func validateZeroBits(hash string, bits uint8) bool {
 }
 
 func (hc *hashcash) Bruteforce(iterations uint64) error {
+	return hc.bruteforce(context.Background(), iterations)
+}
+
+// bruteforce gives up once ctx is done, it checks ctx every ctxCheckInterval iterations
+func (hc *hashcash) bruteforce(ctx context.Context, iterations uint64) error {
 	for hc.Counter <= iterations {
+		if hc.Counter%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		hash := hc.Hash()
 		if validateZeroBits(hash, hc.Bits) {
 			return nil
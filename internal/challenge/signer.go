@@ -0,0 +1,41 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	// signatureSize is the amount of HMAC bytes kept in a signature
+	signatureSize = 16
+
+	// SignatureDelimiter separates the random part of the hashcash from its signature
+	SignatureDelimiter = "."
+)
+
+// Signer authenticates challenges with a secret key,
+// so that they can be verified by any process sharing the key
+// without looking them up in the store
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{
+		key: key,
+	}
+}
+
+// Sign returns a signature of the given parts
+func (s *Signer) Sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(strings.Join(parts, HeaderDelimiter)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:signatureSize])
+}
+
+// Verify checks that signature was produced by Sign for the same parts
+func (s *Signer) Verify(signature string, parts ...string) bool {
+	return hmac.Equal([]byte(signature), []byte(s.Sign(parts...)))
+}
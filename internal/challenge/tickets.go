@@ -0,0 +1,136 @@
+package challenge
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTicket = errors.New("invalid ticket")
+	ErrTicketExpired = errors.New("ticket expired")
+	ErrTicketUsedUp  = errors.New("ticket used up")
+)
+
+const (
+	// ticketDelimiter separates the id, difficulty, expiry, uses and signature of a ticket
+	ticketDelimiter = "."
+
+	// ticketScope keeps signatures of tickets apart from the other signatures of the key
+	ticketScope = "ticket"
+
+	// ticketIDSize is the amount of random bytes identifying a ticket
+	ticketIDSize = 12
+)
+
+// ticketStore counts the uses of tickets
+type ticketStore interface {
+	Use(key string, limit uint64) bool
+}
+
+// Tickets lets a client that solved a challenge in a number of times
+// for a while without solving again. Tickets are signed and bound to the host
+// of the client, and their uses are counted in the store.
+type Tickets struct {
+	store  ticketStore
+	signer *Signer
+	uses   uint64
+	ttl    time.Duration
+	maxTTL time.Duration
+	now    func() time.Time
+}
+
+// NewTickets creates tickets valid for the given number of uses and for ttl per zero
+// of the solved challenge, so that harder challenges earn longer tickets. A ticket never
+// lives longer than maxTTL, which must not exceed the time the store keeps the counts.
+func NewTickets(store ticketStore, signer *Signer, uses uint64, ttl, maxTTL time.Duration) *Tickets {
+	return &Tickets{
+		store:  store,
+		signer: signer,
+		uses:   uses,
+		ttl:    ttl,
+		maxTTL: maxTTL,
+		now:    time.Now,
+	}
+}
+
+func (t *Tickets) SetNow(now func() time.Time) {
+	t.now = now
+}
+
+// Issue returns a ticket for the client that solved the header
+func (t *Tickets) Issue(header, clientIP string) (string, error) {
+	segments := strings.Split(header, HeaderDelimiter)
+	if len(segments) != 6 {
+		return "", fmt.Errorf("%w: expected 6 segments in header but got %s", ErrInvalidHeader, header)
+	}
+
+	bits, err := strconv.ParseUint(segments[1], 10, 8)
+	if err != nil {
+		return "", fmt.Errorf("%w: bits are invalid: %v", ErrInvalidHeader, err)
+	}
+
+	id := make([]byte, ticketIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("challenge.Tickets.Issue failed to generate id: %w", err)
+	}
+
+	ttl := min(t.ttl*time.Duration(bits), t.maxTTL)
+	parts := []string{
+		base64.RawURLEncoding.EncodeToString(id),
+		strconv.FormatUint(bits, 10),
+		strconv.FormatInt(t.now().Add(ttl).Unix(), 10),
+		strconv.FormatUint(t.uses, 10),
+	}
+	signature := t.signer.Sign(t.signedParts(parts, clientIP)...)
+
+	return strings.Join(append(parts, signature), ticketDelimiter), nil
+}
+
+// Redeem counts a use of the ticket by the client, it fails once the ticket
+// is expired or used up, or when it was issued to another client
+func (t *Tickets) Redeem(ticket, clientIP string) error {
+	parts := strings.Split(ticket, ticketDelimiter)
+	if len(parts) != 5 {
+		return ErrInvalidTicket
+	}
+
+	if !t.signer.Verify(parts[4], t.signedParts(parts[:4], clientIP)...) {
+		return ErrInvalidTicket
+	}
+
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return ErrInvalidTicket
+	}
+
+	if t.now().Unix() > expiry {
+		return ErrTicketExpired
+	}
+
+	uses, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		return ErrInvalidTicket
+	}
+
+	if !t.store.Use(ticketScope+":"+parts[0], uses) {
+		return ErrTicketUsedUp
+	}
+
+	return nil
+}
+
+// signedParts binds the ticket to the host of the client, since
+// every connection of the client comes from a port of its own
+func (t *Tickets) signedParts(parts []string, clientIP string) []string {
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+
+	return append([]string{ticketScope, clientIP}, parts...)
+}
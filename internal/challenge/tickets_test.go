@@ -0,0 +1,88 @@
+package challenge_test
+
+import (
+	"context"
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/store/adapters/embedded"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTickets(t *testing.T, uses uint64) *challenge.Tickets {
+	t.Helper()
+
+	store, err := embedded.New(context.Background(), 60)
+	require.NoError(t, err)
+
+	tickets := challenge.NewTickets(store, challenge.NewSigner([]byte("secret")), uses, 10*time.Second, time.Minute)
+	tickets.SetNow(func() time.Time {
+		return time.Unix(1702740115, 0)
+	})
+	return tickets
+}
+
+func TestTickets(t *testing.T) {
+	const header = "1|3|1702740115|127.0.0.1:52374|ODk1Mw==|2797"
+
+	t.Run("ticket lets the client in for its uses", func(t *testing.T) {
+		tickets := newTickets(t, 2)
+		ticket, err := tickets.Issue(header, "127.0.0.1:52374")
+		require.NoError(t, err)
+
+		// the next connection of the client comes from another port
+		require.NoError(t, tickets.Redeem(ticket, "127.0.0.1:52380"))
+		require.NoError(t, tickets.Redeem(ticket, "127.0.0.1:52381"))
+		assert.ErrorIs(t, tickets.Redeem(ticket, "127.0.0.1:52382"), challenge.ErrTicketUsedUp)
+	})
+
+	t.Run("ticket of another client", func(t *testing.T) {
+		tickets := newTickets(t, 2)
+		ticket, err := tickets.Issue(header, "127.0.0.1:52374")
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, tickets.Redeem(ticket, "127.0.0.2:52374"), challenge.ErrInvalidTicket)
+	})
+
+	t.Run("tampered ticket", func(t *testing.T) {
+		tickets := newTickets(t, 2)
+		ticket, err := tickets.Issue(header, "127.0.0.1:52374")
+		require.NoError(t, err)
+
+		parts := strings.Split(ticket, ".")
+		parts[3] = "1000"
+		assert.ErrorIs(t, tickets.Redeem(strings.Join(parts, "."), "127.0.0.1:52374"), challenge.ErrInvalidTicket)
+		assert.ErrorIs(t, tickets.Redeem("garbage", "127.0.0.1:52374"), challenge.ErrInvalidTicket)
+	})
+
+	t.Run("expired ticket", func(t *testing.T) {
+		tickets := newTickets(t, 2)
+		ticket, err := tickets.Issue(header, "127.0.0.1:52374")
+		require.NoError(t, err)
+
+		tickets.SetNow(func() time.Time {
+			return time.Unix(1702740115, 0).Add(31 * time.Second)
+		})
+		assert.ErrorIs(t, tickets.Redeem(ticket, "127.0.0.1:52374"), challenge.ErrTicketExpired)
+	})
+
+	t.Run("lifetime scales with the difficulty", func(t *testing.T) {
+		tickets := newTickets(t, 2)
+
+		lifetime := func(header string) int64 {
+			ticket, err := tickets.Issue(header, "127.0.0.1:52374")
+			require.NoError(t, err)
+
+			expiry, err := strconv.ParseInt(strings.Split(ticket, ".")[2], 10, 64)
+			require.NoError(t, err)
+			return expiry - 1702740115
+		}
+
+		assert.Equal(t, int64(20), lifetime("1|2|1702740115|127.0.0.1:52374|ODk1Mw==|1"))
+		assert.Equal(t, int64(50), lifetime("1|5|1702740115|127.0.0.1:52374|ODk1Mw==|1"))
+		assert.Equal(t, int64(60), lifetime("1|9|1702740115|127.0.0.1:52374|ODk1Mw==|1"), "capped by the max TTL")
+	})
+}
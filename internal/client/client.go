@@ -3,13 +3,132 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/websocket"
+	"io"
 	"log/slog"
 	"net"
+	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
+const (
+	// dialTimeout bounds connecting to the server over WebSocket, handshake included
+	dialTimeout = 10 * time.Second
+
+	// udpPrefix marks the address of a UDP server
+	udpPrefix = "udp://"
+
+	// udpDatagramSize is what the client pads its datagrams to, so that the server,
+	// which never answers with more bytes than it received, has room for its responses
+	udpDatagramSize = 512
+
+	// runInterval is how often Run asks for a transmission
+	runInterval = 3 * time.Second
+
+	// goodbyeTimeout bounds sending a Close to a server that is not reading
+	goodbyeTimeout = time.Second
+)
+
+var (
+	ErrRejected          = errors.New("server rejected the request")
+	ErrExpired           = errors.New("challenge or ticket expired")
+	ErrWrongDifficulty   = errors.New("wrong difficulty")
+	ErrUnknownNonce      = errors.New("challenge or ticket unknown to the server")
+	ErrReplay            = errors.New("challenge or ticket already used")
+	ErrBadBinding        = errors.New("challenge, ticket or session issued to another client")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrBanned            = errors.New("banned")
+	ErrMalformed         = errors.New("malformed request")
+	ErrNotSolved         = errors.New("challenge is not solved")
+	ErrIllegalTransition = errors.New("request is not allowed in the state of the connection")
+	ErrUnavailable       = errors.New("service unavailable")
+	ErrUnsupported       = errors.New("no protocol version or algorithm in common with the server")
+	ErrClosed            = errors.New("server closed the connection")
+	ErrShutdown          = errors.New("server is shutting down")
+	ErrOverloaded        = errors.New("server is overloaded")
+	ErrIdleTimeout       = errors.New("connection was idle for too long")
+
+	// ErrNoHello is returned by servers predating the Hello, the client goes on without it
+	ErrNoHello = errors.New("server does not speak hello")
+)
+
+// rejectErrors are the errors of the reasons of rejections
+var rejectErrors = map[protocol.Reason]error{
+	protocol.ReasonExpired:           ErrExpired,
+	protocol.ReasonWrongDifficulty:   ErrWrongDifficulty,
+	protocol.ReasonUnknownNonce:      ErrUnknownNonce,
+	protocol.ReasonReplay:            ErrReplay,
+	protocol.ReasonBadBinding:        ErrBadBinding,
+	protocol.ReasonRateLimited:       ErrRateLimited,
+	protocol.ReasonBanned:            ErrBanned,
+	protocol.ReasonMalformed:         ErrMalformed,
+	protocol.ReasonNotSolved:         ErrNotSolved,
+	protocol.ReasonIllegalTransition: ErrIllegalTransition,
+	protocol.ReasonUnavailable:       ErrUnavailable,
+	protocol.ReasonUnsupported:       ErrUnsupported,
+	protocol.ReasonShutdown:          ErrShutdown,
+	protocol.ReasonOverloaded:        ErrOverloaded,
+	protocol.ReasonIdleTimeout:       ErrIdleTimeout,
+}
+
+// RejectError is returned when the server rejects a request, it matches ErrRejected
+// and the error of its reason, e.g. ErrExpired, with errors.Is
+type RejectError struct {
+	protocol.Rejection
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRejected, e.Reason)
+}
+
+func (e *RejectError) Unwrap() []error {
+	if err, ok := rejectErrors[e.Reason]; ok {
+		return []error{ErrRejected, err}
+	}
+	return []error{ErrRejected}
+}
+
+// CloseError is returned when the server closes the connection, it matches ErrClosed
+// and the error of its reason, e.g. ErrShutdown, with errors.Is
+type CloseError struct {
+	protocol.Rejection
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrClosed, e.Reason)
+}
+
+func (e *CloseError) Unwrap() []error {
+	if err, ok := rejectErrors[e.Reason]; ok {
+		return []error{ErrClosed, err}
+	}
+	return []error{ErrClosed}
+}
+
+// closeError reads the data of a Close
+func closeError(data []byte) error {
+	rejection, err := protocol.ParseReject(data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	return &CloseError{Rejection: rejection}
+}
+
+// rejectError reads the data of a Reject
+func rejectError(data []byte) error {
+	rejection, err := protocol.ParseReject(data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRejected, err)
+	}
+	return &RejectError{Rejection: rejection}
+}
+
 type solver interface {
 	Solve(header string) (string, error)
 }
@@ -17,8 +136,37 @@ type solver interface {
 type Client struct {
 	addr string
 	s    solver
+	tls  *tls.Config
+
+	serverName string
+
+	// ticket is the last ticket the server issued, it is presented
+	// instead of solving a challenge until the server rejects it
+	ticket string
+
+	// resumable clients hold a session, on reconnect they resume it and go on
+	// with the challenge they were solving when the connection dropped
+	resumable bool
+	session   string
+	pending   string
+
+	// offer is advertised in a Hello on connect, clients without one speak Version1
+	offer *protocol.Offer
+
+	// r reads from conn, the connection the client exchanged frames on last
+	conn net.Conn
+	r    *bufio.Reader
+
+	// lastID is the ID of the last tagged request, see Pipeline
+	lastID uint32
+
+	// body is the body of the last streamed transmission
+	body *body
 }
 
+// New creates a client of the server at addr, either host:port of the TCP
+// listener, udp://host:port of the UDP one or a ws:// or wss:// URL
+// of the WebSocket endpoint of the HTTP front end
 func New(addr string, s solver) *Client {
 	return &Client{
 		addr: addr,
@@ -26,33 +174,249 @@ func New(addr string, s solver) *Client {
 	}
 }
 
+// SetTLSConfig makes the client connect over TLS,
+// e.g. with a CA bundle, a server name, pinned keys and a client certificate
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tls = cfg
+}
+
+// SetServerName names the server the client is going to open TLS to once it solved
+// the challenge, so that a server routing by SNI picks the difficulty and the backend.
+// The TLS handshake itself is up to the caller after Communicate.
+func (c *Client) SetServerName(name string) {
+	c.serverName = name
+}
+
+// SetResumable makes the client open a session on connect and, when the connection drops,
+// reconnect and resume it instead of starting over, see server.Server.SetSessionGrace
+func (c *Client) SetResumable(resumable bool) {
+	c.resumable = resumable
+}
+
+// SetOffer makes the client send a Hello with the offer on connect, e.g. protocol.NewOffer(6)
+// to solve challenges of up to 6 zeroes only. Servers predating the Hello are spoken to without it.
+func (c *Client) SetOffer(offer protocol.Offer) {
+	c.offer = &offer
+}
+
+// Run asks the server for a transmission every runInterval on a connection it keeps open, answering
+// the Pings of the server in between. A server closing the connection for a shutdown, an overload or
+// an idle timeout is reconnected to once the hint of its Close allows, a lost connection is reconnected
+// to when the client is resumable.
 func (c *Client) Run(ctx context.Context) error {
-	conn, closer, err := c.Connect()
+	conn, closer, err := c.open(ctx)
 	if err != nil {
 		return err
 	}
-	defer closer()
+	defer func() {
+		c.goodbye(conn)
+		_ = closer()
+	}()
+
+	for {
+		err := c.wait(ctx, conn, runInterval)
+		if err == nil {
+			var quote string
+			if quote, err = c.Communicate(ctx, conn); err == nil {
+				slog.With("quote", quote).Info("server transmitted")
+				continue
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var closeErr *CloseError
+		switch {
+		case errors.As(err, &closeErr):
+			if !errors.Is(err, ErrShutdown) && !errors.Is(err, ErrOverloaded) && !errors.Is(err, ErrIdleTimeout) {
+				return err
+			}
+
+			slog.With("reason", closeErr.Reason.String()).With("retry after", closeErr.RetryAfter).Warn("server closed the connection, reconnecting")
+			if err := sleep(ctx, closeErr.RetryAfter); err != nil {
+				return err
+			}
+		case !c.resumable:
+			return err
+		default:
+			slog.With("error", err.Error()).Warn("client lost the connection, resuming the session")
+		}
+
+		_ = closer()
+		if conn, closer, err = c.open(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// open connects to the server, says Hello when the client has an offer
+// and resumes the session when the client is resumable
+func (c *Client) open(ctx context.Context) (net.Conn, func() error, error) {
+	conn, closer, err := c.Connect()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	slog.Info("client connected to", "addr", c.addr)
 
-	t := time.NewTicker(3 * time.Second)
-	defer t.Stop()
+	if c.offer != nil {
+		agreement, err := c.Hello(ctx, conn)
+		switch {
+		case errors.Is(err, ErrNoHello):
+			slog.Info("server does not speak hello, going on without it")
+			c.offer = nil
+			_ = closer()
+			if conn, closer, err = c.Connect(); err != nil {
+				return nil, nil, err
+			}
+		case err != nil:
+			_ = closer()
+			return nil, nil, err
+		default:
+			slog.With("version", agreement.Version).With("zeroes", agreement.Difficulty).Info("server agreed on hello")
+		}
+	}
 
+	if c.resumable {
+		if err := c.Resume(ctx, conn); err != nil {
+			_ = closer()
+			return nil, nil, err
+		}
+	}
+
+	return conn, closer, nil
+}
+
+// wait idles on the connection for d answering the Pings of the server,
+// it returns early with the Close of the server or when the connection drops
+func (c *Client) wait(ctx context.Context, conn net.Conn, d time.Duration) error {
+	deadline := time.Now().Add(d)
+	defer conn.SetReadDeadline(time.Time{})
+
+	// a done ctx wakes the read up
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	r := c.reader(conn)
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-t.C:
-			if quote, err := c.Communicate(ctx, conn); err != nil {
-				return err
-			} else {
-				slog.With("quote", quote).Info("server transmitted")
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+
+		// nothing is consumed until a frame arrives, so that the deadline never cuts one
+		if _, err := r.Peek(1); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return fmt.Errorf("client.Client.wait failed to read: %w", err)
+		}
+
+		_ = conn.SetReadDeadline(time.Time{})
+		p, err := c.readPayload(conn, r)
+		if err != nil {
+			return fmt.Errorf("client.Client.wait failed to read payload: %w", err)
+		}
+		return fmt.Errorf("client.Client.wait received unexpected [%d] action", p.Action)
+	}
+}
+
+// goodbye tells the server that the client is done with the connection
+func (c *Client) goodbye(conn net.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	_ = protocol.Send(protocol.NewClose(protocol.Rejection{Reason: protocol.ReasonGoodbye}), conn)
+}
+
+// reader returns the reader of the connection, kept for the whole connection
+// so that nothing the server sent is lost between exchanges
+func (c *Client) reader(conn net.Conn) *bufio.Reader {
+	if c.conn != conn {
+		c.conn, c.r = conn, bufio.NewReader(conn)
+	}
+	return c.r
+}
+
+// readPayload reads the next payload of the server, answering its Pings on the way,
+// a Close of the server is returned as a *CloseError
+func (c *Client) readPayload(conn net.Conn, r *bufio.Reader) (*protocol.Payload, error) {
+	// a Pong that could not be sent is reported unless the server tells why it closed the connection
+	var pongErr error
+	for {
+		b, err := protocol.ReadFrame(r)
+		if err != nil {
+			if pongErr != nil {
+				return nil, pongErr
 			}
+			return nil, err
+		}
+
+		p, err := protocol.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+
+		switch p.Action {
+		case protocol.Ping:
+			if err := protocol.Send(&protocol.Payload{Action: protocol.Pong}, conn); err != nil && pongErr == nil {
+				pongErr = fmt.Errorf("client.Client.readPayload failed to answer ping: %w", err)
+			}
+		case protocol.Close:
+			return nil, closeError(p.Data)
+		default:
+			return p, nil
 		}
 	}
 }
 
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 func (c *Client) Connect() (net.Conn, func() error, error) {
+	if strings.HasPrefix(c.addr, "ws://") || strings.HasPrefix(c.addr, "wss://") {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+
+		conn, err := websocket.Dial(ctx, c.addr, c.tls)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to dial %s: %w", c.addr, err)
+		}
+
+		return conn, conn.Close, nil
+	}
+
+	if addr, ok := strings.CutPrefix(c.addr, udpPrefix); ok {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to dial %s: %w", addr, err)
+		}
+
+		return paddedConn{Conn: conn}, conn.Close, nil
+	}
+
+	if c.tls != nil {
+		conn, err := tls.Dial("tcp", c.addr, c.tls)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to dial %s over TLS: %w", c.addr, err)
+		}
+
+		return conn, conn.Close, nil
+	}
+
 	conn, err := net.Dial("tcp", c.addr)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to dial %s: %w", c.addr, err)
@@ -62,32 +426,157 @@ func (c *Client) Connect() (net.Conn, func() error, error) {
 }
 
 func (c *Client) Communicate(ctx context.Context, conn net.Conn) (string, error) {
-	r := bufio.NewReader(conn)
+	// a lost datagram or a silent server must not block the client forever
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
 
-	if err := c.askForChallenge(ctx, conn); err != nil {
+	t, err := c.exchange(ctx, conn)
+	if err != nil {
 		return "", err
 	}
 
-	header, err := c.receiveChallenge(ctx, r)
+	resp, err := io.ReadAll(t.Body)
 	if err != nil {
 		return "", err
 	}
 
+	return string(resp), nil
+}
+
+// exchange redeems the ticket or solves a challenge and returns the transmission,
+// whose body is read from the connection when it is streamed
+func (c *Client) exchange(ctx context.Context, conn net.Conn) (*Transmission, error) {
+	if c.unfinished(conn) {
+		return nil, ErrUnfinished
+	}
+
+	r := c.reader(conn)
+
+	if c.ticket != "" {
+		t, err := c.redeemTicket(ctx, conn, r)
+		if err == nil {
+			return t, nil
+		}
+		slog.With("error", err.Error()).Info("ticket is not accepted, solving a challenge")
+	}
+
+	header := c.pending
+	if header == "" {
+		if err := c.askForChallenge(ctx, conn); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if header, err = c.receiveChallenge(ctx, conn, r); err != nil {
+			return nil, err
+		}
+
+		if c.session != "" {
+			c.pending = header
+		}
+	}
+
 	solution, err := c.doProofOfWork(ctx, header)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if err := c.sendSolution(ctx, solution, conn); err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return c.readTransmission(ctx, conn, r)
+}
+
+// Hello sends the offer of the client and returns what the server agreed to. Servers predating
+// the Hello close the connection or reject it as an illegal transition, which is reported as ErrNoHello,
+// the client then goes on without a Hello on a new connection.
+func (c *Client) Hello(ctx context.Context, conn net.Conn) (protocol.Agreement, error) {
+	if c.offer == nil {
+		return protocol.Agreement{}, fmt.Errorf("client.Client.Hello requires an offer")
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := protocol.Send(c.offer.Payload(), conn); err != nil {
+		return protocol.Agreement{}, fmt.Errorf("client.Client.Hello failed: %w", err)
 	}
 
-	resp, err := c.readTransmission(ctx, r)
+	p, err := c.readPayload(conn, c.reader(conn))
+	if errors.Is(err, io.EOF) {
+		return protocol.Agreement{}, ErrNoHello
+	}
 	if err != nil {
-		return "", err
+		return protocol.Agreement{}, fmt.Errorf("client.Client.Hello failed to read payload: %w", err)
 	}
 
-	return resp, nil
+	switch p.Action {
+	case protocol.ServerHello:
+		agreement, err := protocol.ParseAgreement(p.Data)
+		if err != nil {
+			return protocol.Agreement{}, fmt.Errorf("client.Client.Hello received a malformed server hello: %w", err)
+		}
+		if !slices.Contains(c.offer.Versions, agreement.Version) || !slices.Contains(c.offer.Algorithms, agreement.Algorithm) {
+			return protocol.Agreement{}, fmt.Errorf("%w: server picked version %d and algorithm %d", ErrUnsupported, agreement.Version, agreement.Algorithm)
+		}
+		return agreement, nil
+	case protocol.Reject:
+		err := rejectError(p.Data)
+		if errors.Is(err, ErrIllegalTransition) {
+			return protocol.Agreement{}, fmt.Errorf("%w: %w", ErrNoHello, err)
+		}
+		return protocol.Agreement{}, err
+	default:
+		return protocol.Agreement{}, fmt.Errorf("client.Client.Hello received unexpected [%d] action", p.Action)
+	}
+}
+
+// Resume opens a session on the connection, or resumes the session of a former
+// connection, so that the challenge outstanding there and the last ticket carry over.
+// When the server no longer knows the session a new one is opened and the client starts over.
+func (c *Client) Resume(ctx context.Context, conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	r := c.reader(conn)
+	for {
+		p := protocol.Payload{
+			Action: protocol.Resume,
+			Data:   []byte(c.session),
+		}
+		if err := protocol.Send(&p, conn); err != nil {
+			return fmt.Errorf("client.Client.Resume failed: %w", err)
+		}
+
+		rp, err := c.readPayload(conn, r)
+		if err != nil {
+			return fmt.Errorf("client.Client.Resume failed to read payload: %w", err)
+		}
+
+		switch {
+		case rp.Action == protocol.Session:
+			id, ticket := protocol.SplitSession(rp.Data)
+			c.session = id
+			if ticket != "" {
+				c.ticket = ticket
+			}
+			return nil
+		case rp.Action == protocol.Reject && c.session != "":
+			slog.With("error", rejectError(rp.Data).Error()).Info("session is not resumed, starting over")
+			c.session, c.pending = "", ""
+		case rp.Action == protocol.Reject:
+			return fmt.Errorf("client.Client.Resume failed to open session: %w", rejectError(rp.Data))
+		default:
+			return fmt.Errorf("client.Client.Resume received unexpected [%d] action", rp.Action)
+		}
+	}
 }
 
 func (c *Client) askForChallenge(ctx context.Context, conn net.Conn) error {
@@ -95,6 +584,7 @@ func (c *Client) askForChallenge(ctx context.Context, conn net.Conn) error {
 
 	p := protocol.Payload{
 		Action: protocol.Request,
+		Data:   []byte(c.serverName),
 	}
 	b, err := p.Encode()
 	if err != nil {
@@ -128,38 +618,72 @@ func (c *Client) sendSolution(_ context.Context, solution string, conn net.Conn)
 	return nil
 }
 
-func (c *Client) readTransmission(ctx context.Context, r *bufio.Reader) (string, error) {
-	resp, err := r.ReadBytes(protocol.Delimiter)
+func (c *Client) readTransmission(ctx context.Context, conn net.Conn, r *bufio.Reader) (*Transmission, error) {
+	p, err := c.readPayload(conn, r)
 	if err != nil {
-		return "", fmt.Errorf("client.Client.readQoute failed to read bytes: %w", err)
+		return nil, fmt.Errorf("client.Client.readQoute failed to read payload: %w", err)
 	}
 
-	p, err := protocol.Decode(resp)
-	if err != nil {
-		return "", fmt.Errorf("client.Client.readQoute failed to decode payload: %w", err)
-	}
+	// the challenge is answered either way, a resumed session has nothing to go on with
+	c.pending = ""
 
 	switch p.Action {
 	case protocol.Reject:
-		return "", fmt.Errorf("server rejected the solution")
+		return nil, rejectError(p.Data)
 	case protocol.Transmit:
-		return string(p.Data), nil
+		return newTransmission(string(p.Data)), nil
+	case protocol.Ticket:
+		ticket, transmission, ok := protocol.SplitTicket(p.Data)
+		if !ok {
+			return nil, fmt.Errorf("client.Client.readTransmission received a malformed ticket")
+		}
+		c.ticket = ticket
+		return newTransmission(transmission), nil
+	case protocol.TransmitStart:
+		return c.streamed(conn, r, p)
 	default:
-		return "", fmt.Errorf("client.Client.readTransmission received unexpected [%d] action", p.Action)
+		return nil, fmt.Errorf("client.Client.readTransmission received unexpected [%d] action", p.Action)
 	}
 }
 
-func (c *Client) receiveChallenge(ctx context.Context, r *bufio.Reader) (string, error) {
-	resp, err := r.ReadBytes(protocol.Delimiter)
+// redeemTicket presents the ticket instead of a solution, the ticket
+// is forgotten once the server rejects it
+func (c *Client) redeemTicket(_ context.Context, conn net.Conn, r *bufio.Reader) (*Transmission, error) {
+	p := protocol.Payload{
+		Action: protocol.Redeem,
+		Data:   []byte(c.ticket),
+	}
+
+	if err := protocol.Send(&p, conn); err != nil {
+		return nil, fmt.Errorf("client.Client.redeemTicket failed: %w", err)
+	}
+
+	rp, err := c.readPayload(conn, r)
 	if err != nil {
-		return "", fmt.Errorf("client.askForChallenge read challange resp failed: %w", err)
+		return nil, fmt.Errorf("client.Client.redeemTicket failed to read payload: %w", err)
 	}
 
-	slog.Info("challenge received")
-	respPayload, err := protocol.Decode(resp)
+	switch rp.Action {
+	case protocol.Transmit:
+	case protocol.TransmitStart:
+		return c.streamed(conn, r, rp)
+	case protocol.Reject:
+		c.ticket = ""
+		return nil, rejectError(rp.Data)
+	default:
+		c.ticket = ""
+		return nil, fmt.Errorf("client.Client.redeemTicket received unexpected [%d] action", rp.Action)
+	}
+
+	return newTransmission(string(rp.Data)), nil
+}
+
+func (c *Client) receiveChallenge(ctx context.Context, conn net.Conn, r *bufio.Reader) (string, error) {
+	respPayload, err := c.readPayload(conn, r)
 	if err != nil {
-		return "", fmt.Errorf("client.askForChallenge decode resp failed: %w", err)
+		return "", fmt.Errorf("client.askForChallenge read challange resp failed: %w", err)
 	}
+	slog.Info("challenge received")
 
 	if respPayload.Action != protocol.Challenge {
 		return "", fmt.Errorf("client.askForChallenge invalid resp payload action %v", respPayload.Action)
@@ -168,3 +692,22 @@ func (c *Client) receiveChallenge(ctx context.Context, r *bufio.Reader) (string,
 	slog.Info("inspecting", "challenge", string(respPayload.Data))
 	return string(respPayload.Data), nil
 }
+
+// paddedConn pads every datagram written to udpDatagramSize with zero bytes
+type paddedConn struct {
+	net.Conn
+}
+
+func (c paddedConn) Write(b []byte) (int, error) {
+	if len(b) >= udpDatagramSize {
+		return c.Conn.Write(b)
+	}
+
+	padded := make([]byte, udpDatagramSize)
+	copy(padded, b)
+	if _, err := c.Conn.Write(padded); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
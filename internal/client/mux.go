@@ -0,0 +1,12 @@
+package client
+
+import (
+	"github.com/denismitr/antiddos/internal/protocol"
+	"net"
+)
+
+// Multiplex carries streams over the connection once the client solved its challenge on it,
+// e.g. to a server proxying every stream to a backend connection of its own, see protocol.Mux
+func (c *Client) Multiplex(conn net.Conn) *protocol.Mux {
+	return protocol.NewMux(conn, c.reader(conn), true)
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"io"
+	"net"
+	"time"
+)
+
+// Pipeline asks for n transmissions at once: it sends n tagged Requests without waiting
+// for the challenges, sends every Solve as soon as its challenge is solved and matches the
+// responses coming out of order by their ID. The transmissions are returned in the order
+// of the requests. The server has to allow n outstanding challenges on the connection,
+// see server.Server.SetMaxChallenges, and handles up to its pipeline limit at once.
+// Streamed transmissions are read whole, see Stream.
+func (c *Client) Pipeline(ctx context.Context, conn net.Conn, n int) ([]string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if c.unfinished(conn) {
+		return nil, ErrUnfinished
+	}
+
+	// index is the position of the request tagged with an ID
+	index := make(map[uint32]int, n)
+	for i := 0; i < n; i++ {
+		id := c.nextID()
+		index[id] = i
+
+		p := protocol.Payload{
+			Action: protocol.Request,
+			ID:     id,
+			Data:   []byte(c.serverName),
+		}
+		if err := protocol.Send(&p, conn); err != nil {
+			return nil, fmt.Errorf("client.Client.Pipeline failed to send request: %w", err)
+		}
+	}
+
+	r := c.reader(conn)
+	transmissions := make([]string, n)
+	for left := n; left > 0; {
+		p, err := c.readPayload(conn, r)
+		if err != nil {
+			return nil, fmt.Errorf("client.Client.Pipeline failed to read payload: %w", err)
+		}
+
+		i, ok := index[p.ID]
+		if !ok {
+			return nil, fmt.Errorf("client.Client.Pipeline received [%d] action with unknown id %d", p.Action, p.ID)
+		}
+
+		switch p.Action {
+		case protocol.Challenge:
+			solution, err := c.doProofOfWork(ctx, string(p.Data))
+			if err != nil {
+				return nil, err
+			}
+
+			solve := protocol.Payload{
+				Action: protocol.Solve,
+				ID:     p.ID,
+				Data:   []byte(solution),
+			}
+			if err := protocol.Send(&solve, conn); err != nil {
+				return nil, fmt.Errorf("client.Client.Pipeline failed to send solution: %w", err)
+			}
+			continue
+		case protocol.Reject:
+			return nil, fmt.Errorf("client.Client.Pipeline request %d failed: %w", i, rejectError(p.Data))
+		case protocol.Transmit:
+			transmissions[i] = string(p.Data)
+		case protocol.Ticket:
+			ticket, transmission, ok := protocol.SplitTicket(p.Data)
+			if !ok {
+				return nil, fmt.Errorf("client.Client.Pipeline received a malformed ticket")
+			}
+			c.ticket = ticket
+			transmissions[i] = transmission
+		case protocol.TransmitStart:
+			t, err := c.streamed(conn, r, p)
+			if err != nil {
+				return nil, err
+			}
+
+			// the server sends the chunks of a transmission before any other response
+			b, err := io.ReadAll(t.Body)
+			if err != nil {
+				return nil, fmt.Errorf("client.Client.Pipeline failed to read transmission %d: %w", i, err)
+			}
+			transmissions[i] = string(b)
+		default:
+			return nil, fmt.Errorf("client.Client.Pipeline received unexpected [%d] action", p.Action)
+		}
+
+		delete(index, p.ID)
+		left--
+	}
+
+	return transmissions, nil
+}
+
+// nextID returns the ID of the next tagged request, IDs are never zero
+func (c *Client) nextID() uint32 {
+	c.lastID++
+	if c.lastID == 0 {
+		c.lastID++
+	}
+	return c.lastID
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrChecksum   = errors.New("transmission does not match its checksum")
+	ErrTruncated  = errors.New("transmission does not match its size")
+	ErrUnfinished = errors.New("body of the former transmission is not read to the end")
+)
+
+// Transmission is what the server transmits for a solution or a ticket,
+// either sent in a single frame or streamed
+type Transmission struct {
+	// Meta tells what the transmission is, e.g. its content type, empty when not streamed
+	Meta string
+
+	// Size is the number of bytes of the body
+	Size int64
+
+	// Body of a streamed transmission is read from the connection chunk by chunk, it has to be
+	// read to io.EOF before anything else is exchanged on the connection. The last read fails with
+	// ErrChecksum or ErrTruncated when the transmission does not match what the server announced.
+	Body io.Reader
+}
+
+func newTransmission(s string) *Transmission {
+	return &Transmission{Size: int64(len(s)), Body: strings.NewReader(s)}
+}
+
+// Stream redeems the ticket or solves a challenge like Communicate, but returns the transmission
+// with its body unread, so that transmissions too large for a frame are read as they come.
+// The deadline of ctx bounds the exchange, the body is read under the deadlines of conn.
+func (c *Client) Stream(ctx context.Context, conn net.Conn) (*Transmission, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	return c.exchange(ctx, conn)
+}
+
+// streamed returns the transmission announced by the TransmitStart p
+func (c *Client) streamed(conn net.Conn, r *bufio.Reader, p *protocol.Payload) (*Transmission, error) {
+	t, ticket, err := protocol.ParseTransmitStart(p.Data)
+	if err != nil {
+		return nil, fmt.Errorf("client.Client.streamed received a malformed transmission: %w", err)
+	}
+
+	if ticket != "" {
+		c.ticket = ticket
+	}
+
+	c.body = &body{c: c, conn: conn, r: r, id: p.ID, size: t.Size, h: sha256.New()}
+	return &Transmission{Meta: t.Meta, Size: t.Size, Body: c.body}, nil
+}
+
+// unfinished tells whether the body of a transmission streamed on conn is not read to the end
+func (c *Client) unfinished(conn net.Conn) bool {
+	return c.body != nil && c.body.conn == conn && c.body.err == nil
+}
+
+// body reads the chunks of a streamed transmission
+type body struct {
+	c    *Client
+	conn net.Conn
+	r    *bufio.Reader
+	id   uint32
+
+	size, read int64
+	h          hash.Hash
+	chunk      []byte
+	err        error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	for len(b.chunk) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.err = b.next()
+	}
+
+	n := copy(p, b.chunk)
+	b.chunk = b.chunk[n:]
+	return n, nil
+}
+
+// next reads the next chunk, the error ends the body
+func (b *body) next() error {
+	rp, err := b.c.readPayload(b.conn, b.r)
+	if err != nil {
+		return fmt.Errorf("client.body failed to read payload: %w", err)
+	}
+	if rp.ID != b.id {
+		return fmt.Errorf("client.body received [%d] action of another request %d", rp.Action, rp.ID)
+	}
+
+	switch rp.Action {
+	case protocol.TransmitChunk:
+		b.read += int64(len(rp.Data))
+		if b.read > b.size {
+			return fmt.Errorf("%w: more than %d bytes", ErrTruncated, b.size)
+		}
+		b.h.Write(rp.Data)
+		b.chunk = rp.Data
+		return nil
+	case protocol.TransmitEnd:
+		if b.read != b.size {
+			return fmt.Errorf("%w: %d of %d bytes", ErrTruncated, b.read, b.size)
+		}
+		if !bytes.Equal(b.h.Sum(nil), rp.Data) {
+			return ErrChecksum
+		}
+		return io.EOF
+	case protocol.Reject:
+		return rejectError(rp.Data)
+	default:
+		return fmt.Errorf("client.body received unexpected [%d] action", rp.Action)
+	}
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// gate puts handlers behind proof of work, see powhttp.Gate
+type gate interface {
+	Require(zeroes uint8) func(http.Handler) http.Handler
+	Strip(r *http.Request)
+}
+
+// route asks for its own difficulty on the paths starting with prefix
+type route struct {
+	prefix string
+	h      http.Handler
+}
+
+// Gateway is a reverse proxy letting through to an HTTP backend only the clients
+// that solved a challenge, they are let in with the cookie of the gate until it expires
+type Gateway struct {
+	gate   gate
+	proxy  *httputil.ReverseProxy
+	routes []route
+	h      http.Handler
+}
+
+// New creates a gateway to the backend asking every client for the given amount of zeroes
+func New(g gate, backend *url.URL, zeroes uint8) *Gateway {
+	gw := &Gateway{gate: g}
+	gw.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(backend)
+			pr.SetXForwarded()
+			gw.gate.Strip(pr.Out)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.With("error", err.Error()).With("path", r.URL.Path).Error("gateway failed to reach backend")
+			http.Error(w, "backend unavailable", http.StatusBadGateway)
+		},
+	}
+	gw.h = g.Require(zeroes)(gw.proxy)
+
+	return gw
+}
+
+// SetDifficulty asks the clients for another amount of zeroes on the paths starting with prefix,
+// the longest matching prefix wins
+func (gw *Gateway) SetDifficulty(prefix string, zeroes uint8) {
+	gw.routes = append(gw.routes, route{prefix: prefix, h: gw.gate.Require(zeroes)(gw.proxy)})
+	sort.SliceStable(gw.routes, func(i, j int) bool {
+		return len(gw.routes[i].prefix) > len(gw.routes[j].prefix)
+	})
+}
+
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, rt := range gw.routes {
+		if strings.HasPrefix(r.URL.Path, rt.prefix) {
+			rt.h.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	gw.h.ServeHTTP(w, r)
+}
@@ -0,0 +1,188 @@
+package gateway_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/gateway"
+	"github.com/denismitr/antiddos/internal/powhttp"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const cookie = "pow"
+
+// newGateway starts a backend answering with the path and the credentials it got
+func newGateway(t *testing.T, zeroes uint8) *gateway.Gateway {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "path=%s authorization=%s cookie=%s", r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	}))
+	t.Cleanup(backend.Close)
+
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	g := powhttp.New(nope.Nope{}, 30)
+	g.SetSigner(challenge.NewSigner([]byte("secret")))
+	g.SetTokenTTL(time.Minute)
+	g.SetCookie(cookie)
+
+	return gateway.New(g, u, zeroes)
+}
+
+func get(h http.Handler, path, remoteAddr string, modify func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = remoteAddr
+	if modify != nil {
+		modify(r)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// solveFor asks the gateway for a challenge on path and solves it
+func solveFor(t *testing.T, gw http.Handler, path, remoteAddr string) string {
+	t.Helper()
+
+	w := get(gw, path, remoteAddr, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	header := strings.TrimSuffix(strings.TrimPrefix(w.Header().Get("WWW-Authenticate"), powhttp.Scheme+` header="`), `"`)
+	zeroes, err := strconv.ParseUint(strings.Split(header, challenge.HeaderDelimiter)[1], 10, 8)
+	require.NoError(t, err)
+
+	solved, err := challenge.New(nope.Nope{}, uint8(zeroes), 30).Solve(header)
+	require.NoError(t, err)
+	return solved
+}
+
+// passCookie solves the challenge of path and returns the cookie the gateway sets
+func passCookie(t *testing.T, gw http.Handler, path, remoteAddr string) *http.Cookie {
+	t.Helper()
+
+	solved := solveFor(t, gw, path, remoteAddr)
+	w := get(gw, path, remoteAddr, func(r *http.Request) {
+		r.Header.Set("Authorization", powhttp.Scheme+" "+solved)
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookie {
+			return c
+		}
+	}
+
+	t.Fatal("no cookie was set")
+	return nil
+}
+
+func TestGateway(t *testing.T) {
+	gw := newGateway(t, 2)
+	const client = "192.0.2.1:1234"
+
+	t.Run("browsers get a challenge page", func(t *testing.T) {
+		w := get(gw, "/page", client, func(r *http.Request) {
+			r.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), powhttp.Scheme)
+		assert.Contains(t, w.Body.String(), "crypto.subtle")
+	})
+
+	t.Run("other clients get a 401 challenge", func(t *testing.T) {
+		w := get(gw, "/page", client, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NotContains(t, w.Body.String(), "<html>")
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), powhttp.Scheme)
+	})
+
+	t.Run("solution is proxied and sets a cookie", func(t *testing.T) {
+		solved := solveFor(t, gw, "/page", client)
+		w := get(gw, "/page", client, func(r *http.Request) {
+			r.Header.Set("Authorization", powhttp.Scheme+" "+solved)
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "path=/page authorization= cookie=", w.Body.String())
+
+		var c *http.Cookie
+		for _, rc := range w.Result().Cookies() {
+			if rc.Name == cookie {
+				c = rc
+			}
+		}
+		require.NotNil(t, c)
+		assert.True(t, c.HttpOnly)
+		assert.Equal(t, int(time.Minute.Seconds()), c.MaxAge)
+	})
+
+	t.Run("cookie lets the client in without solving", func(t *testing.T) {
+		c := passCookie(t, gw, "/", client)
+
+		w := get(gw, "/other", client, func(r *http.Request) {
+			r.AddCookie(c)
+			r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "path=/other authorization= cookie=theme=dark", w.Body.String(), "the cookie of the gateway is not forwarded")
+	})
+
+	t.Run("cookie is bound to the client address", func(t *testing.T) {
+		c := passCookie(t, gw, "/", client)
+
+		w := get(gw, "/", "192.0.2.2:1234", func(r *http.Request) {
+			r.AddCookie(c)
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("tampered cookie", func(t *testing.T) {
+		c := passCookie(t, gw, "/", client)
+		c.Value = "9" + c.Value[1:]
+
+		w := get(gw, "/", client, func(r *http.Request) {
+			r.AddCookie(c)
+		})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestGateway_Difficulty(t *testing.T) {
+	gw := newGateway(t, 2)
+	gw.SetDifficulty("/admin", 3)
+	gw.SetDifficulty("/admin/public", 1)
+	const client = "192.0.2.1:1234"
+
+	header := func(path string) string {
+		return get(gw, path, client, nil).Header().Get("WWW-Authenticate")
+	}
+	assert.Contains(t, header("/"), `header="1|2|`)
+	assert.Contains(t, header("/admin/users"), `header="1|3|`)
+	assert.Contains(t, header("/admin/public/logo.png"), `header="1|1|`)
+
+	easy := passCookie(t, gw, "/", client)
+	w := get(gw, "/admin/users", client, func(r *http.Request) {
+		r.AddCookie(easy)
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "cookie of an easier path does not open a harder one")
+
+	hard := passCookie(t, gw, "/admin/users", client)
+	for _, path := range []string{"/", "/admin/users"} {
+		w := get(gw, path, client, func(r *http.Request) {
+			r.AddCookie(hard)
+		})
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+}
@@ -0,0 +1,464 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/denismitr/antiddos/internal/websocket"
+)
+
+const (
+	// maxBodySize bounds the body of a solve request, a solved header is way shorter
+	maxBodySize = 4 << 10
+
+	contentTypeJSON = "application/json"
+	contentTypeText = "text/plain; charset=utf-8"
+
+	// socketIdleTimeout closes WebSocket connections sending nothing for that long
+	socketIdleTimeout = 5 * time.Minute
+
+	// ticketHeader carries the ticket issued along with a plain text transmission
+	ticketHeader = "PoW-Ticket"
+)
+
+type requestHandler interface {
+	Handle(
+		ctx context.Context,
+		req []byte,
+		clientIP string,
+	) (*protocol.Payload, error)
+}
+
+// challengeResponse is the JSON body of GET /challenge
+type challengeResponse struct {
+	Header string `json:"header"`
+}
+
+// solveRequest is the JSON body of POST /solve
+type solveRequest struct {
+	Header string `json:"header"`
+}
+
+// redeemRequest is the JSON body of POST /redeem
+type redeemRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+// transmitResponse is the JSON body of a successful POST /solve or POST /redeem
+type transmitResponse struct {
+	Transmission string `json:"transmission"`
+	Ticket       string `json:"ticket,omitempty"`
+}
+
+// errorResponse is the JSON body of a failed request, rejections
+// come with the reason code and the hints of the protocol
+type errorResponse struct {
+	Error      string `json:"error"`
+	Reason     uint16 `json:"reason,omitempty"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+	Difficulty uint8  `json:"difficulty,omitempty"`
+}
+
+// Handler is an HTTP front end of the protocol:
+// GET /challenge returns a challenge header, POST /solve takes the solved header
+// and returns the transmission or 403 with the reason of the rejection.
+// When the protocol issues tickets, the ticket comes along with the transmission
+// and POST /redeem takes it instead of a solved header.
+// Bodies are JSON when the request asks for it, plain text otherwise.
+// /ws carries the binary frames of the protocol over WebSocket, a frame per message.
+type Handler struct {
+	rh      requestHandler
+	proxies trust.Networks
+	origins []string
+	mux     *http.ServeMux
+
+	maxChallenges int
+	challengeTTL  time.Duration
+
+	mu      sync.Mutex
+	sockets map[*websocket.Conn]struct{}
+}
+
+func New(rh requestHandler) *Handler {
+	h := &Handler{
+		rh:      rh,
+		mux:     http.NewServeMux(),
+		sockets: make(map[*websocket.Conn]struct{}),
+	}
+
+	h.mux.HandleFunc("/challenge", h.challenge)
+	h.mux.HandleFunc("/solve", h.solve)
+	h.mux.HandleFunc("/redeem", h.redeem)
+	h.mux.HandleFunc("/ws", h.socket)
+
+	return h
+}
+
+// SetTrustedProxies makes the handler take the client address from the
+// Forwarded, X-Forwarded-For or X-Real-IP headers set by the given networks
+func (h *Handler) SetTrustedProxies(networks trust.Networks) {
+	h.proxies = networks
+}
+
+// SetAllowedOrigins lets browsers open WebSocket connections from pages of other origins,
+// given as scheme://host[:port] or * for any. Pages of the same host are always allowed,
+// and so are clients sending no Origin, since only browsers do.
+func (h *Handler) SetAllowedOrigins(origins []string) {
+	h.origins = origins
+}
+
+// SetMaxChallenges keeps the state of the exchange on every WebSocket connection,
+// see server.Server.SetMaxChallenges
+func (h *Handler) SetMaxChallenges(n int) {
+	h.maxChallenges = n
+}
+
+// SetChallengeTTL tells how long a challenge issued on a WebSocket connection can be solved,
+// see server.Server.SetChallengeTTL
+func (h *Handler) SetChallengeTTL(ttl time.Duration) {
+	h.challengeTTL = ttl
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// CloseSockets asks the clients of all WebSocket connections to go away,
+// http.Server.Shutdown does not wait for them since they are hijacked
+func (h *Handler) CloseSockets() {
+	h.mu.Lock()
+	sockets := make([]*websocket.Conn, 0, len(h.sockets))
+	for conn := range h.sockets {
+		sockets = append(sockets, conn)
+	}
+	h.mu.Unlock()
+
+	for _, conn := range sockets {
+		_ = conn.WriteClose(websocket.CloseGoingAway, "server is shutting down")
+	}
+}
+
+func (h *Handler) challenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		h.fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	p, err := h.exchange(r, &protocol.Payload{Action: protocol.Request})
+	if err != nil {
+		slog.With("error", err.Error()).Error("httpapi.Handler.challenge failed to process request")
+		h.fail(w, r, http.StatusInternalServerError, "failed to create a challenge")
+		return
+	}
+
+	if p.Action != protocol.Challenge {
+		h.fail(w, r, http.StatusInternalServerError, "unexpected response")
+		return
+	}
+
+	h.respond(w, r, http.StatusOK, string(p.Data), challengeResponse{Header: string(p.Data)})
+}
+
+func (h *Handler) solve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	header, err := readValue(w, r, &solveRequest{})
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	p, err := h.exchange(r, &protocol.Payload{Action: protocol.Solve, Data: []byte(header)})
+	if err != nil {
+		slog.With("error", err.Error()).Error("httpapi.Handler.solve failed to process request")
+		h.fail(w, r, http.StatusBadRequest, "invalid solution")
+		return
+	}
+
+	h.transmit(w, r, p)
+}
+
+func (h *Handler) redeem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ticket, err := readValue(w, r, &redeemRequest{})
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	p, err := h.exchange(r, &protocol.Payload{Action: protocol.Redeem, Data: []byte(ticket)})
+	if err != nil {
+		slog.With("error", err.Error()).Error("httpapi.Handler.redeem failed to process request")
+		h.fail(w, r, http.StatusBadRequest, "invalid ticket")
+		return
+	}
+
+	h.transmit(w, r, p)
+}
+
+// transmit answers with the transmission of p, or with the reason it was rejected
+func (h *Handler) transmit(w http.ResponseWriter, r *http.Request, p *protocol.Payload) {
+	switch p.Action {
+	case protocol.Transmit:
+		h.respond(w, r, http.StatusOK, string(p.Data), transmitResponse{Transmission: string(p.Data)})
+	case protocol.Ticket:
+		ticket, transmission, _ := protocol.SplitTicket(p.Data)
+		w.Header().Set(ticketHeader, ticket)
+		h.respond(w, r, http.StatusOK, transmission, transmitResponse{Transmission: transmission, Ticket: ticket})
+	case protocol.TransmitStart:
+		h.stream(w, p)
+	case protocol.Reject:
+		h.reject(w, r, p.Data)
+	default:
+		h.fail(w, r, http.StatusInternalServerError, "unexpected response")
+	}
+}
+
+// stream answers with the body of a streamed transmission, its metadata is the content type
+func (h *Handler) stream(w http.ResponseWriter, p *protocol.Payload) {
+	defer p.CloseBody()
+
+	t, ticket, err := protocol.ParseTransmitStart(p.Data)
+	if err != nil {
+		slog.With("error", err.Error()).Error("httpapi.Handler.stream received a malformed transmission")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if ticket != "" {
+		w.Header().Set(ticketHeader, ticket)
+	}
+	if t.Meta != "" {
+		w.Header().Set("Content-Type", t.Meta)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(t.Size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.CopyN(w, p.Body, t.Size); err != nil {
+		slog.With("error", err.Error()).Error("httpapi.Handler.stream failed to send transmission")
+	}
+}
+
+func (h *Handler) socket(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); !h.originAllowed(origin, r.Host) {
+		slog.With("origin", origin, "client", h.proxies.ClientIP(r)).Info("httpapi.Handler.socket rejected origin")
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		slog.With("error", err.Error()).Info("httpapi.Handler.socket rejected handshake")
+		return
+	}
+
+	h.mu.Lock()
+	h.sockets[conn] = struct{}{}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.sockets, conn)
+		h.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	conn.SetReadLimit(protocol.MaxFrameSize)
+	clientIP := h.proxies.ClientIP(r)
+	slog.With("client", clientIP).Info("new websocket client")
+
+	var machine *protocol.Machine
+	if h.maxChallenges > 0 {
+		machine = protocol.NewMachine(h.maxChallenges)
+		if h.challengeTTL > 0 {
+			machine.SetChallengeTTL(h.challengeTTL)
+		}
+	}
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(socketIdleTimeout))
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.With("error", err.Error()).Error("httpapi.Handler.socket failed to read message")
+			}
+			return
+		}
+
+		// a message carries exactly one frame, Handle trusts the frame to be whole
+		frame, rest, err := protocol.SplitFrame(msg)
+		if err != nil || frame == nil || len(rest) > 0 {
+			slog.With("client", clientIP).Error("httpapi.Handler.socket received a malformed message")
+			return
+		}
+
+		var p *protocol.Payload
+		if machine != nil {
+			p, err = machine.Handle(r.Context(), h.rh, frame, clientIP)
+		} else {
+			p, err = h.rh.Handle(r.Context(), frame, clientIP)
+		}
+		if err != nil {
+			slog.With("error", err.Error()).Error("httpapi.Handler.socket failed to process message")
+			return
+		}
+
+		if req, err := protocol.Decode(msg); err == nil {
+			p.ID = req.ID
+		}
+		if err := protocol.Send(p, conn); err != nil {
+			slog.With("error", err.Error()).Error("httpapi.Handler.socket failed to send response")
+			return
+		}
+	}
+}
+
+func (h *Handler) exchange(r *http.Request, p *protocol.Payload) (*protocol.Payload, error) {
+	req, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return h.rh.Handle(r.Context(), req, h.proxies.ClientIP(r))
+}
+
+// bodyRequest is a JSON body carrying a single value
+type bodyRequest interface {
+	value() (string, error)
+}
+
+func (req *solveRequest) value() (string, error) {
+	if req.Header == "" {
+		return "", errors.New("header is missing")
+	}
+	return req.Header, nil
+}
+
+func (req *redeemRequest) value() (string, error) {
+	if req.Ticket == "" {
+		return "", errors.New("ticket is missing")
+	}
+	return req.Ticket, nil
+}
+
+// readValue reads the value of the body, which is either the value
+// as plain text or a JSON body decoded into req
+func readValue(w http.ResponseWriter, r *http.Request, req bodyRequest) (string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+
+	if !isJSON(r.Header.Get("Content-Type")) {
+		return strings.TrimSpace(string(body)), nil
+	}
+
+	if err := json.Unmarshal(body, req); err != nil {
+		return "", fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	return req.value()
+}
+
+func (h *Handler) respond(w http.ResponseWriter, r *http.Request, status int, text string, body any) {
+	if !wantsJSON(r) {
+		w.Header().Set("Content-Type", contentTypeText)
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, text)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.With("error", err.Error()).Error("httpapi.Handler.respond failed to encode body")
+	}
+}
+
+// reject answers with the reason of the rejection, Retry-After carries the hint of the protocol
+func (h *Handler) reject(w http.ResponseWriter, r *http.Request, data []byte) {
+	rejection, err := protocol.ParseReject(data)
+	if err != nil {
+		h.fail(w, r, http.StatusInternalServerError, "unexpected response")
+		return
+	}
+
+	retryAfter := int64(rejection.RetryAfter.Seconds())
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+
+	h.respond(w, r, http.StatusForbidden, rejection.Error(), errorResponse{
+		Error:      rejection.Error(),
+		Reason:     uint16(rejection.Reason),
+		RetryAfter: retryAfter,
+		Difficulty: rejection.Difficulty,
+	})
+}
+
+func (h *Handler) fail(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	h.respond(w, r, status, reason, errorResponse{Error: reason})
+}
+
+// wantsJSON reports whether the client asked for JSON, either explicitly
+// or by sending a JSON body
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isJSON(accept) {
+			return true
+		}
+	}
+	return isJSON(r.Header.Get("Content-Type"))
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(contentType))
+	return err == nil && mediaType == contentTypeJSON
+}
+
+// originAllowed tells whether a page of origin may open a WebSocket connection to host,
+// so that other sites cannot use the connections of their visitors
+func (h *Handler) originAllowed(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+
+	for _, allowed := range h.origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
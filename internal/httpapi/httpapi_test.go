@@ -0,0 +1,259 @@
+package httpapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/httpapi"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/quotes"
+	"github.com/denismitr/antiddos/internal/store/adapters/embedded"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const zeroes = 2
+
+func newHandler(t *testing.T) *httpapi.Handler {
+	t.Helper()
+
+	c := challenge.New(nope.Nope{}, zeroes, 30)
+	c.SetSigner(challenge.NewSigner([]byte("secret")))
+	return httpapi.New(protocol.New(c, quotes.New()))
+}
+
+func solve(t *testing.T, header string) string {
+	t.Helper()
+
+	solved, err := challenge.New(nope.Nope{}, zeroes, 30).Solve(header)
+	require.NoError(t, err)
+	return solved
+}
+
+func do(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandler_Text(t *testing.T) {
+	h := newHandler(t)
+
+	w := do(h, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+
+	solved := solve(t, w.Body.String())
+
+	w = do(h, httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader(solved)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Body.String())
+}
+
+func TestHandler_JSON(t *testing.T) {
+	h := newHandler(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/challenge", nil)
+	r.Header.Set("Accept", "application/json")
+	w := do(h, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var c struct {
+		Header string `json:"header"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&c))
+
+	body, err := json.Marshal(map[string]string{"header": solve(t, c.Header)})
+	require.NoError(t, err)
+
+	r = httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+	w = do(h, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tr struct {
+		Transmission string `json:"transmission"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.NotEmpty(t, tr.Transmission)
+}
+
+func TestHandler_Errors(t *testing.T) {
+	h := newHandler(t)
+
+	t.Run("wrong method", func(t *testing.T) {
+		w := do(h, httptest.NewRequest(http.MethodPost, "/challenge", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		assert.Equal(t, http.MethodGet, w.Header().Get("Allow"))
+
+		w = do(h, httptest.NewRequest(http.MethodGet, "/solve", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		assert.Equal(t, http.MethodPost, w.Header().Get("Allow"))
+	})
+
+	t.Run("invalid header is rejected", func(t *testing.T) {
+		w := do(h, httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader("1|2|3|4|5")))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid header")
+	})
+
+	t.Run("tampered challenge is rejected", func(t *testing.T) {
+		w := do(h, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		tampered := strings.Replace(solve(t, w.Body.String()), "192.0.2.1", "192.0.2.2", 1)
+		w = do(h, httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader(tampered)))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader("{"))
+		r.Header.Set("Content-Type", "application/json")
+		w := do(h, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader(strings.Repeat("a", 8<<10)))
+		w := do(h, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestHandler_TrustedProxies(t *testing.T) {
+	proxies, err := trust.ParseNetworks([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	h := newHandler(t)
+	h.SetTrustedProxies(proxies)
+
+	tt := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{
+			name:       "X-Forwarded-For from a trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "X-Forwarded-For",
+			value:      "192.0.2.1, 10.0.0.2",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "Forwarded from a trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "Forwarded",
+			value:      `for="192.0.2.1:4321";proto=https`,
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "X-Forwarded-For from anyone else is ignored",
+			remoteAddr: "192.0.2.1:1234",
+			header:     "X-Forwarded-For",
+			value:      "198.51.100.1",
+			want:       "192.0.2.1",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/challenge", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header.Set(tc.header, tc.value)
+			w := do(h, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			// the client address is the resource of the challenge
+			segments := strings.Split(w.Body.String(), challenge.HeaderDelimiter)
+			require.Len(t, segments, 6)
+			assert.Equal(t, tc.want, segments[3])
+		})
+	}
+}
+
+func TestHandler_Tickets(t *testing.T) {
+	store, err := embedded.New(context.Background(), 30)
+	require.NoError(t, err)
+
+	signer := challenge.NewSigner([]byte("secret"))
+	c := challenge.New(nope.Nope{}, zeroes, 30)
+	c.SetSigner(signer)
+	p := protocol.New(c, quotes.New())
+	p.SetTickets(challenge.NewTickets(store, signer, 1, time.Second, time.Minute))
+	h := httpapi.New(p)
+
+	w := do(h, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	r := httptest.NewRequest(http.MethodPost, "/solve", strings.NewReader(solve(t, w.Body.String())))
+	r.Header.Set("Accept", "application/json")
+	w = do(h, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tr struct {
+		Transmission string `json:"transmission"`
+		Ticket       string `json:"ticket"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tr))
+	assert.NotEmpty(t, tr.Transmission)
+	require.NotEmpty(t, tr.Ticket)
+	assert.Equal(t, tr.Ticket, w.Header().Get("PoW-Ticket"))
+
+	w = do(h, httptest.NewRequest(http.MethodPost, "/redeem", strings.NewReader(tr.Ticket)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Body.String())
+
+	w = do(h, httptest.NewRequest(http.MethodPost, "/redeem", strings.NewReader(tr.Ticket)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), protocol.ReasonReplay.String())
+}
+
+func TestHandler_SocketOrigin(t *testing.T) {
+	h := newHandler(t)
+	h.SetAllowedOrigins([]string{"https://app.example.com"})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	tt := []struct {
+		name   string
+		origin string
+		want   int
+	}{
+		{name: "no origin", want: http.StatusSwitchingProtocols},
+		{name: "same host", origin: srv.URL, want: http.StatusSwitchingProtocols},
+		{name: "allowed origin", origin: "https://app.example.com", want: http.StatusSwitchingProtocols},
+		{name: "other site", origin: "https://evil.example.com", want: http.StatusForbidden},
+		{name: "scheme of the allowed host", origin: "http://app.example.com", want: http.StatusForbidden},
+		{name: "garbage", origin: "null", want: http.StatusForbidden},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, srv.URL+"/ws", nil)
+			require.NoError(t, err)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			r.Header.Set("Sec-WebSocket-Version", "13")
+			r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+
+			resp, err := http.DefaultClient.Do(r)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, tc.want, resp.StatusCode)
+		})
+	}
+}
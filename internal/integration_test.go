@@ -1,18 +1,40 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/denismitr/antiddos/internal/bootstrap"
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/client"
+	"github.com/denismitr/antiddos/internal/httpapi"
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/proxy"
 	"github.com/denismitr/antiddos/internal/quotes"
+	"github.com/denismitr/antiddos/internal/server"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/denismitr/antiddos/internal/tlsconfig"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/denismitr/antiddos/internal/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestIntegration(t *testing.T) {
 	serverCtx, cancel := context.WithCancel(context.Background())
-	s, err := bootstrap.TcpServer(serverCtx, 30, 3, "127.0.0.1", 3333)
+	s, err := bootstrap.TcpServer(serverCtx, 30, 3, nil, "127.0.0.1", 3333)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -25,6 +47,8 @@ func TestIntegration(t *testing.T) {
 		}
 	}()
 
+	<-s.Ready()
+
 	t.Run("client with valid interaction", func(t *testing.T) {
 		c := bootstrap.TcpClient(3, 30, "127.0.0.1", 3333)
 		conn, closer, err := c.Connect()
@@ -69,3 +93,1149 @@ func TestIntegration(t *testing.T) {
 		assert.Equal(t, "", quote)
 	})
 }
+
+func TestIntegration_Replay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// signed challenges are not remembered, yet they are solved only once
+	p, err := bootstrap.Protocol(ctx, 30, 3, []byte("secret"))
+	require.NoError(t, err)
+
+	s := server.New("127.0.0.1:0", p)
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+
+	conn, err := net.Dial("tcp", s.Listeners()[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	header := roundTrip(t, conn, r, &protocol.Payload{Action: protocol.Request})
+	require.Equal(t, protocol.Challenge, header.Action)
+
+	solve := &protocol.Payload{Action: protocol.Solve, Data: header.Data}
+	assert.Equal(t, protocol.Transmit, roundTrip(t, conn, r, solve).Action)
+	rejected(t, roundTrip(t, conn, r, solve), protocol.ReasonReplay)
+}
+
+func TestIntegration_ListenerHandoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secret := []byte("shared secret of both processes")
+
+	parent, err := bootstrap.TcpServer(ctx, 30, 3, secret, "127.0.0.1", 3334)
+	require.NoError(t, err)
+
+	parentErr := make(chan error, 1)
+	go func() {
+		parentErr <- parent.Run(ctx)
+	}()
+	<-parent.Ready()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:3334")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+	resp, err := protocol.ReadFrame(bufio.NewReader(conn))
+	require.NoError(t, err)
+	p, err := protocol.Decode(resp)
+	require.NoError(t, err)
+	require.Equal(t, protocol.Challenge, p.Action)
+	header := string(p.Data)
+
+	// hand the listening socket over the same way an upgraded process inherits it
+	f, err := parent.Listeners()[0].(*net.TCPListener).File()
+	require.NoError(t, err)
+	inherited, err := net.FileListener(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	child, err := bootstrap.TcpServer(ctx, 30, 3, secret, "127.0.0.1", 3334)
+	require.NoError(t, err)
+	child.SetListeners([]net.Listener{inherited})
+	go func() {
+		if err := child.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-child.Ready()
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer drainCancel()
+	require.NoError(t, parent.Shutdown(drainCtx))
+	assert.ErrorIs(t, <-parentErr, server.ErrServerClosed)
+
+	// the idle connection of the parent got closed during the drain, with a goodbye
+	r := bufio.NewReader(conn)
+	goodbye, err := protocol.ReadFrame(r)
+	require.NoError(t, err)
+	p, err = protocol.Decode(goodbye)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Close, p.Action)
+	rejection, err := protocol.ParseReject(p.Data)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ReasonShutdown, rejection.Reason)
+
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+
+	t.Run("challenge issued by the parent is solved with the child", func(t *testing.T) {
+		solution, err := challenge.New(nope.Nope{}, 3, 30).Solve(header)
+		require.NoError(t, err)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:3334")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Solve, Data: []byte(solution)}, conn))
+		resp, err := protocol.ReadFrame(bufio.NewReader(conn))
+		require.NoError(t, err)
+		p, err := protocol.Decode(resp)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.Transmit, p.Action)
+	})
+}
+
+func TestIntegration_TLS(t *testing.T) {
+	ca := generateCert(t, "ca", nil)
+	serverCert := generateCert(t, "server", ca)
+	clientCert := generateCert(t, "client", ca)
+	selfSigned := generateCert(t, "self-signed", nil)
+	stranger := generateCert(t, "stranger", generateCert(t, "another-ca", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runTLSServer := func(t *testing.T, port int, cert *testCert, clientCA string) {
+		s, err := bootstrap.TcpServer(ctx, 30, 3, nil, "127.0.0.1", port)
+		require.NoError(t, err)
+
+		cfg, err := tlsconfig.Server(cert.certFile, cert.keyFile, "1.2", clientCA)
+		require.NoError(t, err)
+		s.SetTLSConfig(cfg)
+
+		go func() {
+			if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+		}()
+		<-s.Ready()
+	}
+
+	communicate := func(t *testing.T, port int, cfg *tls.Config) (string, error) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		c.SetTLSConfig(cfg)
+
+		conn, closer, err := c.Connect()
+		if err != nil {
+			return "", err
+		}
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		return c.Communicate(clientCtx, conn)
+	}
+
+	runTLSServer(t, 3335, serverCert, "")
+	runTLSServer(t, 3336, selfSigned, "")
+	runTLSServer(t, 3337, serverCert, ca.certFile)
+
+	tests := []struct {
+		name    string
+		port    int
+		ca      string
+		pins    []string
+		cert    *testCert
+		wantErr bool
+	}{
+		{name: "server verified by CA", port: 3335, ca: ca.certFile},
+		{name: "server verified by CA and pinned key", port: 3335, ca: ca.certFile, pins: []string{tlsconfig.SPKIHash(serverCert.cert)}},
+		{name: "server verified by CA and pinned CA key", port: 3335, ca: ca.certFile, pins: []string{tlsconfig.SPKIHash(ca.cert)}},
+		{name: "unknown CA", port: 3335, ca: selfSigned.certFile, wantErr: true},
+		{name: "pin mismatch", port: 3335, ca: ca.certFile, pins: []string{tlsconfig.SPKIHash(selfSigned.cert)}, wantErr: true},
+		{name: "self-signed server trusted by pin", port: 3336, pins: []string{tlsconfig.SPKIHash(selfSigned.cert)}},
+		{name: "self-signed server with another pin", port: 3336, pins: []string{tlsconfig.SPKIHash(serverCert.cert)}, wantErr: true},
+		{name: "mutual TLS with client certificate", port: 3337, ca: ca.certFile, cert: clientCert},
+		{name: "mutual TLS without client certificate", port: 3337, ca: ca.certFile, wantErr: true},
+		{name: "mutual TLS with unknown client certificate", port: 3337, ca: ca.certFile, cert: stranger, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var certFile, keyFile string
+			if tc.cert != nil {
+				certFile, keyFile = tc.cert.certFile, tc.cert.keyFile
+			}
+
+			cfg, err := tlsconfig.Client(tc.ca, "localhost", "1.2", tc.pins, certFile, keyFile)
+			require.NoError(t, err)
+
+			quote, err := communicate(t, tc.port, cfg)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Contains(t, quotes.Quotes, quote)
+		})
+	}
+}
+
+func TestIntegration_WebSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := bootstrap.Protocol(ctx, 30, 3, nil)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(httpapi.New(p))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	t.Run("several exchanges over a connection", func(t *testing.T) {
+		c := bootstrap.WebSocketClient(3, 30, url)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		for i := 0; i < 3; i++ {
+			clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+			quote, err := c.Communicate(clientCtx, conn)
+			clientCancel()
+			require.NoError(t, err)
+			assert.Contains(t, quotes.Quotes, quote)
+		}
+	})
+
+	t.Run("client with invalid zeroes", func(t *testing.T) {
+		c := bootstrap.WebSocketClient(2, 30, url)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		_, err = c.Communicate(clientCtx, conn)
+		assert.Error(t, err)
+	})
+
+	t.Run("message shorter than a frame", func(t *testing.T) {
+		conn, err := websocket.Dial(ctx, url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage([]byte{1, 0}))
+		_, err = conn.ReadMessage()
+		assert.Error(t, err)
+	})
+
+	t.Run("plain HTTP request to the endpoint", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/ws")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestIntegration_UDP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := bootstrap.UdpServer(ctx, 30, 3, []byte("secret"), "127.0.0.1:3338")
+	require.NoError(t, err)
+
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+
+	c := bootstrap.UdpClient(3, 30, "127.0.0.1", 3338)
+	conn, closer, err := c.Connect()
+	require.NoError(t, err)
+	defer closer()
+
+	for i := 0; i < 3; i++ {
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		quote, err := c.Communicate(clientCtx, conn)
+		clientCancel()
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+	}
+}
+
+func TestIntegration_Proxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the backend echoes what it gets and says bye once the client is done writing
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+				_, _ = conn.Write([]byte("bye"))
+			}()
+		}
+	}()
+
+	reg := metrics.NewRegistry()
+	up := proxy.New(backend.Addr().String())
+	up.SetMetrics(reg)
+
+	// runProxy serves a strict protocol in front of u, like the server does in proxy mode
+	runProxy := func(t *testing.T, port int, u *proxy.Proxy, multiplexing bool) *server.Server {
+		p, err := bootstrap.Protocol(ctx, 30, 3, nil)
+		require.NoError(t, err)
+		p.SetStrict(true)
+
+		s := server.New(fmt.Sprintf("127.0.0.1:%d", port), p)
+		s.SetUpstream(u)
+		s.SetMultiplexing(multiplexing)
+		go func() {
+			if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+		}()
+		<-s.Ready()
+		return s
+	}
+
+	runProxy(t, 3339, up, false)
+
+	t.Run("solved connection is spliced with the backend", func(t *testing.T) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", 3339)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		transmission, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Empty(t, transmission)
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "hellobye", string(b))
+
+		assert.Equal(t, int64(5), reg.Counter("proxy.bytes_up").Value())
+		assert.Equal(t, int64(8), reg.Counter("proxy.bytes_down").Value())
+	})
+
+	t.Run("challenge is not let through unless the client solved it", func(t *testing.T) {
+		// solve asks for a challenge on a connection of its own and answers with solution(header)
+		solve := func(t *testing.T, solution func(header string) string) (resp *protocol.Payload, header string) {
+			conn, err := net.Dial("tcp", "127.0.0.1:3339")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+			header = string(roundTrip(t, conn, r, &protocol.Payload{Action: protocol.Request}).Data)
+			return roundTrip(t, conn, r, &protocol.Payload{Action: protocol.Solve, Data: []byte(solution(header))}), header
+		}
+
+		solver := challenge.New(nope.Nope{}, 3, 30)
+		solved := func(header string) string {
+			solution, err := solver.Solve(header)
+			require.NoError(t, err)
+			return solution
+		}
+
+		// the header of the challenge comes back as it is, the server does not do the work
+		resp, header := solve(t, func(header string) string { return header })
+		rejected(t, resp, protocol.ReasonNotSolved)
+
+		// a solution is bound to the connection its challenge was issued to
+		stolen := solved(header)
+		resp, _ = solve(t, func(string) string { return stolen })
+		rejected(t, resp, protocol.ReasonBadBinding)
+
+		resp, _ = solve(t, solved)
+		assert.Equal(t, protocol.Transmit, resp.Action)
+	})
+
+	t.Run("streams of a solved connection are spliced with backends of their own", func(t *testing.T) {
+		s := runProxy(t, 0, up, true)
+
+		port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		_, err = c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+
+		m := c.Multiplex(conn)
+		defer m.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			st, err := m.Open()
+			require.NoError(t, err)
+			msg := fmt.Sprintf("hello %d", i)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer st.Close()
+
+				_, err := st.Write([]byte(msg))
+				assert.NoError(t, err)
+				assert.NoError(t, st.CloseWrite())
+
+				assert.NoError(t, st.SetReadDeadline(time.Now().Add(3*time.Second)))
+				b, err := io.ReadAll(st)
+				assert.NoError(t, err)
+				assert.Equal(t, msg+"bye", string(b))
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("unreachable backend rejects the solution", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		require.NoError(t, closed.Close())
+
+		s := runProxy(t, 0, proxy.New(closed.Addr().String()), false)
+
+		port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		_, err = c.Communicate(clientCtx, conn)
+		assert.ErrorContains(t, err, "rejected")
+		assert.ErrorIs(t, err, client.ErrUnavailable)
+
+		var rejectErr *client.RejectError
+		require.ErrorAs(t, err, &rejectErr)
+		assert.Equal(t, 5*time.Second, rejectErr.RetryAfter)
+	})
+}
+
+// roundTrip sends p on conn and reads the response from r
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, p *protocol.Payload) *protocol.Payload {
+	t.Helper()
+
+	require.NoError(t, protocol.Send(p, conn))
+	frame, err := protocol.ReadFrame(r)
+	require.NoError(t, err)
+	resp, err := protocol.Decode(frame)
+	require.NoError(t, err)
+	return resp
+}
+
+// rejected asserts that p rejects with the reason
+func rejected(t *testing.T, p *protocol.Payload, reason protocol.Reason) {
+	t.Helper()
+
+	require.Equal(t, protocol.Reject, p.Action)
+	rejection, err := protocol.ParseReject(p.Data)
+	require.NoError(t, err)
+	assert.Equal(t, reason, rejection.Reason)
+}
+
+func TestIntegration_SNI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert := generateCert(t, "backend", generateCert(t, "ca", nil))
+	pair, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+	require.NoError(t, err)
+
+	// every TLS backend greets the client with its name and the server name it was asked for
+	runBackend := func(name string) *proxy.Proxy {
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					defer conn.Close()
+					tc := conn.(*tls.Conn)
+					if err := tc.Handshake(); err != nil {
+						return
+					}
+					_, _ = tc.Write([]byte(name + " " + tc.ConnectionState().ServerName))
+				}()
+			}
+		}()
+
+		return proxy.New(l.Addr().String())
+	}
+
+	s, err := bootstrap.TcpServer(ctx, 30, 3, nil, "127.0.0.1", 0)
+	require.NoError(t, err)
+
+	easy, err := bootstrap.Protocol(ctx, 30, 2, nil)
+	require.NoError(t, err)
+	easy.SetStrict(true)
+	s.AddRoute("a.test", easy, runBackend("backend a"))
+
+	hard, err := bootstrap.Protocol(ctx, 30, 4, nil)
+	require.NoError(t, err)
+	hard.SetStrict(true)
+	s.AddRoute("*.b.test", hard, runBackend("backend b"))
+
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+	port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+
+	// connect solves the challenge for requested and opens TLS to serverName through the spliced connection
+	connect := func(t *testing.T, zeroes uint8, requested, serverName string) (string, error) {
+		c := bootstrap.TcpClient(zeroes, 30, "127.0.0.1", port)
+		c.SetServerName(requested)
+
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		transmission, err := c.Communicate(clientCtx, conn)
+		if err != nil {
+			return "", err
+		}
+		require.Empty(t, transmission)
+
+		tc := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := tc.HandshakeContext(clientCtx); err != nil {
+			return "", err
+		}
+
+		b, err := io.ReadAll(tc)
+		return string(b), err
+	}
+
+	t.Run("server name picks the backend and the difficulty", func(t *testing.T) {
+		greeting, err := connect(t, 2, "a.test", "a.test")
+		require.NoError(t, err)
+		assert.Equal(t, "backend a a.test", greeting)
+
+		greeting, err = connect(t, 4, "api.b.test", "api.b.test")
+		require.NoError(t, err)
+		assert.Equal(t, "backend b api.b.test", greeting)
+
+		_, err = connect(t, 2, "api.b.test", "api.b.test")
+		assert.Error(t, err, "the challenge of b asks for more zeroes")
+	})
+
+	t.Run("ClientHello must ask for the server of the Request", func(t *testing.T) {
+		_, err := connect(t, 2, "a.test", "api.b.test")
+		assert.Error(t, err)
+	})
+
+	t.Run("clients naming no server are served as usual", func(t *testing.T) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		quote, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+	})
+}
+
+// actionCounter counts the actions of the requests passed on to the protocol
+type actionCounter struct {
+	p *protocol.Protocol
+
+	mu      sync.Mutex
+	actions map[protocol.Action]int
+}
+
+func (c *actionCounter) Handle(ctx context.Context, req []byte, clientIP string) (*protocol.Payload, error) {
+	if p, err := protocol.Decode(req); err == nil {
+		c.mu.Lock()
+		c.actions[p.Action]++
+		c.mu.Unlock()
+	}
+	return c.p.Handle(ctx, req, clientIP)
+}
+
+func (c *actionCounter) count(a protocol.Action) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.actions[a]
+}
+
+func TestIntegration_Tickets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secret := []byte("secret")
+	p, err := bootstrap.Protocol(ctx, 30, 3, secret)
+	require.NoError(t, err)
+
+	tickets, err := bootstrap.Tickets(ctx, 30, secret, 2, 5*time.Second)
+	require.NoError(t, err)
+	p.SetTickets(tickets)
+
+	counter := &actionCounter{p: p, actions: make(map[protocol.Action]int)}
+	s := server.New("127.0.0.1:0", counter)
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+	port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+
+	c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+	communicate := func(t *testing.T) {
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		quote, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+	}
+
+	// a new connection every time, the ticket is bound to the host of the client
+	communicate(t)
+	assert.Equal(t, 1, counter.count(protocol.Solve))
+
+	communicate(t)
+	communicate(t)
+	assert.Equal(t, 1, counter.count(protocol.Solve), "the ticket is redeemed instead of solving")
+	assert.Equal(t, 2, counter.count(protocol.Redeem))
+
+	// the used up ticket is rejected, the client solves again and gets a new one
+	communicate(t)
+	assert.Equal(t, 2, counter.count(protocol.Solve))
+	assert.Equal(t, 3, counter.count(protocol.Redeem))
+
+	communicate(t)
+	assert.Equal(t, 2, counter.count(protocol.Solve))
+	assert.Equal(t, 4, counter.count(protocol.Redeem))
+
+	t.Run("no ticket for work the client did not do", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		header := string(roundTrip(t, conn, r, &protocol.Payload{Action: protocol.Request}).Data)
+		rejected(t, roundTrip(t, conn, r, &protocol.Payload{Action: protocol.Solve, Data: []byte(header)}), protocol.ReasonNotSolved)
+
+		solution, err := challenge.New(nope.Nope{}, 3, 30).Solve(header)
+		require.NoError(t, err)
+		solve := &protocol.Payload{Action: protocol.Solve, Data: []byte(solution)}
+		assert.Equal(t, protocol.Ticket, roundTrip(t, conn, r, solve).Action)
+		rejected(t, roundTrip(t, conn, r, solve), protocol.ReasonReplay)
+	})
+}
+
+// droppingSolver closes the connection of the client while it solves its first challenge
+type droppingSolver struct {
+	challenge *challenge.Challenge
+	conn      net.Conn
+}
+
+func (s *droppingSolver) Solve(header string) (string, error) {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return s.challenge.Solve(header)
+}
+
+func TestIntegration_Sessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// strict mode binds the challenge to the address of the connection it was issued on
+	p, err := bootstrap.Protocol(ctx, 30, 3, []byte("secret"))
+	require.NoError(t, err)
+	p.SetStrict(true)
+
+	counter := &actionCounter{p: p, actions: make(map[protocol.Action]int)}
+	s := server.New("127.0.0.1:0", counter)
+	s.SetSessionGrace(5 * time.Second)
+	s.SetMaxChallenges(1)
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+	addr := s.Listeners()[0].Addr().String()
+
+	t.Run("outstanding challenge is solved on another connection", func(t *testing.T) {
+		solver := &droppingSolver{challenge: challenge.New(nope.Nope{}, 3, 30)}
+		c := client.New(addr, solver)
+		c.SetResumable(true)
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		conn, _, err := c.Connect()
+		require.NoError(t, err)
+		require.NoError(t, c.Resume(clientCtx, conn))
+
+		solver.conn = conn
+		_, err = c.Communicate(clientCtx, conn)
+		require.Error(t, err, "the connection drops while the challenge is solved")
+
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+		require.NoError(t, c.Resume(clientCtx, conn))
+
+		requests := counter.count(protocol.Request)
+		quote, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+		assert.Equal(t, requests, counter.count(protocol.Request), "no new challenge is asked for")
+	})
+
+	exchange := func(t *testing.T, conn net.Conn, r *bufio.Reader, p *protocol.Payload) *protocol.Payload {
+		require.NoError(t, protocol.Send(p, conn))
+		frame, err := protocol.ReadFrame(r)
+		require.NoError(t, err)
+		resp, err := protocol.Decode(frame)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("session is resumed once", func(t *testing.T) {
+		first, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		resp := exchange(t, first, bufio.NewReader(first), &protocol.Payload{Action: protocol.Resume})
+		require.Equal(t, protocol.Session, resp.Action)
+		id, _ := protocol.SplitSession(resp.Data)
+		require.NoError(t, first.Close())
+
+		second, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer second.Close()
+		resp = exchange(t, second, bufio.NewReader(second), &protocol.Payload{Action: protocol.Resume, Data: []byte(id)})
+		require.Equal(t, protocol.Session, resp.Action)
+		newID, _ := protocol.SplitSession(resp.Data)
+		assert.NotEqual(t, id, newID)
+
+		third, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer third.Close()
+		resp = exchange(t, third, bufio.NewReader(third), &protocol.Payload{Action: protocol.Resume, Data: []byte(id)})
+		assert.Equal(t, protocol.Reject, resp.Action)
+	})
+
+	t.Run("connection opens a single session", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		require.Equal(t, protocol.Session, exchange(t, conn, r, &protocol.Payload{Action: protocol.Resume}).Action)
+		rejected(t, exchange(t, conn, r, &protocol.Payload{Action: protocol.Resume}), protocol.ReasonIllegalTransition)
+	})
+
+	t.Run("sessions above the limit are rejected", func(t *testing.T) {
+		ls := server.New("127.0.0.1:0", p)
+		ls.SetSessionGrace(5 * time.Second)
+		ls.SetMaxSessions(2)
+		go func() {
+			if err := ls.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+		}()
+		<-ls.Ready()
+
+		open := func() *protocol.Payload {
+			conn, err := net.Dial("tcp", ls.Listeners()[0].Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			return exchange(t, conn, bufio.NewReader(conn), &protocol.Payload{Action: protocol.Resume})
+		}
+
+		// sessions of closed connections count while they wait to be resumed
+		assert.Equal(t, protocol.Session, open().Action)
+		assert.Equal(t, protocol.Session, open().Action)
+		rejected(t, open(), protocol.ReasonOverloaded)
+	})
+
+	t.Run("session is bound to the network of the client", func(t *testing.T) {
+		trusted, err := trust.ParseNetworks([]string{"127.0.0.1/32"})
+		require.NoError(t, err)
+
+		ps := server.New("127.0.0.1:0", p)
+		ps.SetTrustedProxies(trusted)
+		ps.SetSessionGrace(5 * time.Second)
+		go func() {
+			if err := ps.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+		}()
+		<-ps.Ready()
+
+		resume := func(source, id string) *protocol.Payload {
+			conn, err := net.Dial("tcp", ps.Listeners()[0].Addr().String())
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = conn.Close() })
+
+			_, err = conn.Write([]byte("PROXY TCP4 " + source + " 127.0.0.1 56324 3333\r\n"))
+			require.NoError(t, err)
+			return exchange(t, conn, bufio.NewReader(conn), &protocol.Payload{Action: protocol.Resume, Data: []byte(id)})
+		}
+
+		resp := resume("192.0.2.10", "")
+		require.Equal(t, protocol.Session, resp.Action)
+		id, _ := protocol.SplitSession(resp.Data)
+
+		assert.Equal(t, protocol.Reject, resume("198.51.100.10", id).Action, "another network")
+		assert.Equal(t, protocol.Session, resume("192.0.2.77", id).Action, "same /24")
+	})
+}
+
+// legacyHandler is a server predating the Hello
+type legacyHandler struct {
+	p *protocol.Protocol
+}
+
+func (h legacyHandler) Handle(ctx context.Context, req []byte, clientIP string) (*protocol.Payload, error) {
+	if p, err := protocol.Decode(req); err == nil && p.Action >= protocol.Hello {
+		return nil, protocol.ErrInvalidRequestAction
+	}
+	return h.p.Handle(ctx, req, clientIP)
+}
+
+func TestIntegration_VersionSkew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := bootstrap.Protocol(ctx, 30, 3, nil)
+	require.NoError(t, err)
+
+	run := func(h interface {
+		Handle(ctx context.Context, req []byte, clientIP string) (*protocol.Payload, error)
+	}) int {
+		s := server.New("127.0.0.1:0", h)
+		go func() {
+			if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				t.Error(err)
+			}
+		}()
+		<-s.Ready()
+		return s.Listeners()[0].Addr().(*net.TCPAddr).Port
+	}
+	port, legacyPort := run(p), run(legacyHandler{p: p})
+
+	communicate := func(t *testing.T, c *client.Client, conn net.Conn) {
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		quote, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+	}
+
+	hello := func(t *testing.T, port int, offer protocol.Offer) (*client.Client, net.Conn, protocol.Agreement, error) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		c.SetOffer(offer)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = closer() })
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		agreement, err := c.Hello(clientCtx, conn)
+		return c, conn, agreement, err
+	}
+
+	t.Run("client without hello", func(t *testing.T) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		communicate(t, c, conn)
+	})
+
+	t.Run("client with hello", func(t *testing.T) {
+		c, conn, agreement, err := hello(t, port, protocol.NewOffer(0))
+		require.NoError(t, err)
+		assert.Equal(t, protocol.Agreement{Version: protocol.Version1, Algorithm: protocol.HashcashSHA1, Difficulty: 3}, agreement)
+
+		communicate(t, c, conn)
+	})
+
+	t.Run("newer client", func(t *testing.T) {
+		offer := protocol.Offer{Versions: []protocol.Version{protocol.Version1, 2}, Algorithms: []protocol.Algorithm{9, protocol.HashcashSHA1}}
+		c, conn, agreement, err := hello(t, port, offer)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.Version1, agreement.Version)
+		assert.Equal(t, protocol.HashcashSHA1, agreement.Algorithm)
+
+		communicate(t, c, conn)
+	})
+
+	t.Run("client speaking newer versions only", func(t *testing.T) {
+		_, _, _, err := hello(t, port, protocol.Offer{Versions: []protocol.Version{2}, Algorithms: protocol.Algorithms})
+		assert.ErrorIs(t, err, client.ErrUnsupported)
+	})
+
+	t.Run("challenges harder than the client accepts", func(t *testing.T) {
+		_, _, _, err := hello(t, port, protocol.NewOffer(2))
+		assert.ErrorIs(t, err, client.ErrWrongDifficulty)
+
+		var rejectErr *client.RejectError
+		require.ErrorAs(t, err, &rejectErr)
+		assert.Equal(t, uint8(3), rejectErr.Difficulty)
+	})
+
+	t.Run("server predating hello", func(t *testing.T) {
+		c, _, _, err := hello(t, legacyPort, protocol.NewOffer(0))
+		assert.ErrorIs(t, err, client.ErrNoHello)
+
+		// the client goes on without a hello on a new connection
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		communicate(t, c, conn)
+	})
+}
+
+func TestIntegration_Heartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := bootstrap.Protocol(ctx, 30, 3, nil)
+	require.NoError(t, err)
+
+	reg := metrics.NewRegistry()
+	s := server.New("127.0.0.1:0", p)
+	s.SetHeartbeat(50*time.Millisecond, 500*time.Millisecond)
+	s.SetMetrics(reg)
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+	port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+
+	t.Run("client answering pings keeps its connection", func(t *testing.T) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer clientCancel()
+
+		assert.ErrorIs(t, c.Run(clientCtx), context.DeadlineExceeded)
+		assert.Equal(t, int64(1), reg.Counter("server.accepted").Value())
+	})
+
+	t.Run("silent client is told it timed out", func(t *testing.T) {
+		c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer clientCancel()
+
+		quote, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+
+		time.Sleep(800 * time.Millisecond)
+		_, err = c.Communicate(clientCtx, conn)
+		assert.ErrorIs(t, err, client.ErrClosed)
+		assert.ErrorIs(t, err, client.ErrIdleTimeout)
+	})
+}
+
+func TestIntegration_Pipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := bootstrap.Protocol(ctx, 30, 3, nil)
+	require.NoError(t, err)
+
+	s := server.New("127.0.0.1:0", p)
+	s.SetMaxChallenges(4)
+	s.SetPipeline(4)
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+	port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+
+	c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+	conn, closer, err := c.Connect()
+	require.NoError(t, err)
+	defer closer()
+
+	clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer clientCancel()
+
+	t.Run("pipelined requests", func(t *testing.T) {
+		transmissions, err := c.Pipeline(clientCtx, conn, 4)
+		require.NoError(t, err)
+		require.Len(t, transmissions, 4)
+		for _, quote := range transmissions {
+			assert.Contains(t, quotes.Quotes, quote)
+		}
+	})
+
+	t.Run("more requests than outstanding challenges allowed", func(t *testing.T) {
+		_, err := c.Pipeline(clientCtx, conn, 5)
+		assert.ErrorIs(t, err, client.ErrIllegalTransition)
+	})
+
+	t.Run("lockstep exchange on a new connection", func(t *testing.T) {
+		conn, closer, err := c.Connect()
+		require.NoError(t, err)
+		defer closer()
+
+		quote, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Contains(t, quotes.Quotes, quote)
+	})
+}
+
+// blobProvider streams a blob too large for a single frame
+type blobProvider struct {
+	blob []byte
+}
+
+func (p blobProvider) Provide() string {
+	return string(p.blob)
+}
+
+func (p blobProvider) ProvideStream() (protocol.Transmission, error) {
+	return protocol.Transmission{
+		Meta: "application/octet-stream",
+		Size: int64(len(p.blob)),
+		Body: bytes.NewReader(p.blob),
+	}, nil
+}
+
+func TestIntegration_StreamedTransmission(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 10_000)
+	p := protocol.New(challenge.New(nope.Nope{}, 3, 30), blobProvider{blob: blob})
+
+	tickets, err := bootstrap.Tickets(ctx, 30, []byte("secret"), 2, 5*time.Second)
+	require.NoError(t, err)
+	p.SetTickets(tickets)
+
+	s := server.New("127.0.0.1:0", p)
+	s.SetMaxChallenges(3)
+	s.SetPipeline(3)
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+	<-s.Ready()
+	port := s.Listeners()[0].Addr().(*net.TCPAddr).Port
+
+	c := bootstrap.TcpClient(3, 30, "127.0.0.1", port)
+	conn, closer, err := c.Connect()
+	require.NoError(t, err)
+	defer closer()
+
+	clientCtx, clientCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer clientCancel()
+
+	t.Run("stream for a solution", func(t *testing.T) {
+		tr, err := c.Stream(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Equal(t, "application/octet-stream", tr.Meta)
+		assert.Equal(t, int64(len(blob)), tr.Size)
+
+		got, err := io.ReadAll(tr.Body)
+		require.NoError(t, err)
+		assert.Equal(t, blob, got)
+	})
+
+	t.Run("unread body blocks the connection", func(t *testing.T) {
+		tr, err := c.Stream(clientCtx, conn)
+		require.NoError(t, err)
+
+		_, err = c.Communicate(clientCtx, conn)
+		assert.ErrorIs(t, err, client.ErrUnfinished)
+
+		_, err = io.Copy(io.Discard, tr.Body)
+		require.NoError(t, err)
+	})
+
+	t.Run("communicate reads the whole stream", func(t *testing.T) {
+		got, err := c.Communicate(clientCtx, conn)
+		require.NoError(t, err)
+		assert.Equal(t, string(blob), got)
+	})
+
+	t.Run("pipelined streams", func(t *testing.T) {
+		transmissions, err := c.Pipeline(clientCtx, conn, 3)
+		require.NoError(t, err)
+		require.Len(t, transmissions, 3)
+		for _, got := range transmissions {
+			assert.Equal(t, string(blob), got)
+		}
+	})
+}
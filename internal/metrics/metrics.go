@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a named value that can go up and down,
+// so it serves both as a counter and as a gauge
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Dec() {
+	c.v.Add(-1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Set(n int64) {
+	c.v.Store(n)
+}
+
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// Registry holds the counters of the components sharing it
+type Registry struct {
+	mu       sync.RWMutex
+	counters map[string]*Counter
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+	}
+}
+
+// Counter returns the counter registered under name, creating it on first use
+func (r *Registry) Counter(name string) *Counter {
+	r.mu.RLock()
+	c, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.counters[name]; ok {
+		return c
+	}
+
+	c = &Counter{}
+	r.counters[name] = c
+	return c
+}
+
+// Snapshot returns current values of all the counters,
+// its signature fits expvar.Func
+func (r *Registry) Snapshot() any {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	values := make(map[string]int64, len(r.counters))
+	for name, c := range r.counters {
+		values[name] = c.Value()
+	}
+
+	return values
+}
@@ -0,0 +1,72 @@
+package powhttp
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// page solves the challenge in the browser and repeats the request with the solution,
+// the gate answers it with the cookie and the page reloads with it. WebCrypto is only
+// available in secure contexts, so the page has to be served over HTTPS or from localhost.
+var page = template.Must(template.New("page").Funcs(template.FuncMap{
+	"scheme": func() string { return Scheme },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Checking your browser</title>
+</head>
+<body>
+<p id="status">Checking your browser, this takes a few seconds&hellip;</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(async function () {
+  const header = {{.}};
+  const parts = header.split("|");
+  const bits = parseInt(parts[1], 10);
+  const prefix = parts.slice(0, 5).join("|") + "|";
+  const zeroes = "0".repeat(bits);
+  const encoder = new TextEncoder();
+
+  for (let counter = 0; ; counter++) {
+    const solution = prefix + counter;
+    const digest = new Uint8Array(await crypto.subtle.digest("SHA-1", encoder.encode(solution)));
+    const hex = Array.from(digest, function (b) { return b.toString(16).padStart(2, "0"); }).join("");
+    if (hex.startsWith(zeroes)) {
+      const resp = await fetch(location.href, {headers: {"Authorization": "{{scheme}} " + solution}, credentials: "same-origin"});
+      if (resp.ok) {
+        location.reload();
+      } else {
+        document.getElementById("status").textContent = "Verification failed, please reload the page.";
+      }
+      return;
+    }
+  }
+})();
+</script>
+</body>
+</html>
+`))
+
+func writePage(w http.ResponseWriter, header string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := page.Execute(w, header); err != nil {
+		slog.With("error", err.Error()).Error("powhttp.Gate failed to write the challenge page")
+	}
+}
+
+// wantsHTML reports whether the request comes from a browser navigating to a page
+func wantsHTML(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.TrimSpace(mediaType) == "text/html" {
+			return true
+		}
+	}
+
+	return false
+}
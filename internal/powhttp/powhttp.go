@@ -0,0 +1,259 @@
+package powhttp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/trust"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid access token")
+	ErrTokenExpired = errors.New("access token expired")
+)
+
+const (
+	// Scheme is the HTTP authentication scheme of proof of work, the server sends
+	// WWW-Authenticate: PoW header="<challenge>" and the client answers with
+	// Authorization: PoW <solved header>
+	Scheme = "PoW"
+
+	// tokenParam names the access token in Authentication-Info of the response
+	// and in Authorization: PoW token="<token>" of the following requests
+	tokenParam = "token"
+
+	// tokenDelimiter separates the difficulty, expiry and signature of a token
+	tokenDelimiter = "."
+)
+
+// store remembers issued challenges and the spent ones, the same store
+// may be shared with the other transports of the process
+type store interface {
+	Validate(key string) bool
+	Remember(key string)
+	Spend(key string) bool
+}
+
+// Gate puts HTTP handlers behind hashcash. Requests without a valid solution
+// get 401 with a fresh challenge, every solution is accepted only once and
+// only from the client it was issued for.
+type Gate struct {
+	store       store
+	maxDuration uint64
+	signer      *challenge.Signer
+	proxies     trust.Networks
+	tokenTTL    time.Duration
+	cookie      string
+
+	// secureCookie marks the cookie Secure whatever the request came over, see SetSecureCookie
+	secureCookie bool
+}
+
+func New(store store, maxDuration uint64) *Gate {
+	return &Gate{
+		store:       store,
+		maxDuration: maxDuration,
+	}
+}
+
+// SetSigner signs the challenges, so that any process sharing the key accepts them,
+// it applies to the middleware created by Require afterwards
+func (g *Gate) SetSigner(s *challenge.Signer) {
+	g.signer = s
+}
+
+// SetTrustedProxies makes the gate take the client address from the
+// Forwarded, X-Forwarded-For or X-Real-IP headers set by the given networks
+func (g *Gate) SetTrustedProxies(networks trust.Networks) {
+	g.proxies = networks
+}
+
+// SetTokenTTL makes the gate issue an access token along with every accepted
+// solution, letting the client in for ttl without solving again. Tokens are
+// bound to the client address and the difficulty, and need a signer.
+func (g *Gate) SetTokenTTL(ttl time.Duration) {
+	g.tokenTTL = ttl
+}
+
+// SetCookie makes the gate hand the access token out as a cookie with the given
+// name as well and accept it from there, so that browsers are let in until it
+// expires. Browsers asking for HTML get a page solving the challenge in place.
+// It needs a token TTL and a signer.
+func (g *Gate) SetCookie(name string) {
+	g.cookie = name
+}
+
+// SetSecureCookie marks the cookie Secure even on requests that reached the gate over plain HTTP,
+// e.g. behind a load balancer terminating TLS in front of a PROXY protocol listener. Requests over
+// TLS, or forwarded as https by the trusted proxies, get a Secure cookie anyway.
+func (g *Gate) SetSecureCookie(secure bool) {
+	g.secureCookie = secure
+}
+
+// Strip removes the proof of work credentials from the request,
+// e.g. before it is forwarded to a backend that has no use for them
+func (g *Gate) Strip(r *http.Request) {
+	if _, ok := credentials(r); ok {
+		r.Header.Del("Authorization")
+	}
+
+	if g.cookie == "" {
+		return
+	}
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != g.cookie {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// Require returns middleware letting through only the requests solving
+// a challenge with the given amount of zeroes, so that every route may ask for
+// its own difficulty. Solutions of easier routes are not accepted by harder ones.
+func (g *Gate) Require(zeroes uint8) func(http.Handler) http.Handler {
+	c := challenge.New(g.store, zeroes, g.maxDuration)
+	if g.signer != nil {
+		c.SetSigner(g.signer)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := g.proxies.ClientIP(r)
+
+			reason := "proof of work required"
+			if credentials, ok := g.credentials(r); ok {
+				var err error
+				if token, isToken := strings.CutPrefix(credentials, tokenParam+"="); isToken {
+					err = g.verifyToken(strings.Trim(token, `"`), clientIP, zeroes)
+				} else if err = c.Verify(credentials, clientIP); err == nil && g.issuesTokens() {
+					token := g.issueToken(clientIP, zeroes)
+					w.Header().Set("Authentication-Info", fmt.Sprintf("%s=%q", tokenParam, token))
+					g.setCookie(w, r, token)
+				}
+
+				if err == nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				slog.With("error", err.Error(), "client", clientIP).Info("rejecting proof of work")
+				reason = err.Error()
+			}
+
+			header, err := c.Create(clientIP)
+			if err != nil {
+				slog.With("error", err.Error()).Error("powhttp.Gate failed to create a challenge")
+				http.Error(w, "failed to create a challenge", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("%s header=%q", Scheme, header))
+			w.Header().Set("Cache-Control", "no-store")
+			if g.cookie != "" && wantsHTML(r) {
+				writePage(w, header)
+				return
+			}
+			http.Error(w, reason, http.StatusUnauthorized)
+		})
+	}
+}
+
+func (g *Gate) issuesTokens() bool {
+	return g.tokenTTL > 0 && g.signer != nil
+}
+
+func (g *Gate) issueToken(clientIP string, zeroes uint8) string {
+	bits := strconv.Itoa(int(zeroes))
+	expiry := strconv.FormatInt(time.Now().Add(g.tokenTTL).Unix(), 10)
+	signature := g.signer.Sign(tokenParam, clientIP, bits, expiry)
+	return strings.Join([]string{bits, expiry, signature}, tokenDelimiter)
+}
+
+// setCookie hands the token out as a cookie living as long as the token
+func (g *Gate) setCookie(w http.ResponseWriter, r *http.Request, token string) {
+	if g.cookie == "" {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     g.cookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(g.tokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   g.secureCookie || g.proxies.Secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// verifyToken accepts tokens of the client issued by routes at least as hard as this one
+func (g *Gate) verifyToken(token, clientIP string, zeroes uint8) error {
+	if !g.issuesTokens() {
+		return ErrInvalidToken
+	}
+
+	parts := strings.Split(token, tokenDelimiter)
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	if !g.signer.Verify(parts[2], tokenParam, clientIP, parts[0], parts[1]) {
+		return ErrInvalidToken
+	}
+
+	bits, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil || uint8(bits) < zeroes {
+		return ErrInvalidToken
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if time.Now().Unix() > expiry {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// credentials returns the credentials of the request, the cookie
+// with the token is looked at when there is no Authorization header
+func (g *Gate) credentials(r *http.Request) (string, bool) {
+	if credentials, ok := credentials(r); ok {
+		return credentials, true
+	}
+
+	if g.cookie == "" {
+		return "", false
+	}
+
+	c, err := r.Cookie(g.cookie)
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+
+	return tokenParam + "=" + c.Value, true
+}
+
+// credentials returns what follows the scheme in the Authorization header of the request,
+// either a solved header or a token
+func credentials(r *http.Request) (string, bool) {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, Scheme) {
+		return "", false
+	}
+
+	credentials = strings.TrimSpace(credentials)
+	return credentials, credentials != ""
+}
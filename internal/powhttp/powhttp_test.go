@@ -0,0 +1,156 @@
+package powhttp_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/powhttp"
+	"github.com/denismitr/antiddos/internal/store/adapters/embedded"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var challengeParam = regexp.MustCompile(`^PoW header="([^"]+)"$`)
+
+func newGate(t *testing.T) *powhttp.Gate {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	store, err := embedded.New(ctx, 30)
+	require.NoError(t, err)
+
+	return powhttp.New(store, 30)
+}
+
+func ok() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// challengeOf requests h without a solution and returns the challenge it sent
+func challengeOf(t *testing.T, h http.Handler) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	m := challengeParam.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	require.Len(t, m, 2)
+	return m[1]
+}
+
+func solve(t *testing.T, header string, zeroes uint8) string {
+	t.Helper()
+
+	solved, err := challenge.New(nope.Nope{}, zeroes, 30).Solve(header)
+	require.NoError(t, err)
+	return solved
+}
+
+func request(h http.Handler, solved, remoteAddr string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "PoW "+solved)
+	if remoteAddr != "" {
+		r.RemoteAddr = remoteAddr
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestGate(t *testing.T) {
+	g := newGate(t)
+	g.SetSigner(challenge.NewSigner([]byte("secret")))
+	h := g.Require(2)(ok())
+
+	t.Run("solved challenge passes once", func(t *testing.T) {
+		solved := solve(t, challengeOf(t, h), 2)
+
+		assert.Equal(t, http.StatusOK, request(h, solved, ""))
+		assert.Equal(t, http.StatusUnauthorized, request(h, solved, ""))
+	})
+
+	t.Run("solution of another client", func(t *testing.T) {
+		solved := solve(t, challengeOf(t, h), 2)
+		assert.Equal(t, http.StatusUnauthorized, request(h, solved, "192.0.2.2:1234"))
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, request(h, "1|2|3", ""))
+	})
+}
+
+func TestGate_Difficulty(t *testing.T) {
+	g := newGate(t)
+	easy := g.Require(1)(ok())
+	hard := g.Require(3)(ok())
+
+	solved := solve(t, challengeOf(t, easy), 1)
+	assert.Equal(t, http.StatusUnauthorized, request(hard, solved, ""))
+
+	solved = solve(t, challengeOf(t, hard), 3)
+	assert.Equal(t, http.StatusOK, request(hard, solved, ""))
+}
+
+func TestGate_SecureCookie(t *testing.T) {
+	proxies, err := trust.ParseNetworks([]string{"192.0.2.0/24"})
+	require.NoError(t, err)
+
+	tt := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		configured bool
+		secure     bool
+	}{
+		{name: "plain http", remoteAddr: "192.0.2.1:1234"},
+		{name: "https forwarded by trusted proxy", remoteAddr: "192.0.2.1:1234", proto: "https", secure: true},
+		{name: "https forwarded by anyone else", remoteAddr: "198.51.100.1:1234", proto: "https"},
+		{name: "configured", remoteAddr: "198.51.100.1:1234", configured: true, secure: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newGate(t)
+			g.SetSigner(challenge.NewSigner([]byte("secret")))
+			g.SetTrustedProxies(proxies)
+			g.SetTokenTTL(time.Minute)
+			g.SetCookie("pow")
+			g.SetSecureCookie(tc.configured)
+			h := g.Require(1)(ok())
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			m := challengeParam.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+			require.Len(t, m, 2)
+
+			r = httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header.Set("Authorization", "PoW "+solve(t, m[1], 1))
+			if tc.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tc.proto)
+			}
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			cookies := w.Result().Cookies()
+			require.Len(t, cookies, 1)
+			assert.Equal(t, tc.secure, cookies[0].Secure)
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package powhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+)
+
+var (
+	ErrDifficultyTooHigh = errors.New("challenge is harder than allowed")
+	ErrInvalidChallenge  = errors.New("invalid challenge")
+)
+
+const (
+	defaultMaxZeroes    = 6
+	defaultMaxSolveTime = 10 * time.Second
+
+	// maxDrainSize bounds what is read from a challenge response before it is
+	// closed, so that the connection may be reused for the retry
+	maxDrainSize = 4 << 10
+)
+
+// Transport is an http.RoundTripper solving the challenges of servers guarded by
+// a Gate. A request answered with a challenge is retried once with the solution,
+// and the access token issued for it is sent with the following requests to the host.
+// Requests with a body are retried only when the body can be rewound with GetBody,
+// otherwise the challenge response is returned as is.
+type Transport struct {
+	base         http.RoundTripper
+	maxZeroes    uint8
+	maxSolveTime time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewTransport wraps base, or http.DefaultTransport when it is nil
+func NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{
+		base:         base,
+		maxZeroes:    defaultMaxZeroes,
+		maxSolveTime: defaultMaxSolveTime,
+		tokens:       make(map[string]string),
+	}
+}
+
+// SetMaxZeroes makes the transport refuse challenges asking for more zeroes,
+// so that a hostile server cannot make it burn the CPU
+func (t *Transport) SetMaxZeroes(zeroes uint8) {
+	t.maxZeroes = zeroes
+}
+
+// SetMaxSolveTime bounds the time spent solving a single challenge
+func (t *Transport) SetMaxSolveTime(d time.Duration) {
+	t.maxSolveTime = d
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	attempt := req
+	token, hasToken := t.token(host)
+	if hasToken {
+		attempt = req.Clone(req.Context())
+		attempt.Header.Set("Authorization", fmt.Sprintf("%s %s=%q", Scheme, tokenParam, token))
+	}
+
+	resp, err := t.base.RoundTrip(attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	header, ok := challengeOf(resp)
+	if !ok {
+		t.keepToken(host, resp)
+		return resp, nil
+	}
+
+	if hasToken {
+		t.forgetToken(host, token)
+	}
+
+	retry, ok, err := rewind(req)
+	if err != nil {
+		closeBody(resp)
+		return nil, err
+	}
+	if !ok {
+		return resp, nil
+	}
+
+	solved, err := t.solve(req.Context(), header)
+	closeBody(resp)
+	if err != nil {
+		if retry.Body != nil {
+			_ = retry.Body.Close()
+		}
+		return nil, err
+	}
+
+	retry.Header.Set("Authorization", Scheme+" "+solved)
+	resp, err = t.base.RoundTrip(retry)
+	if err != nil {
+		return nil, err
+	}
+
+	t.keepToken(host, resp)
+	return resp, nil
+}
+
+func (t *Transport) solve(ctx context.Context, header string) (string, error) {
+	segments := strings.Split(header, challenge.HeaderDelimiter)
+	if len(segments) != 6 {
+		return "", fmt.Errorf("%w: %s", ErrInvalidChallenge, header)
+	}
+
+	zeroes, err := strconv.ParseUint(segments[1], 10, 8)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid difficulty %q", ErrInvalidChallenge, segments[1])
+	}
+
+	if uint8(zeroes) > t.maxZeroes {
+		return "", fmt.Errorf("%w: %d zeroes, at most %d are allowed", ErrDifficultyTooHigh, zeroes, t.maxZeroes)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.maxSolveTime)
+	defer cancel()
+
+	// the server checks the challenge, the client only looks for the counter
+	solver := challenge.New(nope.Nope{}, uint8(zeroes), math.MaxUint64)
+	solved, err := solver.SolveContext(ctx, header)
+	if err != nil {
+		return "", fmt.Errorf("powhttp.Transport.solve failed: %w", err)
+	}
+
+	return solved, nil
+}
+
+func (t *Transport) token(host string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token, ok := t.tokens[host]
+	return token, ok
+}
+
+func (t *Transport) keepToken(host string, resp *http.Response) {
+	token, ok := tokenOf(resp)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	t.tokens[host] = token
+	t.mu.Unlock()
+}
+
+// forgetToken drops the token unless another request has replaced it meanwhile
+func (t *Transport) forgetToken(host, token string) {
+	t.mu.Lock()
+	if t.tokens[host] == token {
+		delete(t.tokens, host)
+	}
+	t.mu.Unlock()
+}
+
+// rewind returns a copy of req to send once more, ok is false
+// when the body of req has been consumed and cannot be restored
+func rewind(req *http.Request) (*http.Request, bool, error) {
+	retry := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry, true, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, false, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false, fmt.Errorf("powhttp.Transport failed to rewind request body: %w", err)
+	}
+	retry.Body = body
+
+	return retry, true, nil
+}
+
+// challengeOf returns the challenge of a 401 response of a Gate
+func challengeOf(resp *http.Response) (string, bool) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", false
+	}
+
+	for _, v := range resp.Header.Values("WWW-Authenticate") {
+		scheme, params, ok := strings.Cut(v, " ")
+		if !ok || !strings.EqualFold(scheme, Scheme) {
+			continue
+		}
+
+		if header, ok := strings.CutPrefix(strings.TrimSpace(params), "header="); ok {
+			return strings.Trim(header, `"`), true
+		}
+	}
+
+	return "", false
+}
+
+// tokenOf returns the access token issued along with an accepted solution
+func tokenOf(resp *http.Response) (string, bool) {
+	for _, param := range strings.Split(resp.Header.Get("Authentication-Info"), ",") {
+		if token, ok := strings.CutPrefix(strings.TrimSpace(param), tokenParam+"="); ok {
+			return strings.Trim(token, `"`), true
+		}
+	}
+	return "", false
+}
+
+func closeBody(resp *http.Response) {
+	_, _ = io.CopyN(io.Discard, resp.Body, maxDrainSize)
+	_ = resp.Body.Close()
+}
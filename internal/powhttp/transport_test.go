@@ -0,0 +1,87 @@
+package powhttp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/powhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	g := newGate(t)
+	g.SetSigner(challenge.NewSigner([]byte("secret")))
+	g.SetTokenTTL(time.Minute)
+
+	var withToken, withSolution atomic.Int64
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "PoW token=") {
+			withToken.Add(1)
+		} else {
+			withSolution.Add(1)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	})
+
+	srv := httptest.NewServer(g.Require(2)(counted))
+	defer srv.Close()
+
+	c := &http.Client{Transport: powhttp.NewTransport(nil)}
+
+	t.Run("solves the challenge and replays the body", func(t *testing.T) {
+		resp, err := c.Post(srv.URL, "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, int64(1), withSolution.Load())
+	})
+
+	t.Run("sends the token afterwards", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			resp, err := c.Get(srv.URL)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+
+		assert.Equal(t, int64(1), withSolution.Load())
+		assert.Equal(t, int64(3), withToken.Load())
+	})
+}
+
+func TestTransport_Limits(t *testing.T) {
+	g := newGate(t)
+	srv := httptest.NewServer(g.Require(8)(ok()))
+	defer srv.Close()
+
+	t.Run("difficulty", func(t *testing.T) {
+		tr := powhttp.NewTransport(nil)
+		tr.SetMaxZeroes(4)
+
+		_, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.ErrorIs(t, err, powhttp.ErrDifficultyTooHigh)
+	})
+
+	t.Run("solve time", func(t *testing.T) {
+		tr := powhttp.NewTransport(nil)
+		tr.SetMaxZeroes(8)
+		tr.SetMaxSolveTime(10 * time.Millisecond)
+
+		_, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrMalformedFrame  = errors.New("malformed frame")
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+const (
+	// HeaderSize is the size of the action and the data length preceding the data
+	HeaderSize = 4
+
+	// IDSize is the size of the request ID following the header of tagged frames
+	IDSize = 4
+
+	// MaxDataSize is the largest data a single frame can carry
+	MaxDataSize = 1<<16 - 1
+
+	// MaxFrameSize is the size of the largest frame, tagged and carrying MaxDataSize
+	MaxFrameSize = HeaderSize + IDSize + MaxDataSize + 1
+)
+
+// frameSize returns the size of the whole frame described by the header at the start of b
+func frameSize(b []byte) int {
+	size := HeaderSize + int(binary.LittleEndian.Uint16(b[2:])) + 1
+	if IsTagged(b) {
+		size += IDSize
+	}
+	return size
+}
+
+// IsTagged tells whether the frame at the start of b carries a request ID
+func IsTagged(b []byte) bool {
+	return Action(binary.LittleEndian.Uint16(b))&taggedFlag != 0
+}
+
+// SplitFrame cuts the first frame off b. The frame boundary is found by the
+// data length from the header, so the data is free to contain the delimiter.
+// When b does not hold a whole frame yet, frame is nil and rest is b.
+func SplitFrame(b []byte) (frame, rest []byte, err error) {
+	if len(b) < HeaderSize {
+		return nil, b, nil
+	}
+
+	size := frameSize(b)
+	if len(b) < size {
+		return nil, b, nil
+	}
+
+	if b[size-1] != Delimiter {
+		return nil, b, fmt.Errorf("%w: frame of %d bytes does not end with delimiter", ErrMalformedFrame, size)
+	}
+
+	return b[:size], b[size:], nil
+}
+
+// ReadFrame reads a single frame from r
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(HeaderSize)
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	frame := make([]byte, frameSize(header))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if frame[len(frame)-1] != Delimiter {
+		return nil, fmt.Errorf("%w: frame of %d bytes does not end with delimiter", ErrMalformedFrame, len(frame))
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,75 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_Tagged(t *testing.T) {
+	tests := []struct {
+		name string
+		p    protocol.Payload
+		size int
+	}{
+		{
+			name: "untagged",
+			p:    protocol.Payload{Action: protocol.Solve, Data: []byte("1:3:#:1")},
+			size: protocol.HeaderSize + 7 + 1,
+		},
+		{
+			name: "tagged",
+			p:    protocol.Payload{Action: protocol.Solve, ID: 42, Data: []byte("1:3:#:1")},
+			size: protocol.HeaderSize + protocol.IDSize + 7 + 1,
+		},
+		{
+			name: "tagged without data",
+			p:    protocol.Payload{Action: protocol.Request, ID: 1<<32 - 1, Data: []byte{}},
+			size: protocol.HeaderSize + protocol.IDSize + 1,
+		},
+		{
+			name: "tagged with the largest data",
+			p:    protocol.Payload{Action: protocol.Transmit, ID: 3, Data: make([]byte, protocol.MaxDataSize)},
+			size: protocol.MaxFrameSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.p.Encode()
+			require.NoError(t, err)
+			assert.Len(t, b, tt.size)
+			assert.Equal(t, tt.p.ID != 0, protocol.IsTagged(b))
+
+			// the next frame starts right after the tagged one
+			frame, rest, err := protocol.SplitFrame(append(b, b...))
+			require.NoError(t, err)
+			assert.Equal(t, b, frame)
+			assert.Equal(t, b, rest)
+
+			frame, err = protocol.ReadFrame(bufio.NewReader(bytes.NewReader(b)))
+			require.NoError(t, err)
+
+			p, err := protocol.Decode(frame)
+			require.NoError(t, err)
+			assert.Equal(t, tt.p, *p)
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		b, err := (&protocol.Payload{Action: protocol.Solve, ID: 7, Data: []byte("header")}).Encode()
+		require.NoError(t, err)
+
+		_, err = protocol.Decode(b[:protocol.HeaderSize+2])
+		assert.ErrorIs(t, err, protocol.ErrMalformedFrame)
+	})
+
+	t.Run("data beyond a frame", func(t *testing.T) {
+		_, err := (&protocol.Payload{Action: protocol.Transmit, Data: make([]byte, protocol.MaxDataSize+1)}).Encode()
+		assert.ErrorIs(t, err, protocol.ErrPayloadTooLarge)
+	})
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+)
+
+var (
+	ErrMalformedHello   = errors.New("malformed hello")
+	ErrUnsupportedHello = errors.New("no version or algorithm in common")
+)
+
+// Version is a version of the protocol
+type Version uint16
+
+const (
+	// Version1 is the protocol of Request, Challenge, Solve and Transmit with hashcash headers
+	Version1 Version = 1
+)
+
+// Algorithm is a puzzle the challenges are made of
+type Algorithm uint8
+
+const (
+	// HashcashSHA1 challenges ask for a SHA-1 hash of the header starting with a number of zero hex digits
+	HashcashSHA1 Algorithm = 1
+)
+
+var (
+	// Versions are the versions of the protocol this package speaks, newest last
+	Versions = []Version{Version1}
+
+	// Algorithms are the puzzles this package solves and issues, preferred first
+	Algorithms = []Algorithm{HashcashSHA1}
+)
+
+// Offer is what a client advertises in its Hello before anything else on a connection,
+// clients that never send it are served with Version1 and HashcashSHA1
+type Offer struct {
+	Versions   []Version
+	Algorithms []Algorithm
+
+	// MaxDifficulty is the largest number of zeroes the client is ready to solve, 0 means any
+	MaxDifficulty uint8
+
+	// Cores is the number of cores the client solves with
+	Cores uint16
+}
+
+// NewOffer creates the Offer of a client speaking everything this package speaks
+func NewOffer(maxDifficulty uint8) Offer {
+	return Offer{
+		Versions:      Versions,
+		Algorithms:    Algorithms,
+		MaxDifficulty: maxDifficulty,
+		Cores:         uint16(min(runtime.NumCPU(), 1<<16-1)),
+	}
+}
+
+// Payload encodes the Offer as a Hello with the number of versions and the versions,
+// the number of algorithms and the algorithms, the max difficulty and the cores
+func (o Offer) Payload() *Payload {
+	data := make([]byte, 0, 1+2*len(o.Versions)+1+len(o.Algorithms)+1+2)
+	data = append(data, uint8(len(o.Versions)))
+	for _, v := range o.Versions {
+		data = binary.LittleEndian.AppendUint16(data, uint16(v))
+	}
+
+	data = append(data, uint8(len(o.Algorithms)))
+	for _, a := range o.Algorithms {
+		data = append(data, uint8(a))
+	}
+
+	data = append(data, o.MaxDifficulty)
+	data = binary.LittleEndian.AppendUint16(data, o.Cores)
+
+	return &Payload{Action: Hello, Data: data}
+}
+
+// ParseOffer reads the data of a Hello payload
+func ParseOffer(data []byte) (Offer, error) {
+	var o Offer
+	if len(data) < 1 {
+		return o, ErrMalformedHello
+	}
+
+	n, data := int(data[0]), data[1:]
+	if len(data) < 2*n+1 {
+		return o, ErrMalformedHello
+	}
+	for i := 0; i < n; i++ {
+		o.Versions = append(o.Versions, Version(binary.LittleEndian.Uint16(data[2*i:])))
+	}
+
+	n, data = int(data[2*n]), data[2*n+1:]
+	if len(data) != n+1+2 {
+		return o, ErrMalformedHello
+	}
+	for i := 0; i < n; i++ {
+		o.Algorithms = append(o.Algorithms, Algorithm(data[i]))
+	}
+
+	o.MaxDifficulty = data[n]
+	o.Cores = binary.LittleEndian.Uint16(data[n+1:])
+	return o, nil
+}
+
+// Agreement is what the server picked for the connection in its ServerHello
+type Agreement struct {
+	Version   Version
+	Algorithm Algorithm
+
+	// Difficulty is the number of zeroes of the challenges
+	Difficulty uint8
+}
+
+const serverHelloSize = 2 + 1 + 1
+
+func (a Agreement) Payload() *Payload {
+	data := binary.LittleEndian.AppendUint16(make([]byte, 0, serverHelloSize), uint16(a.Version))
+	return &Payload{Action: ServerHello, Data: append(data, uint8(a.Algorithm), a.Difficulty)}
+}
+
+// ParseAgreement reads the data of a ServerHello payload
+func ParseAgreement(data []byte) (Agreement, error) {
+	if len(data) != serverHelloSize {
+		return Agreement{}, fmt.Errorf("%w: %d bytes of server hello", ErrMalformedHello, len(data))
+	}
+
+	return Agreement{
+		Version:    Version(binary.LittleEndian.Uint16(data)),
+		Algorithm:  Algorithm(data[2]),
+		Difficulty: data[3],
+	}, nil
+}
+
+// negotiate picks the newest version both sides speak
+// and the algorithm the server prefers among the ones of the client
+func negotiate(o Offer, versions []Version, algorithms []Algorithm) (Version, Algorithm, error) {
+	var version Version
+	for _, v := range versions {
+		if slices.Contains(o.Versions, v) {
+			version = max(version, v)
+		}
+	}
+
+	for _, a := range algorithms {
+		if version != 0 && slices.Contains(o.Algorithms, a) {
+			return version, a, nil
+		}
+	}
+
+	return 0, 0, ErrUnsupportedHello
+}
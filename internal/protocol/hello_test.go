@@ -0,0 +1,45 @@
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffer(t *testing.T) {
+	t.Run("offer round trip", func(t *testing.T) {
+		want := protocol.Offer{
+			Versions:      []protocol.Version{protocol.Version1, 2},
+			Algorithms:    []protocol.Algorithm{protocol.HashcashSHA1, 9},
+			MaxDifficulty: 6,
+			Cores:         8,
+		}
+
+		p := want.Payload()
+		assert.Equal(t, protocol.Hello, p.Action)
+
+		got, err := protocol.ParseOffer(p.Data)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("agreement round trip", func(t *testing.T) {
+		want := protocol.Agreement{Version: protocol.Version1, Algorithm: protocol.HashcashSHA1, Difficulty: 4}
+
+		p := want.Payload()
+		assert.Equal(t, protocol.ServerHello, p.Action)
+
+		got, err := protocol.ParseAgreement(p.Data)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("malformed offers", func(t *testing.T) {
+		for _, data := range [][]byte{nil, {1}, {1, 1, 0}, {1, 1, 0, 1, 1, 6, 8}, {0, 0, 6, 8, 0, 0}} {
+			_, err := protocol.ParseOffer(data)
+			assert.ErrorIs(t, err, protocol.ErrMalformedHello, "%v", data)
+		}
+	})
+}
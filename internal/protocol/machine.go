@@ -0,0 +1,315 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/challenge"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIllegalTransition = errors.New("illegal transition")
+	ErrTooManyChallenges = errors.New("too many outstanding challenges")
+	ErrForeignChallenge  = errors.New("challenge not issued on the connection")
+)
+
+// defaultChallengeTTL is how long a challenge is outstanding unless SetChallengeTTL says otherwise
+const defaultChallengeTTL = 30 * time.Second
+
+// State is where the exchange on a connection is at
+type State uint8
+
+const (
+	// Idle connections have no outstanding challenge and nothing solved
+	Idle State = iota
+
+	// Challenged connections have outstanding challenges to solve
+	Challenged
+
+	// Solved connections got a transmission for a solution or a ticket
+	Solved
+)
+
+func (s State) String() string {
+	switch s {
+	case Idle:
+		return "idle"
+	case Challenged:
+		return "challenged"
+	case Solved:
+		return "solved"
+	default:
+		return fmt.Sprintf("state(%d)", uint8(s))
+	}
+}
+
+type handler interface {
+	Handle(ctx context.Context, req []byte, clientIP string) (*Payload, error)
+}
+
+// Machine keeps the state of the exchange on a single connection, so that
+// a peer solves only challenges it asked for on the connection, holds
+// a limited number of them at once and never sends actions of the server.
+// It is safe for concurrent use, e.g. with pipelined requests.
+type Machine struct {
+	mu             sync.Mutex
+	state          State
+	maxOutstanding int
+	challengeTTL   time.Duration
+
+	// challenges are the nonces of the challenges issued on the connection and not solved yet
+	challenges map[string]outstanding
+
+	// requesting counts the Requests being handled,
+	// so that pipelined ones do not overrun the limit checked for them
+	requesting int
+}
+
+// outstanding is a challenge issued on the connection
+type outstanding struct {
+	issued time.Time
+
+	// solving is set while a Solve of the challenge is being handled
+	solving bool
+}
+
+// NewMachine creates the state machine of a new connection,
+// which may hold up to maxOutstanding challenges at once
+func NewMachine(maxOutstanding int) *Machine {
+	return &Machine{
+		maxOutstanding: maxOutstanding,
+		challengeTTL:   defaultChallengeTTL,
+		challenges:     make(map[string]outstanding),
+	}
+}
+
+// SetChallengeTTL tells how long a challenge can be solved once issued,
+// i.e. the max duration of the challenges
+func (m *Machine) SetChallengeTTL(ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.challengeTTL = ttl
+}
+
+func (m *Machine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.state
+}
+
+// Outstanding returns the number of challenges issued on the connection and not solved yet
+func (m *Machine) Outstanding() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.evict(time.Now())
+	return len(m.challenges)
+}
+
+// Expires returns when the last of the outstanding challenges expires,
+// the zero time when there are none
+func (m *Machine) Expires() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expires time.Time
+	for _, c := range m.challenges {
+		if t := c.issued.Add(m.challengeTTL); t.After(expires) {
+			expires = t
+		}
+	}
+	return expires
+}
+
+// Challenges returns the nonces of the challenges issued on the connection and not solved yet
+func (m *Machine) Challenges() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.evict(time.Now())
+	nonces := make([]string, 0, len(m.challenges))
+	for nonce := range m.challenges {
+		nonces = append(nonces, nonce)
+	}
+	return nonces
+}
+
+// Restore puts back the challenges outstanding on a former connection of the peer,
+// e.g. when it resumes its session, they count as issued at the time of the restore
+func (m *Machine) Restore(challenges []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.challenges = make(map[string]outstanding, len(challenges))
+	for _, nonce := range challenges {
+		m.challenges[nonce] = outstanding{issued: now}
+	}
+	if len(challenges) > 0 {
+		m.state = Challenged
+	}
+}
+
+// Check tells whether the peer may send the request in the current state
+func (m *Machine) Check(req *Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.check(req)
+}
+
+func (m *Machine) check(req *Payload) error {
+	m.evict(time.Now())
+
+	switch req.Action {
+	case Request:
+		if outstanding := len(m.challenges) + m.requesting; outstanding >= m.maxOutstanding {
+			return fmt.Errorf("%w: %d of %d", ErrTooManyChallenges, outstanding, m.maxOutstanding)
+		}
+	case Solve:
+		if len(m.challenges) == 0 {
+			return fmt.Errorf("%w: solve in %s state without an outstanding challenge", ErrIllegalTransition, m.state)
+		}
+
+		nonce, err := challenge.Nonce(string(req.Data))
+		if err != nil {
+			return err
+		}
+
+		c, ok := m.challenges[nonce]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrForeignChallenge, nonce)
+		}
+		if c.solving {
+			return fmt.Errorf("%w: challenge %s is being solved", ErrIllegalTransition, nonce)
+		}
+	case Redeem, Ping, Pong, Close:
+	case Hello:
+		if m.state != Idle || len(m.challenges) > 0 {
+			return fmt.Errorf("%w: hello in %s state", ErrIllegalTransition, m.state)
+		}
+	case Resume:
+		if m.state == Challenged {
+			return fmt.Errorf("%w: resume in %s state", ErrIllegalTransition, m.state)
+		}
+	default:
+		return fmt.Errorf("%w: action [%d] is not sent by clients", ErrIllegalTransition, req.Action)
+	}
+
+	return nil
+}
+
+// evict forgets the challenges that expired unsolved, so that a peer giving up
+// on a challenge is not held to the limit by it, nor can solve it any more
+func (m *Machine) evict(now time.Time) {
+	for nonce, c := range m.challenges {
+		if !c.solving && now.Sub(c.issued) > m.challengeTTL {
+			delete(m.challenges, nonce)
+		}
+	}
+
+	if len(m.challenges) == 0 && m.state == Challenged {
+		m.state = Idle
+	}
+}
+
+// Advance moves the machine once the request of the peer got the response
+func (m *Machine) Advance(req, resp *Payload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance(req, resp)
+}
+
+func (m *Machine) advance(req, resp *Payload) {
+	switch {
+	case req.Action == Request && resp.Action == Challenge:
+		nonce, err := challenge.Nonce(string(resp.Data))
+		if err != nil {
+			slog.With("error", err.Error()).Error("protocol.Machine.advance got a malformed challenge")
+			return
+		}
+		m.challenges[nonce] = outstanding{issued: time.Now()}
+		m.state = Challenged
+	case req.Action == Solve:
+		// the challenge is spent either way
+		nonce, _ := challenge.Nonce(string(req.Data))
+		delete(m.challenges, nonce)
+		switch {
+		case resp.Action == Transmit || resp.Action == Ticket || resp.Action == TransmitStart:
+			m.state = Solved
+		case len(m.challenges) > 0:
+			m.state = Challenged
+		default:
+			m.state = Idle
+		}
+	case req.Action == Redeem && (resp.Action == Transmit || resp.Action == TransmitStart):
+		m.state = Solved
+	}
+}
+
+// Handle passes the request to h when it is legal in the current state and advances
+// the machine with the response, illegal requests are answered with a Reject
+func (m *Machine) Handle(ctx context.Context, h handler, req []byte, clientIP string) (*Payload, error) {
+	p, err := Decode(req)
+	if err != nil {
+		return nil, fmt.Errorf("protocol.Machine.Handle failed to decode request: %w", err)
+	}
+
+	if err := m.reserve(p); err != nil {
+		slog.With("error", err.Error()).With("client", clientIP).Warn("rejecting illegal request")
+		return RejectFor(err), nil
+	}
+
+	resp, err := h.Handle(ctx, req, clientIP)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.release(p)
+	if err != nil {
+		return nil, err
+	}
+
+	m.advance(p, resp)
+	return resp, nil
+}
+
+// reserve checks the request and counts it as being handled until it is released
+func (m *Machine) reserve(req *Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(req); err != nil {
+		return err
+	}
+
+	switch req.Action {
+	case Request:
+		m.requesting++
+	case Solve:
+		nonce, _ := challenge.Nonce(string(req.Data))
+		c := m.challenges[nonce]
+		c.solving = true
+		m.challenges[nonce] = c
+	}
+	return nil
+}
+
+func (m *Machine) release(req *Payload) {
+	switch req.Action {
+	case Request:
+		m.requesting--
+	case Solve:
+		nonce, _ := challenge.Nonce(string(req.Data))
+		if c, ok := m.challenges[nonce]; ok {
+			c.solving = false
+			m.challenges[nonce] = c
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package protocol_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// step is a request of the peer and the response of the handler, if the request is legal
+type step struct {
+	req  protocol.Action
+	resp protocol.Action
+}
+
+// header is the n-th challenge issued by the handler
+func header(n int) string {
+	return fmt.Sprintf("1|3|1700000000|127.0.0.1:52374|nonce%d|0", n)
+}
+
+// exchange makes up the payloads of the steps: challenges carry headers
+// of their own, and every Solve solves the oldest outstanding challenge
+type exchange struct {
+	issued, solved int
+}
+
+func (e *exchange) request(a protocol.Action) *protocol.Payload {
+	if a == protocol.Solve {
+		return &protocol.Payload{Action: a, Data: []byte(header(e.solved + 1))}
+	}
+	return &protocol.Payload{Action: a}
+}
+
+func (e *exchange) response(req, resp protocol.Action) *protocol.Payload {
+	if req == protocol.Solve {
+		e.solved++
+	}
+	if resp == protocol.Challenge {
+		e.issued++
+		return &protocol.Payload{Action: resp, Data: []byte(header(e.issued))}
+	}
+	return &protocol.Payload{Action: resp}
+}
+
+func TestMachine(t *testing.T) {
+	tests := []struct {
+		name        string
+		max         int
+		steps       []step
+		next        protocol.Action
+		nextData    string
+		wantErr     error
+		state       protocol.State
+		outstanding int
+	}{
+		{
+			name:  "request in idle state",
+			max:   1,
+			next:  protocol.Request,
+			state: protocol.Idle,
+		},
+		{
+			name:        "solve of an outstanding challenge",
+			max:         1,
+			steps:       []step{{protocol.Request, protocol.Challenge}},
+			next:        protocol.Solve,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:        "solve of a challenge issued elsewhere",
+			max:         1,
+			steps:       []step{{protocol.Request, protocol.Challenge}},
+			next:        protocol.Solve,
+			nextData:    "1|3|1700000000|127.0.0.1:52374|elsewhere|0",
+			wantErr:     protocol.ErrForeignChallenge,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:    "solve without a request",
+			max:     1,
+			next:    protocol.Solve,
+			wantErr: protocol.ErrIllegalTransition,
+			state:   protocol.Idle,
+		},
+		{
+			name:    "solve after the challenge is solved",
+			max:     1,
+			steps:   []step{{protocol.Request, protocol.Challenge}, {protocol.Solve, protocol.Transmit}},
+			next:    protocol.Solve,
+			wantErr: protocol.ErrIllegalTransition,
+			state:   protocol.Solved,
+		},
+		{
+			name:    "rejected solution spends the challenge",
+			max:     1,
+			steps:   []step{{protocol.Request, protocol.Challenge}, {protocol.Solve, protocol.Reject}},
+			next:    protocol.Solve,
+			wantErr: protocol.ErrIllegalTransition,
+			state:   protocol.Idle,
+		},
+		{
+			name:        "requests in a row above the limit",
+			max:         2,
+			steps:       []step{{protocol.Request, protocol.Challenge}, {protocol.Request, protocol.Challenge}},
+			next:        protocol.Request,
+			wantErr:     protocol.ErrTooManyChallenges,
+			state:       protocol.Challenged,
+			outstanding: 2,
+		},
+		{
+			name:        "rejected solution keeps the other challenges",
+			max:         2,
+			steps:       []step{{protocol.Request, protocol.Challenge}, {protocol.Request, protocol.Challenge}, {protocol.Solve, protocol.Reject}},
+			next:        protocol.Solve,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:        "request once solved",
+			max:         1,
+			steps:       []step{{protocol.Request, protocol.Challenge}, {protocol.Solve, protocol.Ticket}, {protocol.Request, protocol.Challenge}},
+			next:        protocol.Solve,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:  "redeemed ticket",
+			max:   1,
+			steps: []step{{protocol.Redeem, protocol.Transmit}},
+			next:  protocol.Request,
+			state: protocol.Solved,
+		},
+		{
+			name:  "rejected ticket",
+			max:   1,
+			steps: []step{{protocol.Redeem, protocol.Reject}},
+			next:  protocol.Request,
+			state: protocol.Idle,
+		},
+		{
+			name:        "resume with an outstanding challenge",
+			max:         1,
+			steps:       []step{{protocol.Request, protocol.Challenge}},
+			next:        protocol.Resume,
+			wantErr:     protocol.ErrIllegalTransition,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:  "hello on a new connection",
+			max:   1,
+			next:  protocol.Hello,
+			state: protocol.Idle,
+		},
+		{
+			name:        "hello with an outstanding challenge",
+			max:         1,
+			steps:       []step{{protocol.Request, protocol.Challenge}},
+			next:        protocol.Hello,
+			wantErr:     protocol.ErrIllegalTransition,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:        "ping with an outstanding challenge",
+			max:         1,
+			steps:       []step{{protocol.Request, protocol.Challenge}, {protocol.Ping, protocol.Pong}},
+			next:        protocol.Close,
+			state:       protocol.Challenged,
+			outstanding: 1,
+		},
+		{
+			name:    "transmit sent by the peer",
+			max:     1,
+			next:    protocol.Transmit,
+			wantErr: protocol.ErrIllegalTransition,
+			state:   protocol.Idle,
+		},
+		{
+			name:    "challenge sent by the peer",
+			max:     1,
+			next:    protocol.Challenge,
+			wantErr: protocol.ErrIllegalTransition,
+			state:   protocol.Idle,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := protocol.NewMachine(tt.max)
+			e := &exchange{}
+			for _, s := range tt.steps {
+				req := e.request(s.req)
+				require.NoError(t, m.Check(req))
+				m.Advance(req, e.response(s.req, s.resp))
+			}
+
+			next := e.request(tt.next)
+			if tt.nextData != "" {
+				next.Data = []byte(tt.nextData)
+			}
+			err := m.Check(next)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.state, m.State())
+			assert.Equal(t, tt.outstanding, m.Outstanding())
+		})
+	}
+}
+
+// challengeHandler answers every request with a challenge
+type challengeHandler struct {
+	calls int
+}
+
+func (h *challengeHandler) Handle(_ context.Context, _ []byte, _ string) (*protocol.Payload, error) {
+	h.calls++
+	return &protocol.Payload{Action: protocol.Challenge, Data: []byte(header(h.calls))}, nil
+}
+
+func TestMachine_Handle(t *testing.T) {
+	m := protocol.NewMachine(1)
+	h := &challengeHandler{}
+
+	handle := func(a protocol.Action) *protocol.Payload {
+		req, err := (&protocol.Payload{Action: a}).Encode()
+		require.NoError(t, err)
+		resp, err := m.Handle(context.Background(), h, req, "127.0.0.1:52374")
+		require.NoError(t, err)
+		return resp
+	}
+
+	assert.Equal(t, protocol.Challenge, handle(protocol.Request).Action)
+
+	resp := handle(protocol.Request)
+	assert.Equal(t, protocol.Reject, resp.Action)
+	rejection, err := protocol.ParseReject(resp.Data)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ReasonIllegalTransition, rejection.Reason)
+
+	assert.Equal(t, protocol.Reject, handle(protocol.Transmit).Action)
+	assert.Equal(t, 1, h.calls, "illegal requests do not reach the handler")
+	assert.Equal(t, protocol.Challenged, m.State())
+}
+
+func TestMachine_Expires(t *testing.T) {
+	m := protocol.NewMachine(2)
+	m.SetChallengeTTL(time.Minute)
+	assert.True(t, m.Expires().IsZero())
+
+	issued := time.Now()
+	m.Advance(&protocol.Payload{Action: protocol.Request}, &protocol.Payload{Action: protocol.Challenge, Data: []byte(header(1))})
+	assert.WithinDuration(t, issued.Add(time.Minute), m.Expires(), time.Second)
+
+	m.Advance(&protocol.Payload{Action: protocol.Solve, Data: []byte(header(1))}, &protocol.Payload{Action: protocol.Transmit})
+	assert.True(t, m.Expires().IsZero(), "solved challenges do not expire")
+}
+
+func TestMachine_ExpiredChallenges(t *testing.T) {
+	m := protocol.NewMachine(1)
+	m.SetChallengeTTL(time.Millisecond)
+
+	m.Advance(&protocol.Payload{Action: protocol.Request}, &protocol.Payload{Action: protocol.Challenge, Data: []byte(header(1))})
+	assert.ErrorIs(t, m.Check(&protocol.Payload{Action: protocol.Request}), protocol.ErrTooManyChallenges)
+
+	// a peer giving up on its challenge asks for another one once it expired
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, m.Check(&protocol.Payload{Action: protocol.Request}))
+	assert.Equal(t, protocol.Idle, m.State())
+	assert.Zero(t, m.Outstanding())
+
+	err := m.Check(&protocol.Payload{Action: protocol.Solve, Data: []byte(header(1))})
+	assert.ErrorIs(t, err, protocol.ErrIllegalTransition, "the expired challenge is not solved")
+}
@@ -0,0 +1,280 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	ErrMuxClosed   = errors.New("multiplexed connection closed")
+	ErrStreamReset = errors.New("stream reset")
+	ErrFlowControl = errors.New("stream data beyond its window")
+)
+
+const (
+	// InitialWindow is how many bytes either side may send to a new stream
+	// before the peer lets it send more with a StreamWindow
+	InitialWindow = 256 << 10
+
+	// acceptBacklog is how many streams opened by the peer wait to be accepted,
+	// the streams above it are reset as overloaded
+	acceptBacklog = 64
+
+	// defaultMaxStreams bounds the streams open at once unless SetMaxStreams says otherwise
+	defaultMaxStreams = 100
+
+	// windowSize is the size of the data of a StreamWindow
+	windowSize = 4
+)
+
+// Mux carries independent streams over a single connection, e.g. the connection a client
+// solved a challenge on. Each stream has its own flow-control window, so a stream whose
+// reader is stalled never blocks the others. Streams opened by the client have odd IDs
+// and the ones opened by the server even IDs. Pings of the peer are answered on the way.
+type Mux struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// wmu keeps the frames of concurrent writers whole
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	// maxStreams bounds the streams open at once, see SetMaxStreams
+	maxStreams int
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// NewMux starts multiplexing the connection, frames are read from r,
+// which may hold bytes already buffered from conn
+func NewMux(conn net.Conn, r *bufio.Reader, client bool) *Mux {
+	m := &Mux{
+		conn:       conn,
+		r:          r,
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		maxStreams: defaultMaxStreams,
+		accept:     make(chan *Stream, acceptBacklog),
+		done:       make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+
+	go m.read()
+	return m
+}
+
+// SetMaxStreams limits the streams open at once,
+// the streams the peer opens above it are reset as overloaded
+func (m *Mux) SetMaxStreams(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxStreams = n
+}
+
+// Open opens a new stream
+func (m *Mux) Open() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+
+	st := newStream(m.nextID, m)
+	m.streams[st.id] = st
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.send(&Payload{Action: StreamOpen, ID: st.id}); err != nil {
+		return nil, fmt.Errorf("protocol.Mux.Open failed: %w", err)
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (m *Mux) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.done:
+		return nil, m.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed once the connection is closed
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the connection was closed
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+// Close says goodbye to the peer and closes the connection with all its streams
+func (m *Mux) Close() error {
+	_ = m.send(NewClose(Rejection{Reason: ReasonGoodbye}))
+	m.fail(ErrMuxClosed)
+	return nil
+}
+
+func (m *Mux) send(p *Payload) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	return Send(p, m.conn)
+}
+
+// fail closes the connection and every stream with err
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	close(m.done)
+	m.mu.Unlock()
+
+	for _, st := range streams {
+		st.abort(err)
+	}
+	_ = m.conn.Close()
+}
+
+// read dispatches the frames of the peer to their streams until the connection fails
+func (m *Mux) read() {
+	for {
+		b, err := ReadFrame(m.r)
+		if err != nil {
+			m.fail(fmt.Errorf("%w: %w", ErrMuxClosed, err))
+			return
+		}
+
+		p, err := Decode(b)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+
+		if err := m.dispatch(p); err != nil {
+			m.fail(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) dispatch(p *Payload) error {
+	switch p.Action {
+	case Ping:
+		return m.send(&Payload{Action: Pong})
+	case Pong:
+		return nil
+	case Close:
+		r, err := ParseReject(p.Data)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ErrMuxClosed, r)
+	case StreamOpen:
+		return m.opened(p.ID)
+	}
+
+	m.mu.Lock()
+	st := m.streams[p.ID]
+	m.mu.Unlock()
+
+	// frames of a stream closed on this side meanwhile are dropped
+	if st == nil {
+		return nil
+	}
+
+	switch p.Action {
+	case StreamData:
+		if err := st.receive(p.Data); err != nil {
+			m.reset(st, Rejection{Reason: ReasonIllegalTransition})
+		}
+	case StreamWindow:
+		if len(p.Data) != windowSize {
+			return fmt.Errorf("%w: %d bytes of stream window", ErrMalformedFrame, len(p.Data))
+		}
+		if err := st.grant(binary.LittleEndian.Uint32(p.Data)); err != nil {
+			m.reset(st, Rejection{Reason: ReasonIllegalTransition})
+		}
+	case StreamClose:
+		st.closeRead()
+	case StreamReset:
+		r, err := ParseReject(p.Data)
+		if err != nil {
+			return err
+		}
+		m.forget(st.id)
+		st.abort(fmt.Errorf("%w: %w", ErrStreamReset, r))
+	default:
+		return fmt.Errorf("%w: action [%d] on a multiplexed connection", ErrIllegalTransition, p.Action)
+	}
+
+	return nil
+}
+
+// opened accepts a stream the peer opened
+func (m *Mux) opened(id uint32) error {
+	m.mu.Lock()
+	if _, ok := m.streams[id]; ok || id == 0 || id%2 == m.nextID%2 {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: stream %d opened twice or with an id of this side", ErrIllegalTransition, id)
+	}
+
+	st := newStream(id, m)
+	if len(m.streams) >= m.maxStreams {
+		m.mu.Unlock()
+		m.reset(st, Rejection{Reason: ReasonOverloaded})
+		return nil
+	}
+	m.streams[id] = st
+	m.mu.Unlock()
+
+	select {
+	case m.accept <- st:
+	default:
+		m.reset(st, Rejection{Reason: ReasonOverloaded})
+	}
+	return nil
+}
+
+// reset aborts the stream on both sides
+func (m *Mux) reset(st *Stream, r Rejection) {
+	m.forget(st.id)
+	st.abort(fmt.Errorf("%w: %w", ErrStreamReset, r))
+
+	p := NewReject(r)
+	p.Action, p.ID = StreamReset, st.id
+	_ = m.send(p)
+}
+
+func (m *Mux) forget(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.streams, id)
+}
@@ -0,0 +1,209 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func muxPair(t *testing.T) (client, server *protocol.Mux) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	client = protocol.NewMux(a, bufio.NewReader(a), true)
+	server = protocol.NewMux(b, bufio.NewReader(b), false)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func accept(t *testing.T, m *protocol.Mux) *protocol.Stream {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	st, err := m.Accept(ctx)
+	require.NoError(t, err)
+	return st
+}
+
+func TestMux(t *testing.T) {
+	t.Run("independent streams", func(t *testing.T) {
+		client, server := muxPair(t)
+
+		// the server echoes every stream until it is closed
+		go func() {
+			for {
+				st, err := server.Accept(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(st, st)
+					_ = st.CloseWrite()
+				}()
+			}
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			st, err := client.Open()
+			require.NoError(t, err)
+			assert.Equal(t, uint32(2*i+1), st.ID())
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				msg := bytes.Repeat([]byte{byte(st.ID())}, 100<<10)
+				go func() {
+					_, _ = st.Write(msg)
+					_ = st.CloseWrite()
+				}()
+
+				got, err := io.ReadAll(st)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, got)
+				assert.NoError(t, st.Close())
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("stalled stream", func(t *testing.T) {
+		client, server := muxPair(t)
+
+		stalled, err := client.Open()
+		require.NoError(t, err)
+		stalledPeer := accept(t, server)
+
+		// the writer of a stream nobody reads stops at the window
+		written := make(chan int, 1)
+		go func() {
+			n, _ := stalled.Write(make([]byte, protocol.InitialWindow+1))
+			written <- n
+		}()
+
+		// other streams go on meanwhile
+		st, err := client.Open()
+		require.NoError(t, err)
+		peer := accept(t, server)
+		_, err = st.Write([]byte("ping"))
+		require.NoError(t, err)
+		b := make([]byte, 4)
+		_, err = io.ReadFull(peer, b)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(b))
+
+		select {
+		case n := <-written:
+			t.Fatalf("stalled stream wrote %d bytes beyond the window", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// reading frees the window
+		_, err = io.ReadFull(stalledPeer, make([]byte, protocol.InitialWindow+1))
+		require.NoError(t, err)
+		assert.Equal(t, protocol.InitialWindow+1, <-written)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		client, server := muxPair(t)
+
+		st, err := client.Open()
+		require.NoError(t, err)
+		peer := accept(t, server)
+
+		peer.Reset(protocol.Rejection{Reason: protocol.ReasonUnavailable})
+		_, err = st.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, protocol.ErrStreamReset)
+
+		var r protocol.Rejection
+		require.ErrorAs(t, err, &r)
+		assert.Equal(t, protocol.ReasonUnavailable, r.Reason)
+	})
+
+	t.Run("streams above the limit", func(t *testing.T) {
+		client, server := muxPair(t)
+		server.SetMaxStreams(1)
+
+		st, err := client.Open()
+		require.NoError(t, err)
+		accept(t, server)
+
+		over, err := client.Open()
+		require.NoError(t, err)
+		require.NoError(t, over.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = over.Read(make([]byte, 1))
+		var r protocol.Rejection
+		require.ErrorAs(t, err, &r)
+		assert.Equal(t, protocol.ReasonOverloaded, r.Reason)
+
+		// the first stream goes on
+		_, err = st.Write([]byte("ping"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("window beyond 32 bits", func(t *testing.T) {
+		a, b := net.Pipe()
+		server := protocol.NewMux(b, bufio.NewReader(b), false)
+		t.Cleanup(func() {
+			_ = a.Close()
+			_ = server.Close()
+		})
+
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.StreamOpen, ID: 1}, a))
+		accept(t, server)
+		window := &protocol.Payload{Action: protocol.StreamWindow, ID: 1, Data: []byte{0xff, 0xff, 0xff, 0xff}}
+		require.NoError(t, protocol.Send(window, a))
+		require.NoError(t, a.SetReadDeadline(time.Now().Add(time.Second)))
+
+		f, err := protocol.ReadFrame(bufio.NewReader(a))
+		require.NoError(t, err)
+		p, err := protocol.Decode(f)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.StreamReset, p.Action)
+		assert.Equal(t, uint32(1), p.ID)
+	})
+
+	t.Run("read deadline", func(t *testing.T) {
+		client, server := muxPair(t)
+
+		st, err := client.Open()
+		require.NoError(t, err)
+		accept(t, server)
+
+		require.NoError(t, st.SetReadDeadline(time.Now().Add(20*time.Millisecond)))
+		_, err = st.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("closed connection", func(t *testing.T) {
+		client, server := muxPair(t)
+
+		st, err := client.Open()
+		require.NoError(t, err)
+		accept(t, server)
+
+		require.NoError(t, server.Close())
+		_, err = st.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, protocol.ErrMuxClosed)
+
+		<-client.Done()
+		_, err = client.Open()
+		assert.ErrorIs(t, err, protocol.ErrMuxClosed)
+	})
+}
@@ -2,6 +2,8 @@ package protocol
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io"
 )
 
 const Delimiter = '#'
@@ -14,28 +16,123 @@ const (
 	Solve
 	Reject
 	Transmit
+
+	// Ticket answers an accepted solution with a ticket along with the transmission,
+	// see NewTicket
+	Ticket
+
+	// Redeem presents a ticket instead of a solution
+	Redeem
+
+	// Resume opens a session when its data is empty, or resumes the session with
+	// the id from its data, e.g. after a reconnect
+	Resume
+
+	// Session answers a Resume with the id of the session to resume next time,
+	// see NewSession
+	Session
+
+	// Hello advertises the versions, the algorithms and the limits of the client,
+	// see Offer
+	Hello
+
+	// ServerHello answers a Hello with the version and the algorithm picked
+	// for the connection, see Agreement
+	ServerHello
+
+	// Ping asks the peer to answer with a Pong, either side may send it
+	Ping
+
+	// Pong answers a Ping
+	Pong
+
+	// Close tells the peer why the connection is about to be closed, see NewClose
+	Close
+
+	// StreamOpen opens the stream with the ID of the frame, see Mux
+	StreamOpen
+
+	// StreamData carries bytes of the stream with the ID of the frame
+	StreamData
+
+	// StreamWindow lets the peer send as many more bytes to the stream as its data tells, uint32 LE
+	StreamWindow
+
+	// StreamClose tells the peer that nothing more is written to the stream
+	StreamClose
+
+	// StreamReset aborts the stream in both directions, its data is read with ParseReject
+	StreamReset
+
+	// TransmitStart answers like a Transmit with a transmission too large for a frame,
+	// see NewTransmitStart, the transmission follows in TransmitChunk frames
+	TransmitStart
+
+	// TransmitChunk carries a part of the streamed transmission
+	TransmitChunk
+
+	// TransmitEnd ends the streamed transmission with the SHA-256 of its bytes
+	TransmitEnd
 )
 
+// taggedFlag is set in the action of frames carrying a request ID after the data length,
+// so that a client pipelining requests matches the responses coming out of order
+const taggedFlag Action = 1 << 15
+
 type Payload struct {
 	Action Action
-	Data   []byte
+
+	// ID tags the frame, a response carries the ID of its request.
+	// Frames with a zero ID are not tagged, as before request IDs.
+	ID uint32
+
+	Data []byte
+
+	// Body is streamed by Send after a TransmitStart, it is never encoded with the frame
+	Body io.Reader
 }
 
+// Encode fails with ErrPayloadTooLarge when the data does not fit a frame,
+// a larger transmission is streamed with NewTransmitStart
 func (p *Payload) Encode() ([]byte, error) {
-	buf := make([]byte, 2+2+len(p.Data)+1)
-	binary.LittleEndian.PutUint16(buf, uint16(p.Action))
-	// todo: verify that data length is not above uint16
+	if len(p.Data) > MaxDataSize {
+		return nil, fmt.Errorf("%w: %d bytes of data", ErrPayloadTooLarge, len(p.Data))
+	}
+
+	header := HeaderSize
+	action := p.Action
+	if p.ID != 0 {
+		header += IDSize
+		action |= taggedFlag
+	}
+
+	buf := make([]byte, header+len(p.Data)+1)
+	binary.LittleEndian.PutUint16(buf, uint16(action))
 	binary.LittleEndian.PutUint16(buf[2:], uint16(len(p.Data)))
-	copy(buf[4:], p.Data)
+	if p.ID != 0 {
+		binary.LittleEndian.PutUint32(buf[HeaderSize:], p.ID)
+	}
+	copy(buf[header:], p.Data)
 	buf[len(buf)-1] = Delimiter
 	return buf, nil
 }
 
 func Decode(b []byte) (*Payload, error) {
+	// the delimiter is not needed to read the payload
+	if len(b) < HeaderSize || len(b) < frameSize(b)-1 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformedFrame, len(b))
+	}
+
 	p := Payload{}
 	p.Action = Action(binary.LittleEndian.Uint16(b))
 	length := binary.LittleEndian.Uint16(b[2:])
+	header := HeaderSize
+	if p.Action&taggedFlag != 0 {
+		p.Action &^= taggedFlag
+		p.ID = binary.LittleEndian.Uint32(b[HeaderSize:])
+		header += IDSize
+	}
 	p.Data = make([]byte, length)
-	copy(p.Data, b[4:])
+	copy(p.Data, b[header:])
 	return &p, nil
 }
@@ -6,33 +6,74 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 )
 
 var (
 	ErrInvalidRequestAction = errors.New("invalid request action")
+	ErrTicketsDisabled      = errors.New("tickets are not issued")
 )
 
+// TicketDelimiter separates the ticket from the transmission in the data of a Ticket,
+// and the id of a session from its ticket in the data of a Session
+const TicketDelimiter = "\n"
+
 type challenger interface {
 	Create(string) (string, error)
 	Solve(header string) (string, error)
+	Verify(header, resource string) error
+	Zeroes() uint8
 }
 
 type transmissionProvider interface {
 	Provide() string
 }
 
+type ticketer interface {
+	Issue(header, clientIP string) (string, error)
+	Redeem(ticket, clientIP string) error
+}
+
 type Protocol struct {
-	c  challenger
-	tp transmissionProvider
+	c          challenger
+	tp         transmissionProvider
+	strict     bool
+	tickets    ticketer
+	versions   []Version
+	algorithms []Algorithm
 }
 
 func New(c challenger, tp transmissionProvider) *Protocol {
 	return &Protocol{
-		c:  c,
-		tp: tp,
+		c:          c,
+		tp:         tp,
+		versions:   Versions,
+		algorithms: Algorithms,
 	}
 }
 
+// SetStrict makes solutions valid only for the client the challenge was issued to,
+// and only once. The protocol then never does the work on behalf of the client either.
+// It suits transports whose client address can be spoofed, like UDP,
+// and servers letting solved clients through to a backend.
+func (pr *Protocol) SetStrict(strict bool) {
+	pr.strict = strict
+}
+
+// SetTickets makes the protocol answer accepted solutions with a Ticket
+// instead of a Transmit, the client presents the ticket in a Redeem afterwards
+// to get a Transmit without solving again. A ticket stands for work the client did,
+// so the solutions are verified like with SetStrict once tickets are issued.
+func (pr *Protocol) SetTickets(t ticketer) {
+	pr.tickets = t
+}
+
+// SetVersions changes the versions the protocol agrees to in a ServerHello,
+// e.g. to keep speaking an older version only
+func (pr *Protocol) SetVersions(versions ...Version) {
+	pr.versions = versions
+}
+
 func (pr *Protocol) Handle(_ context.Context, req []byte, clientIP string) (*Payload, error) {
 	p, err := Decode(req)
 	if err != nil {
@@ -53,29 +94,139 @@ func (pr *Protocol) Handle(_ context.Context, req []byte, clientIP string) (*Pay
 
 		return &p, nil
 	case Solve:
-		header, err := pr.c.Solve(string(p.Data))
+		header, err := pr.solve(string(p.Data), clientIP)
 		errWrapped := fmt.Errorf("solve action failed: %w", err)
 		if err != nil {
 			slog.With("error", errWrapped).Error("rejecting solve")
-			return &Payload{
-				Action: Reject,
-				Data:   []byte(errWrapped.Error()),
-			}, nil
+			return pr.reject(err), nil
 		}
 
 		slog.With("header", header).Info("confirmed correct solve")
+		if sp, ok := pr.tp.(streamProvider); ok {
+			return pr.stream(sp, header, clientIP), nil
+		}
+
 		transmission := pr.tp.Provide()
 
+		if pr.tickets != nil {
+			ticket, err := pr.tickets.Issue(header, clientIP)
+			if err == nil {
+				return NewTicket(ticket, transmission), nil
+			}
+			slog.With("error", err.Error()).Error("failed to issue a ticket")
+		}
+
 		return &Payload{
 			Action: Transmit,
 			Data:   []byte(transmission),
 		}, nil
+	case Redeem:
+		if err := pr.redeem(string(p.Data), clientIP); err != nil {
+			errWrapped := fmt.Errorf("redeem action failed: %w", err)
+			slog.With("error", errWrapped).Info("rejecting ticket")
+			return pr.reject(err), nil
+		}
+
+		if sp, ok := pr.tp.(streamProvider); ok {
+			return pr.stream(sp, "", clientIP), nil
+		}
+
+		return &Payload{
+			Action: Transmit,
+			Data:   []byte(pr.tp.Provide()),
+		}, nil
+	case Hello:
+		return pr.hello(p.Data, clientIP), nil
+	case Ping:
+		return &Payload{Action: Pong}, nil
 	default:
 		return nil, ErrInvalidRequestAction
 	}
 }
 
+// hello answers the Hello of a client with the version and the algorithm of the connection,
+// or rejects it when there is none in common or the challenges are harder than the client accepts
+func (pr *Protocol) hello(data []byte, clientIP string) *Payload {
+	offer, err := ParseOffer(data)
+	if err != nil {
+		return RejectFor(err)
+	}
+
+	version, algorithm, err := negotiate(offer, pr.versions, pr.algorithms)
+	if err != nil {
+		slog.With("client", clientIP).With("versions", offer.Versions).Info("rejecting hello")
+		return RejectFor(err)
+	}
+
+	zeroes := pr.c.Zeroes()
+	if offer.MaxDifficulty != 0 && zeroes > offer.MaxDifficulty {
+		return NewReject(Rejection{Reason: ReasonWrongDifficulty, Difficulty: zeroes})
+	}
+
+	slog.With("client", clientIP).With("version", version).With("cores", offer.Cores).Info("agreed on hello")
+	return Agreement{Version: version, Algorithm: algorithm, Difficulty: zeroes}.Payload()
+}
+
+func (pr *Protocol) solve(header, clientIP string) (string, error) {
+	if !pr.strict && pr.tickets == nil {
+		return pr.c.Solve(header)
+	}
+
+	if err := pr.c.Verify(header, clientIP); err != nil {
+		return "", err
+	}
+	return header, nil
+}
+
+// reject answers with the reason of err, a wrong difficulty
+// is answered with the number of zeroes to solve
+func (pr *Protocol) reject(err error) *Payload {
+	r := Rejection{Reason: reasonOf(err)}
+	if r.Reason == ReasonWrongDifficulty {
+		r.Difficulty = pr.c.Zeroes()
+	}
+	return NewReject(r)
+}
+
+func (pr *Protocol) redeem(ticket, clientIP string) error {
+	if pr.tickets == nil {
+		return ErrTicketsDisabled
+	}
+	return pr.tickets.Redeem(ticket, clientIP)
+}
+
+// NewTicket creates a Ticket payload carrying the ticket and the transmission
+func NewTicket(ticket, transmission string) *Payload {
+	return &Payload{
+		Action: Ticket,
+		Data:   []byte(ticket + TicketDelimiter + transmission),
+	}
+}
+
+// SplitTicket splits the data of a Ticket payload into the ticket and the transmission
+func SplitTicket(data []byte) (ticket, transmission string, ok bool) {
+	return strings.Cut(string(data), TicketDelimiter)
+}
+
+// NewSession creates a Session payload carrying the id of the session
+// and the ticket issued during the resumed one, if any
+func NewSession(id, ticket string) *Payload {
+	return &Payload{
+		Action: Session,
+		Data:   []byte(id + TicketDelimiter + ticket),
+	}
+}
+
+// SplitSession splits the data of a Session payload into the id of the session and the ticket
+func SplitSession(data []byte) (id, ticket string) {
+	id, ticket, _ = strings.Cut(string(data), TicketDelimiter)
+	return id, ticket
+}
+
+// Send writes the frame of the payload to w, followed by its body, if any
 func Send(p *Payload, w io.Writer) error {
+	defer p.CloseBody()
+
 	b, err := p.Encode()
 	if err != nil {
 		return fmt.Errorf("failed to encode payload: %w", err)
@@ -85,5 +236,8 @@ func Send(p *Payload, w io.Writer) error {
 		return fmt.Errorf("failed to write encoded payload: %w", err)
 	}
 
+	if p.Body != nil {
+		return sendBody(p, w)
+	}
 	return nil
 }
@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/challenge"
+	"math"
+	"time"
+)
+
+var ErrMalformedReject = errors.New("malformed reject")
+
+// Reason tells the client why its request was rejected
+type Reason uint16
+
+const (
+	// ReasonUnspecified is the reason of rejections the server does not explain
+	ReasonUnspecified Reason = iota
+
+	// ReasonExpired rejects challenges and tickets older than the server accepts
+	ReasonExpired
+
+	// ReasonWrongDifficulty rejects headers with another number of zeroes,
+	// the rejection hints the number the server asks for
+	ReasonWrongDifficulty
+
+	// ReasonUnknownNonce rejects challenges and tickets the server did not issue
+	ReasonUnknownNonce
+
+	// ReasonReplay rejects challenges solved before and used up tickets
+	ReasonReplay
+
+	// ReasonBadBinding rejects challenges, tickets and sessions of another client
+	ReasonBadBinding
+
+	// ReasonRateLimited rejects clients sending too many requests,
+	// the rejection hints when to retry
+	ReasonRateLimited
+
+	// ReasonBanned rejects clients that are not served at all
+	ReasonBanned
+
+	// ReasonMalformed rejects headers, tickets and requests that cannot be parsed
+	ReasonMalformed
+
+	// ReasonNotSolved rejects headers without the required number of zeroes
+	ReasonNotSolved
+
+	// ReasonIllegalTransition rejects requests not allowed in the state of the connection
+	ReasonIllegalTransition
+
+	// ReasonUnavailable rejects solutions when the service behind the server is unavailable,
+	// the rejection hints when to retry
+	ReasonUnavailable
+
+	// ReasonUnsupported rejects a Hello without a version or an algorithm the server speaks
+	ReasonUnsupported
+
+	// ReasonShutdown closes connections of a server going away, e.g. for an upgrade,
+	// the client may reconnect right away
+	ReasonShutdown
+
+	// ReasonOverloaded closes connections above the limit of the server,
+	// the close hints when to retry
+	ReasonOverloaded
+
+	// ReasonIdleTimeout closes connections of peers that did not answer a Ping
+	ReasonIdleTimeout
+
+	// ReasonGoodbye closes connections the peer is done with
+	ReasonGoodbye
+)
+
+var reasons = map[Reason]string{
+	ReasonUnspecified:       "rejected",
+	ReasonExpired:           "expired",
+	ReasonWrongDifficulty:   "wrong difficulty",
+	ReasonUnknownNonce:      "unknown nonce",
+	ReasonReplay:            "replayed",
+	ReasonBadBinding:        "issued to another client",
+	ReasonRateLimited:       "rate limited",
+	ReasonBanned:            "banned",
+	ReasonMalformed:         "invalid header",
+	ReasonNotSolved:         "not solved",
+	ReasonIllegalTransition: "illegal transition",
+	ReasonUnavailable:       "unavailable",
+	ReasonUnsupported:       "unsupported",
+	ReasonShutdown:          "shutting down",
+	ReasonOverloaded:        "overloaded",
+	ReasonIdleTimeout:       "idle timeout",
+	ReasonGoodbye:           "goodbye",
+}
+
+func (r Reason) String() string {
+	if s, ok := reasons[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("reason(%d)", uint16(r))
+}
+
+// rejectSize is the size of the data of a Reject:
+// the reason, the retry-after hint in seconds and the difficulty hint
+const rejectSize = 2 + 4 + 1
+
+// Rejection is the data of a Reject and of a Close, the hints are zero when not given
+type Rejection struct {
+	Reason Reason
+
+	// RetryAfter tells when the client may try again
+	RetryAfter time.Duration
+
+	// Difficulty is the number of zeroes the server asks for
+	Difficulty uint8
+}
+
+func (r Rejection) Error() string {
+	return r.Reason.String()
+}
+
+// NewReject creates a Reject payload
+func NewReject(r Rejection) *Payload {
+	data := make([]byte, rejectSize)
+	binary.LittleEndian.PutUint16(data, uint16(r.Reason))
+	binary.LittleEndian.PutUint32(data[2:], uint32(min(r.RetryAfter.Seconds(), math.MaxUint32)))
+	data[6] = r.Difficulty
+
+	return &Payload{Action: Reject, Data: data}
+}
+
+// NewClose creates a Close payload, its data is read with ParseReject
+func NewClose(r Rejection) *Payload {
+	p := NewReject(r)
+	p.Action = Close
+	return p
+}
+
+// ParseReject reads the data of a Reject or a Close payload
+func ParseReject(data []byte) (Rejection, error) {
+	if len(data) != rejectSize {
+		return Rejection{}, fmt.Errorf("%w: %d bytes", ErrMalformedReject, len(data))
+	}
+
+	return Rejection{
+		Reason:     Reason(binary.LittleEndian.Uint16(data)),
+		RetryAfter: time.Duration(binary.LittleEndian.Uint32(data[2:])) * time.Second,
+		Difficulty: data[6],
+	}, nil
+}
+
+// RejectFor creates a Reject payload with the reason of the rejection caused by err
+func RejectFor(err error) *Payload {
+	return NewReject(Rejection{Reason: reasonOf(err)})
+}
+
+// reasonOf tells the reason of the rejection caused by err
+func reasonOf(err error) Reason {
+	switch {
+	case errors.Is(err, challenge.ErrChallengeDurationExceeded),
+		errors.Is(err, challenge.ErrTicketExpired):
+		return ReasonExpired
+	case errors.Is(err, challenge.ErrWrongDifficulty):
+		return ReasonWrongDifficulty
+	case errors.Is(err, challenge.ErrUnknownChallenge),
+		errors.Is(err, ErrForeignChallenge),
+		errors.Is(err, challenge.ErrInvalidSignature),
+		errors.Is(err, challenge.ErrInvalidTicket),
+		errors.Is(err, ErrTicketsDisabled):
+		return ReasonUnknownNonce
+	case errors.Is(err, challenge.ErrReplayed),
+		errors.Is(err, challenge.ErrTicketUsedUp):
+		return ReasonReplay
+	case errors.Is(err, challenge.ErrResourceMismatch):
+		return ReasonBadBinding
+	case errors.Is(err, challenge.ErrInvalidHeader),
+		errors.Is(err, ErrMalformedHello):
+		return ReasonMalformed
+	case errors.Is(err, challenge.ErrNotSolved),
+		errors.Is(err, challenge.ErrTooManyIterations):
+		return ReasonNotSolved
+	case errors.Is(err, ErrIllegalTransition),
+		errors.Is(err, ErrTooManyChallenges):
+		return ReasonIllegalTransition
+	case errors.Is(err, ErrUnsupportedHello):
+		return ReasonUnsupported
+	default:
+		return ReasonUnspecified
+	}
+}
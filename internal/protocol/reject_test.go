@@ -0,0 +1,71 @@
+package protocol_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/quotes"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReject(t *testing.T) {
+	t.Run("rejection round trip", func(t *testing.T) {
+		want := protocol.Rejection{Reason: protocol.ReasonRateLimited, RetryAfter: 30 * time.Second, Difficulty: 5}
+		p := protocol.NewReject(want)
+		assert.Equal(t, protocol.Reject, p.Action)
+
+		got, err := protocol.ParseReject(p.Data)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		assert.Equal(t, "rate limited", got.Error())
+	})
+
+	t.Run("malformed rejection", func(t *testing.T) {
+		_, err := protocol.ParseReject([]byte("solve action failed"))
+		assert.ErrorIs(t, err, protocol.ErrMalformedReject)
+	})
+
+	t.Run("reasons of rejected solutions", func(t *testing.T) {
+		c := challenge.New(nope.Nope{}, 3, 30)
+		c.SetSigner(challenge.NewSigner([]byte("secret")))
+		p := protocol.New(c, quotes.New())
+		p.SetStrict(true)
+
+		header, err := c.Create("127.0.0.1:52374")
+		require.NoError(t, err)
+		solved, err := challenge.New(nope.Nope{}, 3, 30).Solve(header)
+		require.NoError(t, err)
+
+		solve := func(header, clientIP string) protocol.Rejection {
+			req, err := (&protocol.Payload{Action: protocol.Solve, Data: []byte(header)}).Encode()
+			require.NoError(t, err)
+			resp, err := p.Handle(context.Background(), req, clientIP)
+			require.NoError(t, err)
+			require.Equal(t, protocol.Reject, resp.Action)
+
+			rejection, err := protocol.ParseReject(resp.Data)
+			require.NoError(t, err)
+			return rejection
+		}
+
+		assert.Equal(t, protocol.ReasonMalformed, solve("1|2|3", "127.0.0.1:52374").Reason)
+		assert.Equal(t, protocol.ReasonBadBinding, solve(solved, "127.0.0.2:52374").Reason)
+		assert.Equal(t, protocol.ReasonUnknownNonce, solve(strings.Replace(solved, "127.0.0.1", "127.0.0.2", 1), "127.0.0.2:52374").Reason)
+
+		// e.g. issued before the difficulty changed
+		easy := challenge.New(nope.Nope{}, 2, 30)
+		easy.SetSigner(challenge.NewSigner([]byte("secret")))
+		easyHeader, err := easy.Create("127.0.0.1:52374")
+		require.NoError(t, err)
+
+		wrongDifficulty := solve(easyHeader, "127.0.0.1:52374")
+		assert.Equal(t, protocol.ReasonWrongDifficulty, wrongDifficulty.Reason)
+		assert.Equal(t, uint8(3), wrongDifficulty.Difficulty)
+	})
+}
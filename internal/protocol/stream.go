@@ -0,0 +1,278 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection carried by a Mux, it is a net.Conn
+// so that it can be spliced and wrapped like any other connection
+type Stream struct {
+	id uint32
+	m  *Mux
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// buf holds the bytes received and not read yet, recvWindow is how many more
+	// the peer may send and unacked how many were read without letting the peer know
+	buf        []byte
+	recvWindow uint32
+	unacked    uint32
+
+	// sendWindow is how many more bytes may be sent to the peer
+	sendWindow uint32
+
+	readClosed  bool
+	writeClosed bool
+	err         error
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(id uint32, m *Mux) *Stream {
+	st := &Stream{
+		id:         id,
+		m:          m,
+		recvWindow: InitialWindow,
+		sendWindow: InitialWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads the bytes the peer wrote to the stream, io.EOF follows its StreamClose
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 {
+		switch {
+		case st.err != nil:
+			st.mu.Unlock()
+			return 0, st.err
+		case st.readClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.readDeadline.exceeded():
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+
+	n := copy(b, st.buf)
+	st.buf = st.buf[n:]
+	st.unacked += uint32(n)
+
+	// the window is topped up once half of it is read, not on every read
+	var grant uint32
+	if st.unacked >= InitialWindow/2 && !st.readClosed {
+		grant, st.unacked = st.unacked, 0
+		st.recvWindow += grant
+	}
+	st.mu.Unlock()
+
+	if grant > 0 {
+		data := binary.LittleEndian.AppendUint32(make([]byte, 0, windowSize), grant)
+		_ = st.m.send(&Payload{Action: StreamWindow, ID: st.id, Data: data})
+	}
+	return n, nil
+}
+
+// Write writes b to the stream, blocking while the window of the peer is used up
+func (st *Stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.writeClosed && !st.writeDeadline.exceeded() {
+			st.cond.Wait()
+		}
+
+		switch {
+		case st.err != nil:
+			st.mu.Unlock()
+			return written, st.err
+		case st.writeClosed:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case st.writeDeadline.exceeded():
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := min(len(b), int(st.sendWindow), MaxDataSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.m.send(&Payload{Action: StreamData, ID: st.id, Data: b[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite tells the peer that nothing more is written to the stream,
+// the stream is forgotten once the peer is done writing too
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.writeClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	done := st.readClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if done {
+		st.m.forget(st.id)
+	}
+	return st.m.send(&Payload{Action: StreamClose, ID: st.id})
+}
+
+// Close closes the stream, a stream the peer is still writing to is reset
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	readClosed, err := st.readClosed, st.err
+	st.mu.Unlock()
+
+	if err != nil {
+		return nil
+	}
+	if !readClosed {
+		st.m.reset(st, Rejection{Reason: ReasonGoodbye})
+		return nil
+	}
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream on both sides telling the peer why, e.g. ReasonUnavailable
+func (st *Stream) Reset(r Rejection) {
+	st.m.reset(st, r)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.m.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.m.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.readDeadline.set(t, st.wake)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.writeDeadline.set(t, st.wake)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *Stream) wake() {
+	st.mu.Lock()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// receive buffers the data of the peer, which has to fit the window
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(data)) > st.recvWindow || st.readClosed {
+		return ErrFlowControl
+	}
+
+	st.recvWindow -= uint32(len(data))
+	st.buf = append(st.buf, data...)
+	st.cond.Broadcast()
+	return nil
+}
+
+// grant lets the stream send n more bytes, the window has to stay within 32 bits
+func (st *Stream) grant(n uint32) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if n > math.MaxUint32-st.sendWindow {
+		return ErrFlowControl
+	}
+
+	st.sendWindow += n
+	st.cond.Broadcast()
+	return nil
+}
+
+// closeRead takes the StreamClose of the peer
+func (st *Stream) closeRead() {
+	st.mu.Lock()
+	st.readClosed = true
+	done := st.writeClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if done {
+		st.m.forget(st.id)
+	}
+}
+
+// abort fails the stream in both directions
+func (st *Stream) abort(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
+
+// deadline wakes up the waiters of a stream once it passes
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+func (d *deadline) set(t time.Time, wake func()) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	d.t = t
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), wake)
+	}
+}
+
+func (d *deadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
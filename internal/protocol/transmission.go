@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+var (
+	ErrMalformedTransmission = errors.New("malformed transmission")
+	ErrTransmissionSize      = errors.New("transmission size does not match its start")
+)
+
+// transmitStartSize is the size of the data of a TransmitStart before the ticket and the metadata
+const transmitStartSize = 8
+
+// streamProvider is a transmissionProvider with transmissions too large for a frame,
+// they are streamed with a TransmitStart instead of sent in a Transmit
+type streamProvider interface {
+	ProvideStream() (Transmission, error)
+}
+
+// Transmission is a streamed transmission
+type Transmission struct {
+	// Meta tells what the transmission is, e.g. its content type
+	Meta string
+
+	// Size is the number of bytes of the body
+	Size int64
+
+	Body io.Reader
+}
+
+// NewTransmitStart creates a TransmitStart payload with the size of the transmission,
+// the ticket issued along with it, if any, and its metadata. Send streams the body after it.
+func NewTransmitStart(t Transmission, ticket string) *Payload {
+	data := binary.LittleEndian.AppendUint64(make([]byte, 0, transmitStartSize+len(ticket)+1+len(t.Meta)), uint64(t.Size))
+	data = append(data, ticket+TicketDelimiter+t.Meta...)
+
+	return &Payload{Action: TransmitStart, Data: data, Body: t.Body}
+}
+
+// ParseTransmitStart reads the data of a TransmitStart payload,
+// the transmission comes without a body
+func ParseTransmitStart(data []byte) (t Transmission, ticket string, err error) {
+	if len(data) < transmitStartSize {
+		return t, "", fmt.Errorf("%w: %d bytes of transmit start", ErrMalformedTransmission, len(data))
+	}
+
+	t.Size = int64(binary.LittleEndian.Uint64(data))
+	ticket, meta, ok := strings.Cut(string(data[transmitStartSize:]), TicketDelimiter)
+	if !ok || t.Size < 0 {
+		return Transmission{}, "", ErrMalformedTransmission
+	}
+
+	t.Meta = meta
+	return t, ticket, nil
+}
+
+// CloseBody releases the body of a payload that is not going to be sent
+func (p *Payload) CloseBody() {
+	if c, ok := p.Body.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// sendBody streams the body announced by the TransmitStart p in TransmitChunk frames
+// and a TransmitEnd, a body failing or not matching its size is followed by a Reject instead
+func sendBody(p *Payload, w io.Writer) error {
+	t, _, err := ParseTransmitStart(p.Data)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	buf := make([]byte, MaxDataSize)
+	var sent int64
+	for sent < t.Size {
+		n, err := io.ReadFull(p.Body, buf[:min(int64(len(buf)), t.Size-sent)])
+		if err != nil {
+			reject := NewReject(Rejection{Reason: ReasonUnavailable})
+			reject.ID = p.ID
+			_ = Send(reject, w)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("%w: %d of %d bytes", ErrTransmissionSize, sent+int64(n), t.Size)
+			}
+			return fmt.Errorf("failed to read transmission: %w", err)
+		}
+
+		h.Write(buf[:n])
+		if err := Send(&Payload{Action: TransmitChunk, ID: p.ID, Data: buf[:n]}, w); err != nil {
+			return err
+		}
+		sent += int64(n)
+	}
+
+	return Send(&Payload{Action: TransmitEnd, ID: p.ID, Data: h.Sum(nil)}, w)
+}
+
+// stream answers with a TransmitStart of the transmission of the provider,
+// or with a Reject when the provider has none
+func (pr *Protocol) stream(sp streamProvider, header, clientIP string) *Payload {
+	t, err := sp.ProvideStream()
+	if err != nil {
+		slog.With("error", err.Error()).Error("failed to provide transmission")
+		return NewReject(Rejection{Reason: ReasonUnavailable})
+	}
+
+	var ticket string
+	if pr.tickets != nil && header != "" {
+		if ticket, err = pr.tickets.Issue(header, clientIP); err != nil {
+			slog.With("error", err.Error()).Error("failed to issue a ticket")
+		}
+	}
+
+	return NewTransmitStart(t, ticket)
+}
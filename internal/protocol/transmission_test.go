@@ -0,0 +1,89 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransmitStart(t *testing.T) {
+	p := protocol.NewTransmitStart(protocol.Transmission{Meta: "text/plain\ncharset", Size: 1 << 40}, "ticket")
+	assert.Equal(t, protocol.TransmitStart, p.Action)
+
+	tr, ticket, err := protocol.ParseTransmitStart(p.Data)
+	require.NoError(t, err)
+	assert.Equal(t, "ticket", ticket)
+	assert.Equal(t, "text/plain\ncharset", tr.Meta)
+	assert.Equal(t, int64(1<<40), tr.Size)
+
+	_, _, err = protocol.ParseTransmitStart([]byte{1, 2, 3})
+	assert.ErrorIs(t, err, protocol.ErrMalformedTransmission)
+}
+
+func TestSend_Stream(t *testing.T) {
+	body := make([]byte, 2*protocol.MaxDataSize+10)
+	_, err := rand.Read(body)
+	require.NoError(t, err)
+
+	read := func(t *testing.T, b []byte) []*protocol.Payload {
+		var ps []*protocol.Payload
+		r := bufio.NewReader(bytes.NewReader(b))
+		for {
+			frame, err := protocol.ReadFrame(r)
+			if err == io.EOF {
+				return ps
+			}
+			require.NoError(t, err)
+			p, err := protocol.Decode(frame)
+			require.NoError(t, err)
+			ps = append(ps, p)
+		}
+	}
+
+	t.Run("chunks and checksum", func(t *testing.T) {
+		p := protocol.NewTransmitStart(protocol.Transmission{Meta: "blob", Size: int64(len(body)), Body: bytes.NewReader(body)}, "")
+		p.ID = 3
+
+		var buf bytes.Buffer
+		require.NoError(t, protocol.Send(p, &buf))
+
+		ps := read(t, buf.Bytes())
+		require.Len(t, ps, 5)
+		assert.Equal(t, protocol.TransmitStart, ps[0].Action)
+
+		var got []byte
+		for _, p := range ps[1:4] {
+			assert.Equal(t, protocol.TransmitChunk, p.Action)
+			assert.Equal(t, uint32(3), p.ID)
+			got = append(got, p.Data...)
+		}
+		assert.Equal(t, body, got)
+
+		sum := sha256.Sum256(body)
+		assert.Equal(t, protocol.TransmitEnd, ps[4].Action)
+		assert.Equal(t, sum[:], ps[4].Data)
+	})
+
+	t.Run("body shorter than its size", func(t *testing.T) {
+		p := protocol.NewTransmitStart(protocol.Transmission{Size: int64(len(body)) + 1, Body: bytes.NewReader(body)}, "")
+
+		var buf bytes.Buffer
+		err := protocol.Send(p, &buf)
+		assert.ErrorIs(t, err, protocol.ErrTransmissionSize)
+
+		// the client is told the transmission is unavailable instead of waiting for the end
+		ps := read(t, buf.Bytes())
+		last := ps[len(ps)-1]
+		assert.Equal(t, protocol.Reject, last.Action)
+		r, err := protocol.ParseReject(last.Data)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.ReasonUnavailable, r.Reason)
+	})
+}
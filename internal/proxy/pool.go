@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnknownBalancing = errors.New("unknown balancing")
+	ErrNoBackends       = errors.New("no backend is available")
+)
+
+const (
+	// defaultCheckInterval is how often backends are health checked
+	defaultCheckInterval = 5 * time.Second
+
+	// defaultCheckTimeout bounds connecting to a backend during a health check
+	defaultCheckTimeout = 2 * time.Second
+
+	// ringReplicas is the number of points each backend gets on the hash ring,
+	// more points spread the clients more evenly
+	ringReplicas = 100
+)
+
+// Balancing tells how the proxy picks a backend for a client
+type Balancing string
+
+const (
+	// RoundRobin hands clients to the backends in turn
+	RoundRobin Balancing = "round-robin"
+
+	// LeastConn picks the backend with the fewest spliced connections
+	LeastConn Balancing = "least-conn"
+
+	// ConsistentHash sticks every client address to the same backend,
+	// and moves only the clients of a backend that goes down or comes back
+	ConsistentHash Balancing = "hash"
+)
+
+// ParseBalancing turns the name of a balancing into one of the known balancings
+func ParseBalancing(name string) (Balancing, error) {
+	switch b := Balancing(name); b {
+	case RoundRobin, LeastConn, ConsistentHash:
+		return b, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnknownBalancing, name)
+	}
+}
+
+// backend is a member of the pool
+type backend struct {
+	addr    string
+	healthy atomic.Bool
+	active  atomic.Int64
+}
+
+// ringPoint is a point of a backend on the hash ring
+type ringPoint struct {
+	hash uint32
+	b    *backend
+}
+
+// backendConn is a connection to a backend, it keeps the backend
+// counting it as active until the connection is closed
+type backendConn struct {
+	net.Conn
+	p    *Proxy
+	b    *backend
+	once sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		c.b.active.Add(-1)
+		c.p.metrics.Counter("proxy.backend." + c.b.addr + ".active").Dec()
+	})
+	return c.Conn.Close()
+}
+
+func (c *backendConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// setBackends replaces the pool, all the backends start healthy
+func (p *Proxy) setBackends(addrs []string) {
+	p.backends = make([]*backend, 0, len(addrs))
+	p.ring = make([]ringPoint, 0, len(addrs)*ringReplicas)
+
+	for _, addr := range addrs {
+		b := &backend{addr: addr}
+		b.healthy.Store(true)
+		p.backends = append(p.backends, b)
+
+		for i := 0; i < ringReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{hash: crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i))), b: b})
+		}
+	}
+
+	sort.Slice(p.ring, func(i, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+
+	p.metrics.Counter("proxy.healthy").Set(int64(len(p.backends)))
+}
+
+// candidates lists the healthy backends in the order the client should try them
+func (p *Proxy) candidates(clientIP string) []*backend {
+	switch p.balancing {
+	case ConsistentHash:
+		return p.walkRing(clientIP)
+	case LeastConn:
+		// rotating first spreads the clients between backends that are equally loaded
+		bs := p.rotate()
+		sort.SliceStable(bs, func(i, j int) bool {
+			return bs[i].active.Load() < bs[j].active.Load()
+		})
+		return bs
+	default:
+		return p.rotate()
+	}
+}
+
+// rotate lists the healthy backends starting with the next one in turn
+func (p *Proxy) rotate() []*backend {
+	start := int(p.next.Add(1) - 1)
+
+	bs := make([]*backend, 0, len(p.backends))
+	for i := range p.backends {
+		b := p.backends[(start+i)%len(p.backends)]
+		if b.healthy.Load() {
+			bs = append(bs, b)
+		}
+	}
+
+	return bs
+}
+
+// walkRing lists the healthy backends in the order they follow
+// the address of the client on the hash ring
+func (p *Proxy) walkRing(clientIP string) []*backend {
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+
+	h := crc32.ChecksumIEEE([]byte(clientIP))
+	start := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+
+	seen := make(map[*backend]bool, len(p.backends))
+	bs := make([]*backend, 0, len(p.backends))
+	for i := 0; i < len(p.ring) && len(seen) < len(p.backends); i++ {
+		b := p.ring[(start+i)%len(p.ring)].b
+		if seen[b] {
+			continue
+		}
+
+		seen[b] = true
+		if b.healthy.Load() {
+			bs = append(bs, b)
+		}
+	}
+
+	return bs
+}
+
+// Run health checks the backends every interval until ctx is done,
+// a backend that does not accept connections is taken out of the pool
+// and put back once it does again
+func (p *Proxy) Run(ctx context.Context) {
+	t := time.NewTicker(p.checkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.check(ctx)
+		}
+	}
+}
+
+// check connects to every backend at once and waits for all of them
+func (p *Proxy) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+
+			d := net.Dialer{Timeout: p.checkTimeout}
+			conn, err := d.DialContext(ctx, "tcp", b.addr)
+			if err != nil {
+				if ctx.Err() == nil {
+					p.setHealthy(b, false, err)
+				}
+				return
+			}
+
+			_ = conn.Close()
+			p.setHealthy(b, true, nil)
+		}(b)
+	}
+	wg.Wait()
+}
+
+// setHealthy moves the backend in or out of the pool, err is the reason it is out
+func (p *Proxy) setHealthy(b *backend, healthy bool, err error) {
+	if b.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	if healthy {
+		p.metrics.Counter("proxy.healthy").Inc()
+		slog.With("backend", b.addr).Info("backend is back in the pool")
+		return
+	}
+
+	p.metrics.Counter("proxy.healthy").Dec()
+	slog.With("backend", b.addr).With("error", err.Error()).Warn("backend is out of the pool")
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/metrics"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultDialTimeout bounds connecting to the backend
+	defaultDialTimeout = 5 * time.Second
+
+	// halfCloseTimeout is how long one direction may keep on going
+	// after the other one is done, e.g. when a peer never closes its side
+	halfCloseTimeout = 60 * time.Second
+)
+
+// closeWriter is a connection that can shut down its writing side only,
+// like *net.TCPConn or *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Proxy splices clients that solved their challenge with a pool of backends
+type Proxy struct {
+	backends      []*backend
+	ring          []ringPoint
+	next          atomic.Uint64
+	balancing     Balancing
+	dialTimeout   time.Duration
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+	metrics       *metrics.Registry
+}
+
+// New creates a proxy to the TCP backend at addr
+func New(backend string) *Proxy {
+	p := &Proxy{
+		balancing:     RoundRobin,
+		dialTimeout:   defaultDialTimeout,
+		checkInterval: defaultCheckInterval,
+		checkTimeout:  defaultCheckTimeout,
+		metrics:       metrics.NewRegistry(),
+	}
+	p.setBackends([]string{backend})
+
+	return p
+}
+
+// SetBackends makes the proxy balance clients between several backends
+func (p *Proxy) SetBackends(addrs []string) {
+	p.setBackends(addrs)
+}
+
+// SetBalancing tells how a backend is picked for a client, round-robin by default
+func (p *Proxy) SetBalancing(b Balancing) {
+	p.balancing = b
+}
+
+// SetDialTimeout bounds connecting to the backend
+func (p *Proxy) SetDialTimeout(d time.Duration) {
+	p.dialTimeout = d
+}
+
+// SetHealthCheck tells how often Run checks the backends
+// and how long a backend may take to accept a connection
+func (p *Proxy) SetHealthCheck(interval, timeout time.Duration) {
+	p.checkInterval = interval
+	p.checkTimeout = timeout
+}
+
+// SetMetrics makes the proxy count connections and bytes in the given registry
+func (p *Proxy) SetMetrics(r *metrics.Registry) {
+	p.metrics = r
+	r.Counter("proxy.healthy").Set(int64(len(p.backends)))
+}
+
+// Dial connects the client to a healthy backend picked by the balancing.
+// A backend refusing the connection is taken out of the pool and the next one is tried.
+// When the whole pool is out, every backend is tried anyway, the first one
+// accepting the connection is put back.
+func (p *Proxy) Dial(ctx context.Context, clientIP string) (net.Conn, error) {
+	candidates := p.candidates(clientIP)
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+
+	var errs []error
+	for _, b := range candidates {
+		d := net.Dialer{Timeout: p.dialTimeout}
+		conn, err := d.DialContext(ctx, "tcp", b.addr)
+		if err != nil {
+			p.metrics.Counter("proxy.dial_failed").Inc()
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("proxy.Proxy.Dial failed to connect to %s: %w", b.addr, err)
+			}
+
+			p.setHealthy(b, false, err)
+			errs = append(errs, err)
+			continue
+		}
+
+		p.setHealthy(b, true, nil)
+		b.active.Add(1)
+		p.metrics.Counter("proxy.backend." + b.addr + ".active").Inc()
+		return &backendConn{Conn: conn, p: p, b: b}, nil
+	}
+
+	return nil, fmt.Errorf("proxy.Proxy.Dial failed: %w", errors.Join(append([]error{ErrNoBackends}, errs...)...))
+}
+
+// Splice copies data between the client and the backend in both directions until
+// both of them are done, then closes the backend. Data from the client is read
+// from r, which lets the caller hand over bytes it has already buffered.
+// When one side stops writing, the other one is told so with a half-close.
+func (p *Proxy) Splice(ctx context.Context, client net.Conn, r io.Reader, backend net.Conn) error {
+	defer backend.Close()
+
+	active := p.metrics.Counter("proxy.active")
+	active.Inc()
+	defer active.Dec()
+
+	// unblock both directions when the caller gives up on the connection
+	stop := context.AfterFunc(ctx, func() {
+		_ = client.SetDeadline(time.Now())
+		_ = backend.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	type result struct {
+		n   int64
+		err error
+	}
+
+	up := make(chan result, 1)
+	go func() {
+		n, err := io.Copy(backend, r)
+		p.metrics.Counter("proxy.bytes_up").Add(n)
+		closeWrite(backend)
+		up <- result{n: n, err: err}
+	}()
+
+	down := make(chan result, 1)
+	go func() {
+		n, err := io.Copy(client, backend)
+		p.metrics.Counter("proxy.bytes_down").Add(n)
+		closeWrite(client)
+		down <- result{n: n, err: err}
+	}()
+
+	var sent, received result
+	select {
+	case sent = <-up:
+		_ = backend.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+		received = <-down
+	case received = <-down:
+		_ = client.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+		sent = <-up
+	}
+
+	slog.
+		With("address", client.RemoteAddr().String()).
+		With("backend", backend.RemoteAddr().String()).
+		With("bytes up", sent.n).
+		With("bytes down", received.n).
+		Info("proxied connection finished")
+
+	if err := errors.Join(copyErr(sent.err), copyErr(received.err)); err != nil {
+		return fmt.Errorf("proxy.Proxy.Splice failed: %w", err)
+	}
+
+	return nil
+}
+
+// copyErr drops the errors of a direction that was cut by a deadline,
+// those are the regular way to stop a stalled or abandoned connection
+func copyErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+}
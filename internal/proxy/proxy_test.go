@@ -0,0 +1,203 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen starts a backend accepting connections and keeping them open until the end of the test
+func listen(t *testing.T, addr string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	t.Cleanup(func() {
+		_ = l.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+func newPool(t *testing.T, n int, balancing proxy.Balancing) (*proxy.Proxy, []net.Listener) {
+	t.Helper()
+
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range addrs {
+		listeners[i] = listen(t, "127.0.0.1:0")
+		addrs[i] = listeners[i].Addr().String()
+	}
+
+	p := proxy.New(addrs[0])
+	p.SetBackends(addrs)
+	p.SetBalancing(balancing)
+	return p, listeners
+}
+
+func dial(t *testing.T, p *proxy.Proxy, clientIP string) net.Conn {
+	t.Helper()
+
+	conn, err := p.Dial(context.Background(), clientIP)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestParseBalancing(t *testing.T) {
+	b, err := proxy.ParseBalancing("least-conn")
+	require.NoError(t, err)
+	assert.Equal(t, proxy.LeastConn, b)
+
+	_, err = proxy.ParseBalancing("random")
+	assert.ErrorIs(t, err, proxy.ErrUnknownBalancing)
+}
+
+func TestProxy_RoundRobin(t *testing.T) {
+	p, listeners := newPool(t, 3, proxy.RoundRobin)
+
+	for i := 0; i < 6; i++ {
+		conn := dial(t, p, "192.0.2.1:1000")
+		assert.Equal(t, listeners[i%3].Addr().String(), conn.RemoteAddr().String())
+	}
+}
+
+func TestProxy_LeastConn(t *testing.T) {
+	p, listeners := newPool(t, 3, proxy.LeastConn)
+
+	busy := map[string]net.Conn{}
+	for i := 0; i < 3; i++ {
+		conn := dial(t, p, "192.0.2.1:1000")
+		busy[conn.RemoteAddr().String()] = conn
+	}
+	require.Len(t, busy, 3, "every backend gets one connection first")
+
+	// the backend whose connection is over is the least loaded one
+	idle := listeners[1].Addr().String()
+	require.NoError(t, busy[idle].Close())
+	for i := 0; i < 3; i++ {
+		conn := dial(t, p, "192.0.2.1:1000")
+		assert.Equal(t, idle, conn.RemoteAddr().String())
+		require.NoError(t, conn.Close())
+	}
+}
+
+func TestProxy_ConsistentHash(t *testing.T) {
+	p, listeners := newPool(t, 3, proxy.ConsistentHash)
+
+	clients := []string{"192.0.2.1", "192.0.2.2", "198.51.100.7", "203.0.113.42", "203.0.113.43"}
+	picked := map[string]string{}
+	for _, ip := range clients {
+		picked[ip] = dial(t, p, ip+":1000").RemoteAddr().String()
+
+		// the port of the client does not matter
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, picked[ip], dial(t, p, ip+":2000").RemoteAddr().String())
+		}
+	}
+
+	t.Run("only the clients of a dead backend move", func(t *testing.T) {
+		dead := picked[clients[0]]
+		for _, l := range listeners {
+			if l.Addr().String() == dead {
+				require.NoError(t, l.Close())
+			}
+		}
+
+		for _, ip := range clients {
+			got := dial(t, p, ip+":1000").RemoteAddr().String()
+			if picked[ip] == dead {
+				assert.NotEqual(t, dead, got)
+			} else {
+				assert.Equal(t, picked[ip], got)
+			}
+		}
+	})
+}
+
+func TestProxy_HealthCheck(t *testing.T) {
+	reg := metrics.NewRegistry()
+	p, listeners := newPool(t, 3, proxy.RoundRobin)
+	p.SetMetrics(reg)
+	p.SetHealthCheck(10*time.Millisecond, 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	healthy := reg.Counter("proxy.healthy")
+	assert.Equal(t, int64(3), healthy.Value())
+
+	dead := listeners[0].Addr().String()
+	require.NoError(t, listeners[0].Close())
+	require.Eventually(t, func() bool { return healthy.Value() == 2 }, 3*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 6; i++ {
+		assert.NotEqual(t, dead, dial(t, p, "192.0.2.1:1000").RemoteAddr().String())
+	}
+	assert.Zero(t, reg.Counter("proxy.dial_failed").Value(), "clients are not sent to a dead backend")
+
+	listen(t, dead)
+	require.Eventually(t, func() bool { return healthy.Value() == 3 }, 3*time.Second, 10*time.Millisecond)
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[dial(t, p, "192.0.2.1:1000").RemoteAddr().String()] = true
+	}
+	assert.True(t, seen[dead], "a recovered backend is back in the pool")
+}
+
+func TestProxy_Dial(t *testing.T) {
+	t.Run("whole pool down", func(t *testing.T) {
+		p, listeners := newPool(t, 2, proxy.RoundRobin)
+		for _, l := range listeners {
+			require.NoError(t, l.Close())
+		}
+
+		_, err := p.Dial(context.Background(), "192.0.2.1:1000")
+		assert.ErrorIs(t, err, proxy.ErrNoBackends)
+	})
+
+	t.Run("backend is retried once the whole pool is out", func(t *testing.T) {
+		p, listeners := newPool(t, 1, proxy.RoundRobin)
+		addr := listeners[0].Addr().String()
+		require.NoError(t, listeners[0].Close())
+
+		_, err := p.Dial(context.Background(), "192.0.2.1:1000")
+		require.Error(t, err)
+
+		listen(t, addr)
+		assert.Equal(t, addr, dial(t, p, "192.0.2.1:1000").RemoteAddr().String())
+	})
+}
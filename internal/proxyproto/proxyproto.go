@@ -0,0 +1,213 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoHeader        = errors.New("no PROXY protocol header")
+	ErrMalformedHeader = errors.New("malformed PROXY protocol header")
+)
+
+const (
+	// v1MaxSize is the longest v1 header allowed by the spec, CRLF included
+	v1MaxSize = 107
+
+	// v2MaxAddressSize bounds the address block and the TLVs following it
+	v2MaxAddressSize = 4096
+
+	v2HeaderSize = 16
+
+	// probeSize is how many bytes are enough to tell a header from anything else
+	probeSize = 5
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamilyUnspec = 0x0
+	v2FamilyInet   = 0x1
+	v2FamilyInet6  = 0x2
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Header is what a proxy tells about the connection it forwards
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+
+	// Local is set for health checks and other connections made by the proxy itself,
+	// they carry no addresses and the connection addresses apply
+	Local bool
+}
+
+// LooksLikeHeader reports whether b, the first bytes of a connection,
+// may be the start of a PROXY protocol header of either version
+func LooksLikeHeader(b []byte) bool {
+	for _, prefix := range [][]byte{v1Prefix, v2Signature} {
+		n := min(len(b), len(prefix))
+		if n > 0 && bytes.Equal(b[:n], prefix[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHeader reads a PROXY protocol header of either version from the start of r.
+// It never reads past the end of the header, so r can be handed over as is afterwards.
+func ReadHeader(r io.Reader) (*Header, error) {
+	// both versions are longer than the v2 signature, but a peer sending
+	// something else might never send that much, so look at a few bytes first
+	start := make([]byte, len(v2Signature))
+	if _, err := io.ReadFull(r, start[:probeSize]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoHeader, err)
+	}
+
+	if !LooksLikeHeader(start[:probeSize]) {
+		return nil, ErrNoHeader
+	}
+
+	if _, err := io.ReadFull(r, start[probeSize:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
+	}
+
+	switch {
+	case bytes.Equal(start, v2Signature):
+		return readV2(r)
+	case bytes.HasPrefix(start, v1Prefix):
+		return readV1(r, start)
+	default:
+		return nil, ErrMalformedHeader
+	}
+}
+
+func readV1(r io.Reader, start []byte) (*Header, error) {
+	line := start
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxSize {
+			return nil, fmt.Errorf("%w: v1 header is longer than %d bytes", ErrMalformedHeader, v1MaxSize)
+		}
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
+		}
+		line = append(line, b[0])
+	}
+
+	return parseV1(string(line[:len(line)-2]))
+}
+
+func parseV1(line string) (*Header, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w: %q", ErrMalformedHeader, line)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return &Header{Version: 1, Local: true}, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unsupported protocol %q", ErrMalformedHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: expected 6 fields in %q", ErrMalformedHeader, line)
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil && !strings.Contains(host, ":")) {
+		return nil, fmt.Errorf("%w: invalid %s address %q", ErrMalformedHeader, proto, host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrMalformedHeader, port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r io.Reader) (*Header, error) {
+	rest := make([]byte, v2HeaderSize-len(v2Signature))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
+	}
+
+	verCmd, fam := rest[0], rest[1]
+	size := int(binary.BigEndian.Uint16(rest[2:]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrMalformedHeader, verCmd>>4)
+	}
+
+	if size > v2MaxAddressSize {
+		return nil, fmt.Errorf("%w: address block of %d bytes is too long", ErrMalformedHeader, size)
+	}
+
+	block := make([]byte, size)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
+	}
+
+	switch verCmd & 0xf {
+	case v2CmdLocal:
+		return &Header{Version: 2, Local: true}, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrMalformedHeader, verCmd&0xf)
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case v2FamilyUnspec:
+		return &Header{Version: 2, Local: true}, nil
+	case v2FamilyInet:
+		ipLen = net.IPv4len
+	case v2FamilyInet6:
+		ipLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("%w: unsupported address family %d", ErrMalformedHeader, fam>>4)
+	}
+
+	if len(block) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%w: address block of %d bytes is too short", ErrMalformedHeader, len(block))
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), block[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(block[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), block[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(block[2*ipLen+2:])),
+	}
+
+	return &Header{Version: 2, Source: src, Destination: dst}, nil
+}
@@ -0,0 +1,172 @@
+package proxyproto_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/denismitr/antiddos/internal/proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(cmd, fam byte, block []byte) []byte {
+	b := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	b = append(b, 0x20|cmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(block)))
+	return append(b, block...)
+}
+
+func inet4Block(src, dst string, sport, dport uint16) []byte {
+	b := append([]byte(nil), net.ParseIP(src).To4()...)
+	b = append(b, net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	return binary.BigEndian.AppendUint16(b, dport)
+}
+
+func TestReadHeader(t *testing.T) {
+	inet6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	inet6 = binary.BigEndian.AppendUint16(inet6, 40000)
+	inet6 = binary.BigEndian.AppendUint16(inet6, 443)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		source  string
+		local   bool
+		version int
+		err     error
+	}{
+		{
+			name:    "v1 tcp4",
+			input:   []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 3333\r\n"),
+			source:  "192.0.2.10:56324",
+			version: 1,
+		},
+		{
+			name:    "v1 tcp6",
+			input:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n"),
+			source:  "[2001:db8::1]:40000",
+			version: 1,
+		},
+		{
+			name:    "v1 unknown",
+			input:   []byte("PROXY UNKNOWN\r\n"),
+			local:   true,
+			version: 1,
+		},
+		{
+			name:    "v2 inet",
+			input:   v2Header(0x1, 0x11, inet4Block("192.0.2.10", "198.51.100.1", 56324, 3333)),
+			source:  "192.0.2.10:56324",
+			version: 2,
+		},
+		{
+			name:    "v2 inet6",
+			input:   v2Header(0x1, 0x21, inet6),
+			source:  "[2001:db8::1]:40000",
+			version: 2,
+		},
+		{
+			name:    "v2 inet with TLVs",
+			input:   v2Header(0x1, 0x11, append(inet4Block("192.0.2.10", "198.51.100.1", 1, 2), 0x04, 0x00, 0x01, 0xff)),
+			source:  "192.0.2.10:1",
+			version: 2,
+		},
+		{
+			name:    "v2 local",
+			input:   v2Header(0x0, 0x00, nil),
+			local:   true,
+			version: 2,
+		},
+		{
+			name:  "native frame",
+			input: []byte{0, 0, 0, 0, '#', 0, 0, 0, 0, '#', 0, 0},
+			err:   proxyproto.ErrNoHeader,
+		},
+		{
+			name:  "too short",
+			input: []byte("PROXY"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "garbage looking like a header",
+			input: []byte("PROXYING SOMETHING"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v1 without crlf",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 3333"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v1 too long",
+			input: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v1 ipv6 address for tcp4",
+			input: []byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 3333\r\n"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v1 invalid port",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 70000 3333\r\n"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v1 missing fields",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1\r\n"),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v2 wrong version",
+			input: append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x11, 0x11, 0, 0),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v2 truncated address block",
+			input: v2Header(0x1, 0x11, []byte{192, 0, 2, 10}),
+			err:   proxyproto.ErrMalformedHeader,
+		},
+		{
+			name:  "v2 block shorter than announced",
+			input: v2Header(0x1, 0x11, inet4Block("192.0.2.10", "198.51.100.1", 1, 2))[:20],
+			err:   proxyproto.ErrMalformedHeader,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trailer := []byte("payload")
+			r := bytes.NewReader(append(append([]byte(nil), tc.input...), trailer...))
+
+			h, err := proxyproto.ReadHeader(r)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.version, h.Version)
+			assert.Equal(t, tc.local, h.Local)
+			if !tc.local {
+				assert.Equal(t, tc.source, h.Source.String())
+			}
+
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, trailer, rest, "header reader must not consume the data after the header")
+		})
+	}
+}
+
+func TestLooksLikeHeader(t *testing.T) {
+	assert.True(t, proxyproto.LooksLikeHeader([]byte("PROX")))
+	assert.True(t, proxyproto.LooksLikeHeader([]byte("\r\n\r\n")))
+	assert.False(t, proxyproto.LooksLikeHeader([]byte{0, 0, 0, 0}))
+	assert.False(t, proxyproto.LooksLikeHeader([]byte("PRXY")))
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+)
+
+const (
+	// epollEvents is how many ready connections a single epoll_wait hands over at most
+	epollEvents = 128
+
+	// epollWaitMs bounds epoll_wait, so that the loop notices when it is stopped
+	epollWaitMs = 500
+
+	// readBufferSize is the size of the buffers borrowed by the workers for a single read
+	readBufferSize = 4096
+
+	// maxPendingSize bounds the incomplete frame kept between reads
+	maxPendingSize = protocol.MaxFrameSize
+
+	// armEvents are the events a connection waits for, EPOLLONESHOT makes sure
+	// that only one worker at a time processes a connection until it is rearmed
+	armEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+)
+
+// epollConn is a connection registered in the poller. Unlike the goroutine
+// engine it has no goroutine and no read buffer of its own, only the bytes
+// of an incomplete frame are kept between reads.
+type epollConn struct {
+	*trackedConn
+	rc      syscall.RawConn
+	fd      int
+	pending []byte
+	started bool
+
+	// busy guards against a stale event of a reused descriptor
+	// handing the connection to a second worker
+	busy atomic.Bool
+}
+
+// poller is the epoll based network engine. A single goroutine waits for
+// connections to have data and hands them over to a small pool of workers,
+// which read what is available with a pooled buffer and process whole frames.
+type poller struct {
+	ctx   context.Context
+	s     *Server
+	epfd  int
+	ready chan *epollConn
+	done  chan struct{}
+	wg    sync.WaitGroup
+	bufs  sync.Pool
+
+	mu    sync.Mutex
+	conns map[int]*epollConn
+}
+
+func newPoller(ctx context.Context, s *Server, workers int) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1 failed: %w", err)
+	}
+
+	p := &poller{
+		ctx:   ctx,
+		s:     s,
+		epfd:  epfd,
+		ready: make(chan *epollConn, epollEvents),
+		done:  make(chan struct{}),
+		conns: make(map[int]*epollConn),
+		bufs: sync.Pool{
+			New: func() any {
+				b := make([]byte, readBufferSize)
+				return &b
+			},
+		},
+	}
+
+	p.wg.Add(workers + 1)
+	go p.wait()
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	slog.With("workers", workers).Info("epoll engine started")
+
+	return p, nil
+}
+
+// add registers a freshly accepted connection
+func (p *poller) add(_ context.Context, conn *trackedConn) {
+	sc, ok := conn.Conn.(syscall.Conn)
+	if !ok {
+		slog.With("address", conn.id).Error("connection does not expose a file descriptor")
+		_ = conn.Close()
+		return
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		slog.With("error", err.Error()).Error("server.poller.add failed to get raw connection")
+		_ = conn.Close()
+		return
+	}
+
+	ec := &epollConn{trackedConn: conn, rc: rc}
+	if err := rc.Control(func(fd uintptr) {
+		ec.fd = int(fd)
+	}); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	conn.mu.Lock()
+	conn.onClose = func() {
+		p.remove(ec)
+	}
+	conn.mu.Unlock()
+	conn.setIdle(true)
+
+	p.mu.Lock()
+	p.conns[ec.fd] = ec
+	p.mu.Unlock()
+
+	if err := p.ctl(ec, syscall.EPOLL_CTL_ADD); err != nil {
+		slog.With("error", err.Error()).Error("server.poller.add failed to register connection")
+		_ = conn.Close()
+	}
+}
+
+func (p *poller) ctl(ec *epollConn, op int) error {
+	var opErr error
+	err := ec.rc.Control(func(fd uintptr) {
+		opErr = syscall.EpollCtl(p.epfd, op, int(fd), &syscall.EpollEvent{
+			Events: armEvents,
+			Fd:     int32(fd),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+func (p *poller) remove(ec *epollConn) {
+	p.mu.Lock()
+	if p.conns[ec.fd] == ec {
+		delete(p.conns, ec.fd)
+	}
+	p.mu.Unlock()
+
+	_ = ec.rc.Control(func(fd uintptr) {
+		_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+}
+
+func (p *poller) wait() {
+	defer p.wg.Done()
+	defer close(p.ready)
+
+	events := make([]syscall.EpollEvent, epollEvents)
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		n, err := syscall.EpollWait(p.epfd, events, epollWaitMs)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			slog.With("error", err.Error()).Error("server.poller.wait epoll_wait failed")
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			p.mu.Lock()
+			ec, ok := p.conns[int(events[i].Fd)]
+			p.mu.Unlock()
+			if !ok || !ec.busy.CompareAndSwap(false, true) {
+				continue
+			}
+
+			ec.setIdle(false)
+			select {
+			case p.ready <- ec:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *poller) work() {
+	defer p.wg.Done()
+
+	for ec := range p.ready {
+		if !p.process(ec) {
+			_ = ec.Close()
+			continue
+		}
+
+		ec.setIdle(true)
+		ec.busy.Store(false)
+		if p.s.shuttingDown.Load() {
+			_ = ec.Close()
+			continue
+		}
+
+		if err := p.ctl(ec, syscall.EPOLL_CTL_MOD); err != nil {
+			_ = ec.Close()
+		}
+	}
+}
+
+// process reads the data available on the connection and handles the whole
+// frames in it, it reports whether the connection should be kept open
+func (p *poller) process(ec *epollConn) bool {
+	if p.ctx.Err() != nil {
+		return false
+	}
+
+	bp := p.bufs.Get().(*[]byte)
+	defer p.bufs.Put(bp)
+	buf := *bp
+
+	var n int
+	var readErr error
+	if err := ec.rc.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), buf)
+		// never park in the runtime poller, epoll tells when to read again
+		return true
+	}); err != nil {
+		return false
+	}
+
+	if readErr != nil {
+		if errors.Is(readErr, syscall.EAGAIN) || errors.Is(readErr, syscall.EINTR) {
+			return true
+		}
+		slog.With("error", readErr.Error()).Error("server.poller.process failed to read payload")
+		return false
+	}
+
+	if n == 0 {
+		slog.Info("connection ended")
+		return false
+	}
+
+	data := buf[:n]
+	if ec.pending != nil {
+		data = append(ec.pending, data...)
+	}
+
+	if !ec.started && len(data) >= protocol.HeaderSize {
+		ec.started = true
+		if p.s.rejectProxyHeader(ec.trackedConn, data[:protocol.HeaderSize]) {
+			return false
+		}
+	}
+
+	for {
+		frame, rest, err := protocol.SplitFrame(data)
+		if err != nil {
+			slog.With("error", err.Error()).Error("server.poller.process failed to read payload")
+			return false
+		}
+
+		if frame == nil {
+			if len(rest) > maxPendingSize {
+				return false
+			}
+			ec.pending = nil
+			if len(rest) > 0 {
+				// the buffer goes back to the pool, keep only the incomplete frame
+				ec.pending = append([]byte(nil), rest...)
+			}
+			return true
+		}
+
+		if _, err := p.s.handle(p.ctx, ec.trackedConn, frame); err != nil {
+			return false
+		}
+		data = rest
+	}
+}
+
+// close stops the workers and closes all the connections
+func (p *poller) close() {
+	close(p.done)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	conns := make([]*epollConn, 0, len(p.conns))
+	for _, ec := range p.conns {
+		conns = append(conns, ec)
+	}
+	p.mu.Unlock()
+
+	for _, ec := range conns {
+		_ = ec.Close()
+	}
+
+	_ = syscall.Close(p.epfd)
+}
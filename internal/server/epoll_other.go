@@ -0,0 +1,22 @@
+//go:build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrEpollUnsupported = errors.New("epoll engine is only supported on linux")
+)
+
+type poller struct{}
+
+func newPoller(_ context.Context, _ *Server, _ int) (*poller, error) {
+	return nil, ErrEpollUnsupported
+}
+
+func (p *poller) add(_ context.Context, _ *trackedConn) {}
+
+func (p *poller) close() {}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	ErrEpollHeartbeat = errors.New("epoll engine can not ping connections")
+
+	// errPeerTimeout closes connections of peers that did not answer a Ping
+	errPeerTimeout = errors.New("peer did not answer a ping")
+
+	// errPeerClosed closes connections the peer said goodbye to
+	errPeerClosed = errors.New("peer closed the connection")
+)
+
+const (
+	// goodbyeTimeout bounds sending a Close to a peer that is not reading
+	goodbyeTimeout = time.Second
+
+	// defaultChallengeTTL is how long a challenge can be solved unless SetChallengeTTL says otherwise
+	defaultChallengeTTL = 30 * time.Second
+)
+
+// SetHeartbeat makes the server send a Ping to connections idle for interval,
+// a peer not answering within timeout gets a Close and its connection is closed.
+// Connections holding an outstanding challenge are not pinged until it expires,
+// since the client does not read while it solves, see SetChallengeTTL.
+func (s *Server) SetHeartbeat(interval, timeout time.Duration) {
+	s.pingInterval = interval
+	s.pingTimeout = timeout
+}
+
+// SetChallengeTTL tells how long a challenge can be solved once issued, i.e. the max duration
+// of the challenges, 30 seconds by default. A challenge outstanding for longer is forgotten
+// and its connection is pinged again.
+func (s *Server) SetChallengeTTL(ttl time.Duration) {
+	s.challengeTTL = ttl
+}
+
+// awaitFrame waits for the next frame of the peer, pinging it while it is idle.
+// Nothing is consumed from r, so a frame is never cut by the deadlines.
+func (s *Server) awaitFrame(conn *trackedConn, r *bufio.Reader) error {
+	defer conn.SetReadDeadline(time.Time{})
+
+	wait, pinged := s.pingInterval, false
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return err
+		}
+
+		_, err := r.Peek(1)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+
+		if until := conn.solvingUntil(); time.Now().Before(until) {
+			wait, pinged = min(s.pingInterval, time.Until(until)), false
+			continue
+		}
+
+		if pinged {
+			conn.goodbye(protocol.Rejection{Reason: protocol.ReasonIdleTimeout})
+			return errPeerTimeout
+		}
+
+		if err := conn.send(&protocol.Payload{Action: protocol.Ping}); err != nil {
+			return err
+		}
+		wait, pinged = s.pingTimeout, true
+	}
+}
+
+// refuse tells a peer above the connection limit to come back later,
+// when the connection is known to speak the protocol in plain text
+func (s *Server) refuse(conn net.Conn) {
+	if s.tls != nil || s.httpHandler != nil || s.proxies.ContainsAddr(conn.RemoteAddr()) {
+		return
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	if err := protocol.Send(protocol.NewClose(protocol.Rejection{Reason: protocol.ReasonOverloaded, RetryAfter: overloadRetryAfter}), conn); err != nil {
+		slog.With("error", err.Error()).Debug("server failed to refuse connection")
+	}
+}
+
+// solvingUntil tells until when the peer may be solving an outstanding challenge, for connections
+// without a state machine that is the expiry of the last response when it was a Challenge
+func (c *trackedConn) solvingUntil() time.Time {
+	if c.machine != nil {
+		return c.machine.Expires()
+	}
+
+	at := c.challenged.Load()
+	if at == 0 {
+		return time.Time{}
+	}
+
+	ttl := c.s.challengeTTL
+	if ttl == 0 {
+		ttl = defaultChallengeTTL
+	}
+	return time.Unix(0, at).Add(ttl)
+}
+
+// send writes a frame to the peer
+func (c *trackedConn) send(p *protocol.Payload) error {
+	return protocol.Send(p, frameWriter{c})
+}
+
+// goodbye tells the peer why its connection is about to be closed,
+// once the peer is known to speak the protocol
+func (c *trackedConn) goodbye(r protocol.Rejection) {
+	if !c.native.Load() {
+		return
+	}
+
+	c.mu.Lock()
+	conn := c.Conn
+	c.mu.Unlock()
+
+	// the deadline also ends a frame write stuck on a peer that is not reading
+	_ = conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	_ = protocol.Send(protocol.NewClose(r), frameWriter{c})
+}
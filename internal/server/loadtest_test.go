@@ -0,0 +1,113 @@
+//go:build linux && loadtest
+
+package server_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// envLoadConns overrides the number of idle connections opened by the load test
+const envLoadConns = "ANTIDDOS_LOAD_CONNS"
+
+// TestLoad_IdleConnections compares the memory held by both engines while
+// many clients sit idle on their connections. Run it with
+//
+//	go test -tags loadtest -run TestLoad -v ./internal/server/
+//
+// The client side of the connections lives in the same process and costs
+// the same for both engines, the difference between the two is what matters.
+func TestLoad_IdleConnections(t *testing.T) {
+	conns := 100_000
+	if v := os.Getenv(envLoadConns); v != "" {
+		n, err := strconv.Atoi(v)
+		require.NoError(t, err)
+		conns = n
+	}
+
+	// every connection takes a descriptor on both ends
+	var lim syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim))
+	lim.Cur = lim.Max
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim))
+	if limit := int(lim.Cur/2) - 100; conns > limit {
+		t.Logf("descriptor limit %d only allows %d connections", lim.Cur, limit)
+		conns = limit
+	}
+
+	engines := []struct {
+		name  string
+		setup func(s *server.Server)
+	}{
+		{name: "goroutines", setup: func(s *server.Server) {}},
+		{name: "epoll", setup: func(s *server.Server) { s.SetEpoll(runtime.GOMAXPROCS(0)) }},
+	}
+
+	for _, e := range engines {
+		t.Run(e.name, func(t *testing.T) {
+			reg := metrics.NewRegistry()
+			s := server.New("127.0.0.1:0", echoHandler{})
+			s.SetMetrics(reg)
+			e.setup(s)
+			addr := runServer(t, s)
+
+			before := heapAndStacks()
+
+			clients := make([]net.Conn, 0, conns)
+			defer func() {
+				for _, c := range clients {
+					_ = c.Close()
+				}
+
+				// let the next engine start from a clean state
+				require.Eventually(t, func() bool {
+					return reg.Counter("server.active").Value() == 0
+				}, time.Minute, 100*time.Millisecond)
+			}()
+
+			for i := 0; i < conns; i++ {
+				// spread the clients over several source addresses,
+				// a single one runs out of ephemeral ports
+				d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 1, byte(1+i%200))}}
+				c, err := d.Dial("tcp", addr)
+				require.NoError(t, err)
+				clients = append(clients, c)
+			}
+
+			require.Eventually(t, func() bool {
+				return reg.Counter("server.active").Value() == int64(conns)
+			}, time.Minute, 100*time.Millisecond)
+
+			used := int64(heapAndStacks()) - int64(before)
+			t.Logf(
+				"%d idle connections hold %s, %d bytes per connection, %d goroutines",
+				conns, megabytes(used), used/int64(conns), runtime.NumGoroutine(),
+			)
+
+			// make sure the connections are still served after the measurement
+			p := exchange(t, addr)
+			require.NotNil(t, p)
+		})
+	}
+}
+
+func heapAndStacks() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse + m.StackInuse
+}
+
+func megabytes(b int64) string {
+	return fmt.Sprintf("%.1f MB", float64(b)/(1<<20))
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// SetMultiplexing makes proxied connections carry streams instead of the raw bytes
+// of a single backend connection, see protocol.Mux: once the client solved the challenge,
+// every stream it opens is spliced with a backend connection of its own, so that one
+// solved connection serves many backend requests. Connections routed by server name
+// are spliced as a whole as before, their TLS goes to the backend in one piece.
+func (s *Server) SetMultiplexing(on bool) {
+	s.multiplexing = on
+}
+
+// SetMaxStreams limits the streams a multiplexed connection has open at once. Every stream
+// holds a backend connection and a window of buffered bytes for the same single challenge,
+// so the streams above it are reset as overloaded.
+func (s *Server) SetMaxStreams(n int) {
+	s.maxStreams = n
+}
+
+// serveStreams splices every stream the client opens with a backend until the client
+// is done, the backend dialed for the solution serves the first stream
+func (s *Server) serveStreams(ctx context.Context, conn *trackedConn, r *bufio.Reader, backend net.Conn) {
+	m := protocol.NewMux(conn, r, false)
+	defer m.Close()
+	if s.maxStreams > 0 {
+		m.SetMaxStreams(s.maxStreams)
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	up := conn.upstream()
+	for {
+		st, err := m.Accept(ctx)
+		if err != nil {
+			if backend != nil {
+				_ = backend.Close()
+			}
+			if !errors.Is(err, protocol.ErrMuxClosed) {
+				slog.With("error", err.Error()).With("address", conn.id).Error("server stopped accepting streams")
+			}
+			return
+		}
+
+		b := backend
+		backend = nil
+		if b == nil {
+			if b, err = up.Dial(ctx, conn.id); err != nil {
+				slog.With("error", err.Error()).With("address", conn.id).Error("server failed to reach backend")
+				st.Reset(protocol.Rejection{Reason: protocol.ReasonUnavailable, RetryAfter: backendRetryAfter})
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer st.Close()
+
+			if err := up.Splice(ctx, st, st, b); err != nil {
+				slog.With("error", err.Error()).With("address", conn.id).With("stream", st.ID()).Error("server failed to proxy stream")
+			}
+		}()
+	}
+}
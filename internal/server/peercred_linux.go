@@ -0,0 +1,28 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials identifies the process on the other side of a unix socket by SO_PEERCRED
+func peerCredentials(conn *net.UnixConn) (string, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return "", err
+	}
+	if credErr != nil {
+		return "", credErr
+	}
+
+	return fmt.Sprintf("%suid=%d,gid=%d,pid=%d", unixPrefix, cred.Uid, cred.Gid, cred.Pid), nil
+}
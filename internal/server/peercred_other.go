@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(_ *net.UnixConn) (string, error) {
+	return "", errors.New("SO_PEERCRED is only supported on linux")
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"sync"
+)
+
+// SetPipeline lets clients pipeline tagged requests, see protocol.Payload.ID: up to n of them
+// are handled at once on a connection, and each response goes out as soon as it is ready,
+// tagged with the ID of its request. Untagged requests wait for the tagged ones and are
+// handled one at a time as before, so are all the requests of proxied connections.
+func (s *Server) SetPipeline(n int) {
+	s.pipeline = n
+}
+
+// pipeline handles the tagged requests of a connection concurrently
+type pipeline struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newPipeline(n int) *pipeline {
+	return &pipeline{slots: make(chan struct{}, n)}
+}
+
+// busy tells whether requests are being handled
+func (p *pipeline) busy() bool {
+	return p != nil && len(p.slots) > 0
+}
+
+// wait blocks until the requests being handled are answered
+func (p *pipeline) wait() {
+	if p != nil {
+		p.wg.Wait()
+	}
+}
+
+// pipelined tells whether the frame is handled in the pipeline of the connection,
+// requests changing the connection, like a Resume, are handled on their own
+func (s *Server) pipelined(conn *trackedConn, frame []byte) bool {
+	if conn.pipeline == nil || s.upstream != nil || len(s.routes) > 0 || !protocol.IsTagged(frame) {
+		return false
+	}
+
+	p, err := protocol.Decode(frame)
+	if err != nil {
+		return false
+	}
+
+	switch p.Action {
+	case protocol.Request, protocol.Solve, protocol.Redeem, protocol.Ping:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue handles the frame once a slot of the pipeline is free,
+// the connection is closed when the frame cannot be handled
+func (s *Server) enqueue(ctx context.Context, conn *trackedConn, frame []byte) {
+	p := conn.pipeline
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-p.slots
+			p.wg.Done()
+		}()
+
+		if _, err := s.handle(ctx, conn, frame); err != nil {
+			_ = conn.Close()
+		}
+	}()
+}
+
+// respond sends the response to a request, a streamed transmission goes out
+// whole even while the responses of pipelined requests are sent concurrently.
+// Only a Ping or a Close may come between its chunks.
+func (c *trackedConn) respond(p *protocol.Payload) error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	return protocol.Send(p, frameWriter{c})
+}
+
+// frameWriter writes to the peer under wmu, protocol.Send writes a frame at once,
+// so the frames of concurrent writers never mix. A chunk of a streamed transmission
+// is read before its frame is written, so the lock is not held meanwhile.
+type frameWriter struct {
+	c *trackedConn
+}
+
+func (w frameWriter) Write(b []byte) (int, error) {
+	w.c.mu.Lock()
+	conn := w.c.Conn
+	w.c.mu.Unlock()
+
+	w.c.wmu.Lock()
+	defer w.c.wmu.Unlock()
+
+	return conn.Write(b)
+}
+
+// tag makes the response carry the ID of the request
+func tag(resp, req *protocol.Payload) *protocol.Payload {
+	resp.ID = req.ID
+	return resp
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// reusePortConfig sets SO_REUSEPORT on the sockets it opens,
+// its value differs between architectures, see soReusePort
+var reusePortConfig = net.ListenConfig{
+	Control: func(_, _ string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}); err != nil {
+			return err
+		}
+		return opErr
+	},
+}
+
+// listenReusePort opens n listeners sharing the same address,
+// the first one resolves the port when addr asks for any port
+func listenReusePort(ctx context.Context, addr string, n int) ([]net.Listener, error) {
+	lc := reusePortConfig
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(ctx, "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("failed to open listener %d with SO_REUSEPORT: %w", i, err)
+		}
+
+		listeners = append(listeners, l)
+		addr = l.Addr().String()
+	}
+
+	return listeners, nil
+}
+
+// listenPacket opens a UDP socket with SO_REUSEPORT, so that an upgraded
+// process can bind the same address while the current one is still serving
+func listenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	return reusePortConfig.ListenPacket(ctx, "udp", addr)
+}
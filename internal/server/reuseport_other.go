@@ -0,0 +1,22 @@
+//go:build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var (
+	ErrReusePortUnsupported = errors.New("SO_REUSEPORT is only supported on linux")
+)
+
+func listenReusePort(_ context.Context, _ string, _ int) ([]net.Listener, error) {
+	return nil, ErrReusePortUnsupported
+}
+
+func listenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp", addr)
+}
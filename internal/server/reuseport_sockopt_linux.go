@@ -0,0 +1,6 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package server
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define for linux
+const soReusePort = 0xf
@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package server
+
+// soReusePort is SO_REUSEPORT, which is 0x200 on mips as on sparc and parisc
+const soReusePort = 0x200
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/sni"
+	"strings"
+	"time"
+)
+
+var (
+	ErrServerNameMismatch = errors.New("server name of the ClientHello does not match the one of the Request")
+)
+
+// sniTimeout bounds waiting for the ClientHello of a routed client once it solved the challenge
+const sniTimeout = 10 * time.Second
+
+// route is where the clients naming a server in their Request go
+type route struct {
+	rh       requestHandler
+	upstream upstream
+}
+
+// AddRoute sends the clients naming serverName in the data of their Request to
+// a handler of their own, e.g. with its own difficulty, and to an upstream of their own.
+// Once the challenge is solved, the TLS ClientHello of the client has to ask for
+// the same name, and the TLS stream is spliced with the upstream without terminating it.
+// A name like *.example.com matches the subdomains of example.com.
+// Clients naming no server or an unknown one are served as usual.
+// Like with SetUpstream, h has to verify the solutions strictly.
+func (s *Server) AddRoute(serverName string, h requestHandler, u upstream) {
+	if s.routes == nil {
+		s.routes = make(map[string]*route)
+	}
+
+	s.routes[strings.ToLower(serverName)] = &route{rh: h, upstream: u}
+}
+
+func (s *Server) lookupRoute(serverName string) *route {
+	serverName = strings.ToLower(serverName)
+	if rt, ok := s.routes[serverName]; ok {
+		return rt
+	}
+
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		return s.routes["*."+parent]
+	}
+
+	return nil
+}
+
+// routeConnection picks the route of the connection by the server name of a Request,
+// every Request picks it anew
+func (s *Server) routeConnection(conn *trackedConn, frame []byte) {
+	p, err := protocol.Decode(frame)
+	if err != nil || p.Action != protocol.Request {
+		return
+	}
+
+	conn.serverName = string(p.Data)
+	conn.route = nil
+	if conn.serverName != "" {
+		conn.route = s.lookupRoute(conn.serverName)
+	}
+}
+
+// checkServerName peeks the ClientHello of a routed connection
+// and makes sure it asks for the server named in the Request
+func (s *Server) checkServerName(conn *trackedConn, r *bufio.Reader) error {
+	if conn.route == nil {
+		return nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(sniTimeout)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	name, err := sni.ServerName(r)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(name, conn.serverName) {
+		return fmt.Errorf("%w: %s instead of %s", ErrServerNameMismatch, name, conn.serverName)
+	}
+
+	return nil
+}
@@ -3,11 +3,48 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/denismitr/antiddos/internal/metrics"
 	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/proxyproto"
+	"github.com/denismitr/antiddos/internal/sni"
+	"github.com/denismitr/antiddos/internal/trust"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+	ErrEpollTLS     = errors.New("epoll engine can not serve TLS connections")
+	ErrEpollProxy   = errors.New("epoll engine can not proxy connections")
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown looks for idle connections to close
+	shutdownPollInterval = 50 * time.Millisecond
+
+	// proxyHeaderTimeout bounds reading the PROXY protocol header from a trusted proxy
+	proxyHeaderTimeout = 5 * time.Second
+
+	// tlsHandshakeTimeout bounds the TLS handshake of a new connection
+	tlsHandshakeTimeout = 10 * time.Second
+
+	// overloadRetryAfter is when a client refused for the connection limit is told to retry
+	overloadRetryAfter = 5 * time.Second
+
+	// backendRetryAfter is when a client rejected for an unreachable backend is told to retry
+	backendRetryAfter = 5 * time.Second
+
+	// httpReadHeaderTimeout bounds reading request headers of sniffed HTTP connections
+	httpReadHeaderTimeout = 5 * time.Second
 )
 
 type requestHandler interface {
@@ -18,53 +55,387 @@ type requestHandler interface {
 	) (*protocol.Payload, error)
 }
 
+type upstream interface {
+	Dial(ctx context.Context, clientIP string) (net.Conn, error)
+	Splice(ctx context.Context, client net.Conn, r io.Reader, backend net.Conn) error
+}
+
 type Server struct {
-	addr string
-	rh   requestHandler
+	addrs     []string
+	rh        requestHandler
+	listeners []net.Listener
+	ready     chan struct{}
+	reusePort int
+	maxConns  int64
+	metrics   *metrics.Registry
+	workers   int
+	proxies   trust.Networks
+	tls       *tls.Config
+	upstream  upstream
+	routes    map[string]*route
+	sessions  *sessions
+
+	// maxSessions bounds the sessions kept at once, see SetMaxSessions
+	maxSessions int
+
+	// maxChallenges turns on the state machine of the connections, see SetMaxChallenges
+	maxChallenges int
+
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	// challengeTTL bounds how long a connection holding a challenge is not pinged, see SetChallengeTTL
+	challengeTTL time.Duration
+
+	// pipeline is the number of tagged requests handled at once on a connection, see SetPipeline
+	pipeline int
+
+	// multiplexing proxies the streams of a connection instead of its bytes, see SetMultiplexing
+	multiplexing bool
+
+	// maxStreams bounds the streams of a multiplexed connection, see SetMaxStreams
+	maxStreams int
+
+	httpHandler http.Handler
+	httpServer  *http.Server
+	httpConns   *connQueue
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+	wg    sync.WaitGroup
+
+	shuttingDown atomic.Bool
 }
 
 func New(addr string, h requestHandler) *Server {
 	return &Server{
-		addr: addr,
-		rh:   h,
+		addrs:   []string{addr},
+		rh:      h,
+		ready:   make(chan struct{}),
+		conns:   make(map[*trackedConn]struct{}),
+		metrics: metrics.NewRegistry(),
 	}
 }
 
-func (s *Server) Run(ctx context.Context) error {
-	l, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return fmt.Errorf("server failed to start listening on %s: %w", s.addr, err)
-	}
-	defer l.Close()
+// SetAddrs makes the server listen on several addresses at once,
+// host:port entries are served over TCP and unix:/path.sock entries over a unix socket
+func (s *Server) SetAddrs(addrs []string) {
+	s.addrs = addrs
+}
 
-	slog.With("tcp", s.addr).Info("listening on address")
+// SetReusePort makes the server open n listeners on each TCP address with SO_REUSEPORT,
+// each one with its own accept loop, so that the kernel balances new connections
+// between them. The handler, the limits and the metrics are shared.
+func (s *Server) SetReusePort(n int) {
+	s.reusePort = n
+}
 
-	errCh := make(chan error, 1)
-	go func() {
-		for {
-			conn, err := l.Accept()
+// SetMaxConns limits the number of connections served at once,
+// connections above the limit are closed right after they are accepted
+func (s *Server) SetMaxConns(n int64) {
+	s.maxConns = n
+}
+
+// SetMetrics makes the server count connections in the given registry
+func (s *Server) SetMetrics(r *metrics.Registry) {
+	s.metrics = r
+}
+
+// SetEpoll switches the server from a goroutine per connection to an epoll
+// based event loop served by the given number of workers. Connections waiting
+// for data hold neither a goroutine nor a read buffer. Linux only.
+func (s *Server) SetEpoll(workers int) {
+	s.workers = workers
+}
+
+// SetTrustedProxies makes the server expect a PROXY protocol header (v1 or v2)
+// at the start of every connection coming from the given networks. The source
+// address from the header then identifies the client instead of the address
+// of the proxy. Connections from these networks without a valid header are closed.
+func (s *Server) SetTrustedProxies(networks trust.Networks) {
+	s.proxies = networks
+}
+
+// SetTLSConfig makes the server accept TLS connections only,
+// mutual authentication is turned on by the client auth settings of cfg
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.tls = cfg
+}
+
+// SetHTTPHandler serves HTTP on the same addresses as the native protocol.
+// The first bytes of every connection then tell a TLS ClientHello, an HTTP
+// request, a PROXY header and the native protocol apart, and TLS becomes
+// optional when the server is configured for it.
+func (s *Server) SetHTTPHandler(h http.Handler) {
+	s.httpHandler = h
+}
+
+// SetUpstream turns the server into a proxy: a client that solved its challenge
+// gets an empty Transmit and its connection is spliced with a backend from then on,
+// or it gets a Reject when the backend is unreachable. The handler has to verify
+// the solutions strictly, see protocol.Protocol.SetStrict, or any client gets through.
+func (s *Server) SetUpstream(u upstream) {
+	s.upstream = u
+}
+
+// SetMaxChallenges keeps the state of the exchange on every connection: a client solves
+// only the challenges it asked for on the connection, holds up to n of them at once,
+// and never sends the actions of the server. Illegal requests are answered with a Reject
+// instead of closing the connection.
+func (s *Server) SetMaxChallenges(n int) {
+	s.maxChallenges = n
+}
+
+// SetListeners makes the server accept connections on already opened listeners,
+// e.g. inherited from a parent process, instead of listening on its address
+func (s *Server) SetListeners(listeners []net.Listener) {
+	s.listeners = listeners
+}
+
+// Listeners returns the listeners the server accepts connections on,
+// they are only available after Ready is closed
+func (s *Server) Listeners() []net.Listener {
+	return s.listeners
+}
+
+// Ready is closed as soon as the server starts accepting connections
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	if len(s.listeners) == 0 {
+		for _, addr := range s.addrs {
+			listeners, err := s.listen(ctx, addr)
 			if err != nil {
-				errCh <- fmt.Errorf("failed to accept a new connection: %w", err)
-				return
+				s.closeListeners()
+				return fmt.Errorf("server failed to start listening on %s: %w", addr, err)
 			}
+			s.listeners = append(s.listeners, listeners...)
+		}
+	}
+	defer s.closeListeners()
 
-			go s.handleConnection(ctx, conn)
+	serve := s.handleConnection
+	if s.workers > 0 {
+		if s.tls != nil {
+			return ErrEpollTLS
 		}
-	}()
+		if s.httpHandler != nil {
+			return ErrEpollSniffing
+		}
+		if s.upstream != nil || len(s.routes) > 0 {
+			return ErrEpollProxy
+		}
+		if s.pingInterval > 0 {
+			return ErrEpollHeartbeat
+		}
+
+		p, err := newPoller(ctx, s, s.workers)
+		if err != nil {
+			return fmt.Errorf("server failed to start epoll engine: %w", err)
+		}
+		defer p.close()
+		serve = p.add
+	}
+
+	if s.httpHandler != nil {
+		s.serveHTTP()
+		defer s.httpServer.Close()
+	}
+
+	errCh := make(chan error, len(s.listeners))
+	for i, l := range s.listeners {
+		slog.With(l.Addr().Network(), l.Addr().String()).With("acceptor", i).Info("listening on address")
+		go s.accept(ctx, l, serve, errCh)
+	}
+
+	close(s.ready)
 
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case err := <-errCh:
+		if s.shuttingDown.Load() {
+			return ErrServerClosed
+		}
 		return err
 	}
 }
 
-func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
-	slog.With("address", conn.RemoteAddr().String()).Info("new client")
+// Shutdown stops accepting new connections, closes idle ones and waits
+// for the active ones to finish their exchange. When ctx is done before that,
+// the remaining connections are closed forcibly.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	s.closeListeners()
+
+	if s.httpServer != nil {
+		// closes idle HTTP connections and lets the active ones finish their request
+		go s.httpServer.Shutdown(ctx)
+	}
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			s.wg.Wait()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			s.wg.Wait()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Server) listen(ctx context.Context, addr string) ([]net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		l, err := listenUnix(path)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	if s.reusePort <= 1 {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	return listenReusePort(ctx, addr, s.reusePort)
+}
+
+func (s *Server) accept(
+	ctx context.Context,
+	l net.Listener,
+	serve func(context.Context, *trackedConn),
+	errCh chan<- error,
+) {
+	accepted := s.metrics.Counter("server.accepted")
+	rejected := s.metrics.Counter("server.rejected")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			errCh <- fmt.Errorf("failed to accept a new connection: %w", err)
+			return
+		}
+		accepted.Inc()
+
+		tc := s.track(conn)
+		if tc == nil {
+			rejected.Inc()
+			if !s.shuttingDown.Load() {
+				s.refuse(conn)
+			}
+			_ = conn.Close()
+			continue
+		}
+
+		if s.httpHandler != nil {
+			go s.serveSniffed(ctx, tc, serve)
+			continue
+		}
+
+		if s.proxies.ContainsAddr(conn.RemoteAddr()) {
+			go s.serveProxied(ctx, tc, serve)
+			continue
+		}
+
+		slog.With("address", tc.id).Info("new client")
+		s.secure(tc)
+		serve(ctx, tc)
+	}
+}
+
+// secure wraps the connection into TLS when the server is configured for it,
+// the handshake itself happens on the first read
+func (s *Server) secure(conn *trackedConn) {
+	if s.tls != nil {
+		conn.mu.Lock()
+		conn.Conn = tls.Server(conn.Conn, s.tls)
+		conn.mu.Unlock()
+	}
+}
+
+// serveProxied reads the PROXY protocol header sent by a trusted proxy
+// and serves the connection on behalf of the client from the header
+func (s *Server) serveProxied(ctx context.Context, conn *trackedConn, serve func(context.Context, *trackedConn)) {
+	h, err := s.readProxyHeader(conn)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	if !h.Local {
+		conn.id = h.Source.String()
+	}
+
+	slog.With("address", conn.id).With("proxy", conn.RemoteAddr().String()).Info("new client")
+	s.secure(conn)
+	serve(ctx, conn)
+}
+
+// serveHTTP starts the HTTP server fed with the connections sniffed as HTTP
+func (s *Server) serveHTTP() {
+	s.httpConns = newConnQueue(s.listeners[0].Addr())
+	s.httpServer = &http.Server{
+		Handler:           s.httpHandler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	go func() {
+		if err := s.httpServer.Serve(s.httpConns); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.With("error", err.Error()).Error("server.Server HTTP server stopped")
+		}
+	}()
+}
+
+// rejectProxyHeader reports whether the first bytes of a connection look like
+// a PROXY protocol header, which only trusted proxies are allowed to send
+func (s *Server) rejectProxyHeader(conn *trackedConn, first []byte) bool {
+	if !proxyproto.LooksLikeHeader(first) {
+		return false
+	}
+
+	slog.With("address", conn.id).Warn("server rejected PROXY protocol header from untrusted peer")
+	return true
+}
+
+func (s *Server) handleConnection(ctx context.Context, conn *trackedConn) {
+	go s.serveConnection(ctx, conn)
+}
+
+func (s *Server) serveConnection(ctx context.Context, conn *trackedConn) {
 	defer conn.Close()
+	// the responses of pipelined requests go out before the connection is closed
+	defer conn.pipeline.wait()
+
+	if tc, ok := conn.Conn.(*tls.Conn); ok {
+		hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tc.HandshakeContext(hsCtx)
+		cancel()
+		if err != nil {
+			slog.With("error", err.Error()).With("address", conn.id).Error("server.Server.serveConnection TLS handshake failed")
+			return
+		}
+	}
 
 	r := bufio.NewReader(conn)
+	if len(s.routes) > 0 {
+		// the ClientHello is peeked before it is spliced
+		r = bufio.NewReaderSize(conn, sni.MaxRecordSize)
+	}
+	first := true
 
 	for {
 		if ctx.Err() != nil {
@@ -72,28 +443,325 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 			return
 		}
 
-		b, err := r.ReadBytes(protocol.Delimiter)
+		if s.shuttingDown.Load() {
+			slog.With("address", conn.id).Info("closing connection due to shutdown")
+			return
+		}
+
+		conn.setIdle(true)
+		var (
+			b   []byte
+			err error
+		)
+		if s.pingInterval > 0 {
+			err = s.awaitFrame(conn, r)
+		}
+		if err == nil && first {
+			first = false
+			if b, err := r.Peek(protocol.HeaderSize); err == nil && s.rejectProxyHeader(conn, b) {
+				return
+			}
+		}
+		if err == nil {
+			b, err = protocol.ReadFrame(r)
+		}
+		conn.setIdle(false)
 		if err != nil {
 			if err == io.EOF {
 				slog.Info("connection ended")
 				return
 			}
 
+			if s.shuttingDown.Load() {
+				slog.With("address", conn.id).Info("idle connection closed due to shutdown")
+				return
+			}
+
 			slog.With("error", err.Error()).Error("server.Server.handleConnection failed to read payload")
 			return
 		}
 
-		payload, err := s.rh.Handle(ctx, b, conn.RemoteAddr().String())
+		if s.pipelined(conn, b) {
+			s.enqueue(ctx, conn, b)
+			continue
+		}
+		conn.pipeline.wait()
+
+		if len(s.routes) > 0 {
+			s.routeConnection(conn, b)
+		}
+
+		backend, err := s.handle(ctx, conn, b)
 		if err != nil {
-			slog.With("error", err.Error()).Error("server.Server.handleConnection failed to process request")
 			return
 		}
 
-		if err := protocol.Send(payload, conn); err != nil {
-			slog.
-				With("error", err.Error()).
-				With("client address", conn.RemoteAddr().String()).
-				Error("server failed to send payload")
+		if backend != nil {
+			if s.multiplexing && conn.route == nil {
+				s.serveStreams(ctx, conn, r, backend)
+				return
+			}
+
+			if err := s.checkServerName(conn, r); err != nil {
+				slog.With("error", err.Error()).With("address", conn.id).Error("server refused to route connection")
+				_ = backend.Close()
+				return
+			}
+
+			if err := conn.upstream().Splice(ctx, conn, r, backend); err != nil {
+				slog.With("error", err.Error()).With("address", conn.id).Error("server failed to proxy connection")
+			}
+			return
+		}
+	}
+}
+
+// handle processes a single frame read from conn and sends the response back,
+// an error means that the connection has to be closed. In proxy mode a solved
+// challenge yields the backend connection the client is to be spliced with.
+func (s *Server) handle(ctx context.Context, conn *trackedConn, frame []byte) (net.Conn, error) {
+	conn.native.Store(true)
+	req, err := protocol.Decode(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Action {
+	case protocol.Pong:
+		return nil, nil
+	case protocol.Close:
+		slog.With("address", conn.id).Info("peer closed the connection")
+		return nil, errPeerClosed
+	}
+
+	if s.sessions != nil && req.Action == protocol.Resume {
+		if conn.machine != nil {
+			if err := conn.machine.Check(req); err != nil {
+				return nil, conn.respond(tag(protocol.RejectFor(err), req))
+			}
+		}
+
+		resp, err := s.resume(conn, string(req.Data))
+		if err != nil {
+			return nil, err
 		}
+		return nil, conn.respond(tag(resp, req))
+	}
+
+	rh, up := s.rh, s.upstream
+	if conn.route != nil {
+		rh, up = conn.route.rh, conn.route.upstream
+	}
+
+	var payload *protocol.Payload
+	if conn.machine != nil {
+		payload, err = conn.machine.Handle(ctx, rh, frame, conn.id)
+	} else {
+		payload, err = rh.Handle(ctx, frame, conn.id)
 	}
+	if err != nil {
+		slog.With("error", err.Error()).Error("server.Server.handle failed to process request")
+		return nil, err
+	}
+
+	if s.sessions != nil {
+		s.remember(conn, payload)
+	}
+	if payload.Action == protocol.Challenge {
+		conn.challenged.Store(time.Now().UnixNano())
+	} else {
+		conn.challenged.Store(0)
+	}
+
+	var backend net.Conn
+	if up != nil && (payload.Action == protocol.Transmit || payload.Action == protocol.Ticket || payload.Action == protocol.TransmitStart) {
+		payload.CloseBody()
+
+		if backend, err = up.Dial(ctx, conn.id); err != nil {
+			slog.With("error", err.Error()).With("address", conn.id).Error("server failed to reach backend")
+			payload = protocol.NewReject(protocol.Rejection{Reason: protocol.ReasonUnavailable, RetryAfter: backendRetryAfter})
+		} else if ticket, _, ok := protocol.SplitTicket(payload.Data); ok && payload.Action == protocol.Ticket {
+			// the ticket lets the client open the following connections without solving
+			payload = protocol.NewTicket(ticket, "")
+		} else {
+			payload = &protocol.Payload{Action: protocol.Transmit}
+		}
+	}
+
+	if err := conn.respond(tag(payload, req)); err != nil {
+		slog.
+			With("error", err.Error()).
+			With("client address", conn.id).
+			Error("server failed to send payload")
+
+		if backend != nil {
+			_ = backend.Close()
+		}
+		return nil, nil
+	}
+
+	return backend, nil
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+}
+
+func (s *Server) track(conn net.Conn) *trackedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown.Load() {
+		return nil
+	}
+
+	if s.maxConns > 0 && int64(len(s.conns)) >= s.maxConns {
+		slog.With("address", conn.RemoteAddr().String()).Warn("connection limit reached")
+		return nil
+	}
+
+	tc := &trackedConn{Conn: conn, s: s, id: identify(conn)}
+	if s.maxChallenges > 0 {
+		tc.machine = protocol.NewMachine(s.maxChallenges)
+		if s.challengeTTL > 0 {
+			tc.machine.SetChallengeTTL(s.challengeTTL)
+		}
+	}
+	if s.pipeline > 0 {
+		tc.pipeline = newPipeline(s.pipeline)
+	}
+	s.conns[tc] = struct{}{}
+	s.wg.Add(1)
+	s.metrics.Counter("server.active").Inc()
+	return tc
+}
+
+func (s *Server) untrack(conn *trackedConn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	s.metrics.Counter("server.active").Dec()
+	s.wg.Done()
+}
+
+// closeIdleConns closes connections waiting for a request
+// and reports whether there are no connections left
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	var idle []*trackedConn
+	for c := range s.conns {
+		if c.idle.Load() && !c.pipeline.busy() {
+			idle = append(idle, c)
+		}
+	}
+	left := len(s.conns) - len(idle)
+	s.mu.Unlock()
+
+	for _, c := range idle {
+		c.goodbye(protocol.Rejection{Reason: protocol.ReasonShutdown})
+		_ = c.Close()
+	}
+
+	return left == 0
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	all := make([]*trackedConn, 0, len(s.conns))
+	for c := range s.conns {
+		all = append(all, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range all {
+		c.goodbye(protocol.Rejection{Reason: protocol.ReasonShutdown})
+		_ = c.Close()
+	}
+}
+
+// trackedConn is a connection the server keeps count of
+// until it is closed, e.g. to drain them during a graceful shutdown
+type trackedConn struct {
+	net.Conn
+	s    *Server
+	id   string
+	idle atomic.Bool
+	once sync.Once
+
+	// native connections sent a frame of the protocol, so they understand a Close
+	native atomic.Bool
+
+	// route is picked by the server name of the Request of the client, if any
+	route      *route
+	serverName string
+
+	// machine keeps the state of the exchange when the server limits the challenges
+	machine *protocol.Machine
+
+	// challenged is when the last response was sent in unix nanoseconds if it was a Challenge,
+	// zero otherwise, see solvingUntil
+	challenged atomic.Int64
+
+	// pipeline handles tagged requests concurrently when the server allows it
+	pipeline *pipeline
+
+	// wmu keeps the frames written concurrently whole, see frameWriter,
+	// and rmu keeps the responses of pipelined requests whole, see respond
+	wmu sync.Mutex
+	rmu sync.Mutex
+
+	// mu guards the fields replaced while the connection is being set up,
+	// since Close may be called concurrently by a shutdown
+	mu      sync.Mutex
+	onClose func()
+
+	// session is the id of the session the connection holds, if any
+	session string
+}
+
+// Close closes the connection and forgets about it, it is safe to call more than once
+func (c *trackedConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.mu.Lock()
+		conn, onClose, session := c.Conn, c.onClose, c.session
+		c.mu.Unlock()
+
+		if onClose != nil {
+			onClose()
+		}
+		if session != "" {
+			c.s.sessions.release(session)
+		}
+		err = conn.Close()
+		c.s.untrack(c)
+	})
+	return err
+}
+
+// upstream returns the upstream the connection is proxied to
+func (c *trackedConn) upstream() upstream {
+	if c.route != nil {
+		return c.route.upstream
+	}
+	return c.s.upstream
+}
+
+// CloseWrite shuts down the writing side of the connection when it supports that
+func (c *trackedConn) CloseWrite() error {
+	c.mu.Lock()
+	conn := c.Conn
+	c.mu.Unlock()
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *trackedConn) setIdle(idle bool) {
+	c.idle.Store(idle)
 }
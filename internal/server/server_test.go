@@ -0,0 +1,673 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/quotes"
+	"github.com/denismitr/antiddos/internal/server"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoHandler answers every request with a challenge carrying the client address
+type echoHandler struct{}
+
+func (echoHandler) Handle(_ context.Context, _ []byte, clientIP string) (*protocol.Payload, error) {
+	return &protocol.Payload{Action: protocol.Challenge, Data: []byte(clientIP)}, nil
+}
+
+func runServer(t testing.TB, s *server.Server) string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, server.ErrServerClosed) {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not get ready")
+	}
+
+	return s.Listeners()[0].Addr().String()
+}
+
+func exchange(t testing.TB, addr string) *protocol.Payload {
+	t.Helper()
+	return exchangeOn(t, "tcp", addr)
+}
+
+func exchangeOn(t testing.TB, network, addr string) *protocol.Payload {
+	t.Helper()
+
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+	b, err := protocol.ReadFrame(bufio.NewReader(conn))
+	require.NoError(t, err)
+	p, err := protocol.Decode(b)
+	require.NoError(t, err)
+	return p
+}
+
+func TestServer_ReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+
+	reg := metrics.NewRegistry()
+	s := server.New("127.0.0.1:0", echoHandler{})
+	s.SetReusePort(4)
+	s.SetMetrics(reg)
+	addr := runServer(t, s)
+
+	require.Len(t, s.Listeners(), 4)
+	for _, l := range s.Listeners() {
+		assert.Equal(t, addr, l.Addr().String())
+	}
+
+	for i := 0; i < 20; i++ {
+		p := exchange(t, addr)
+		assert.Equal(t, protocol.Challenge, p.Action)
+	}
+
+	assert.Equal(t, int64(20), reg.Counter("server.accepted").Value())
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	reg := metrics.NewRegistry()
+	s := server.New("127.0.0.1:0", echoHandler{})
+	s.SetMaxConns(1)
+	s.SetMetrics(reg)
+	addr := runServer(t, s)
+
+	held, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer held.Close()
+	require.Eventually(t, func() bool {
+		return reg.Counter("server.active").Value() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	rejected, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer rejected.Close()
+
+	// the client is told to come back later before the connection is closed
+	r := bufio.NewReader(rejected)
+	b, err := protocol.ReadFrame(r)
+	require.NoError(t, err)
+	p, err := protocol.Decode(b)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Close, p.Action)
+	rejection, err := protocol.ParseReject(p.Data)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ReasonOverloaded, rejection.Reason)
+	assert.Positive(t, rejection.RetryAfter)
+
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), reg.Counter("server.rejected").Value())
+}
+
+func BenchmarkServer_Accept(b *testing.B) {
+	b.Run("single listener", func(b *testing.B) {
+		benchmarkAccept(b, server.New("127.0.0.1:0", echoHandler{}))
+	})
+
+	b.Run("reuseport", func(b *testing.B) {
+		if runtime.GOOS != "linux" {
+			b.Skip("SO_REUSEPORT is only supported on linux")
+		}
+
+		s := server.New("127.0.0.1:0", echoHandler{})
+		s.SetReusePort(runtime.GOMAXPROCS(0))
+		benchmarkAccept(b, s)
+	})
+}
+
+func benchmarkAccept(b *testing.B, s *server.Server) {
+	addr := runServer(b, s)
+
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			// reset instead of a graceful close, so that the benchmark
+			// does not run out of ephemeral ports stuck in TIME_WAIT
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			_ = conn.Close()
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "conns/s")
+}
+
+func TestServer_Epoll(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("epoll engine is only supported on linux")
+	}
+
+	s := server.New("127.0.0.1:0", echoHandler{})
+	s.SetEpoll(2)
+	addr := runServer(t, s)
+
+	t.Run("single exchange", func(t *testing.T) {
+		p := exchange(t, addr)
+		assert.Equal(t, protocol.Challenge, p.Action)
+	})
+
+	t.Run("frame split across writes and frames sharing a write", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// a data length of 35 puts the delimiter byte into the header
+		frame, err := (&protocol.Payload{Action: protocol.Request, Data: make([]byte, 35)}).Encode()
+		require.NoError(t, err)
+
+		_, err = conn.Write(frame[:3])
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		_, err = conn.Write(append(frame[3:], frame...))
+		require.NoError(t, err)
+
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			b, err := protocol.ReadFrame(r)
+			require.NoError(t, err)
+			p, err := protocol.Decode(b)
+			require.NoError(t, err)
+			assert.Equal(t, protocol.Challenge, p.Action)
+			assert.Equal(t, conn.LocalAddr().String(), string(p.Data))
+		}
+	})
+
+	t.Run("malformed frame closes the connection", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte{0, 0, 1, 0, 'x', 'x'})
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	engines := map[string]func(s *server.Server){
+		"goroutines": func(s *server.Server) {},
+		"epoll": func(s *server.Server) {
+			if runtime.GOOS != "linux" {
+				t.Skip("epoll engine is only supported on linux")
+			}
+			s.SetEpoll(1)
+		},
+	}
+
+	for name, setup := range engines {
+		t.Run(name, func(t *testing.T) {
+			s := server.New("127.0.0.1:0", echoHandler{})
+			setup(s)
+			addr := runServer(t, s)
+
+			idle, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer idle.Close()
+			exchange(t, addr)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			require.NoError(t, s.Shutdown(ctx))
+
+			_, err = idle.Read(make([]byte, 1))
+			assert.Error(t, err)
+
+			_, err = net.Dial("tcp", addr)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestServer_MultipleAddresses(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "antiddos.sock")
+	addrs := []string{"127.0.0.1:0", "unix:" + sock}
+	if l, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		_ = l.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+
+	s := server.New("", echoHandler{})
+	s.SetAddrs(addrs)
+	runServer(t, s)
+	require.Len(t, s.Listeners(), len(addrs))
+
+	for _, l := range s.Listeners() {
+		if l.Addr().Network() != "tcp" {
+			continue
+		}
+
+		t.Run(l.Addr().String(), func(t *testing.T) {
+			p := exchangeOn(t, "tcp", l.Addr().String())
+			assert.Equal(t, protocol.Challenge, p.Action)
+		})
+	}
+
+	t.Run("unix socket client is identified by peer credentials", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("SO_PEERCRED is only supported on linux")
+		}
+
+		p := exchangeOn(t, "unix", sock)
+		assert.Equal(t, protocol.Challenge, p.Action)
+		assert.Equal(
+			t,
+			fmt.Sprintf("unix:uid=%d,gid=%d,pid=%d", os.Getuid(), os.Getgid(), os.Getpid()),
+			string(p.Data),
+		)
+	})
+
+	t.Run("socket of a running server is kept", func(t *testing.T) {
+		err := server.New("unix:"+sock, echoHandler{}).Run(context.Background())
+		assert.ErrorIs(t, err, syscall.EADDRINUSE)
+
+		p := exchangeOn(t, "unix", sock)
+		assert.Equal(t, protocol.Challenge, p.Action)
+	})
+
+	t.Run("stale socket file is replaced", func(t *testing.T) {
+		require.NoError(t, s.Shutdown(context.Background()))
+		_, err := os.Stat(sock)
+		require.NoError(t, err)
+
+		s := server.New("unix:"+sock, echoHandler{})
+		runServer(t, s)
+
+		p := exchangeOn(t, "unix", sock)
+		assert.Equal(t, protocol.Challenge, p.Action)
+	})
+}
+
+func TestServer_TrustedProxies(t *testing.T) {
+	trusted, err := trust.ParseNetworks([]string{"127.0.0.1/32"})
+	require.NoError(t, err)
+	untrusted, err := trust.ParseNetworks([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	request, err := (&protocol.Payload{Action: protocol.Request}).Encode()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		networks trust.Networks
+		epoll    bool
+		preamble string
+		clientIP string
+	}{
+		{
+			name:     "real client address from trusted proxy",
+			networks: trusted,
+			preamble: "PROXY TCP4 192.0.2.10 127.0.0.1 56324 3333\r\n",
+			clientIP: "192.0.2.10:56324",
+		},
+		{
+			name:     "real client address from trusted proxy with epoll engine",
+			networks: trusted,
+			epoll:    true,
+			preamble: "PROXY TCP6 2001:db8::1 ::1 40000 3333\r\n",
+			clientIP: "[2001:db8::1]:40000",
+		},
+		{
+			name:     "proxy health check keeps the proxy address",
+			networks: trusted,
+			preamble: "PROXY UNKNOWN\r\n",
+			clientIP: "127.0.0.1",
+		},
+		{
+			name:     "malformed header from trusted proxy",
+			networks: trusted,
+			preamble: "PROXY TCP4 192.0.2.10\r\n",
+		},
+		{
+			name:     "trusted proxy without header",
+			networks: trusted,
+		},
+		{
+			name:     "header from untrusted peer",
+			networks: untrusted,
+			preamble: "PROXY TCP4 192.0.2.10 127.0.0.1 56324 3333\r\n",
+		},
+		{
+			name:     "header from untrusted peer with epoll engine",
+			networks: untrusted,
+			epoll:    true,
+			preamble: "PROXY TCP4 192.0.2.10 127.0.0.1 56324 3333\r\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.epoll && runtime.GOOS != "linux" {
+				t.Skip("epoll engine is only supported on linux")
+			}
+
+			s := server.New("127.0.0.1:0", echoHandler{})
+			s.SetTrustedProxies(tc.networks)
+			if tc.epoll {
+				s.SetEpoll(1)
+			}
+			addr := runServer(t, s)
+
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.SetDeadline(time.Now().Add(3*time.Second)))
+
+			_, err = conn.Write(append([]byte(tc.preamble), request...))
+			require.NoError(t, err)
+
+			b, err := protocol.ReadFrame(bufio.NewReader(conn))
+			if tc.clientIP == "" {
+				assert.Error(t, err, "connection must be closed")
+				return
+			}
+
+			require.NoError(t, err)
+			p, err := protocol.Decode(b)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(p.Data), tc.clientIP), "client %s", p.Data)
+		})
+	}
+}
+
+func TestServer_MaxChallenges(t *testing.T) {
+	c := challenge.New(nope.Nope{}, 3, 30)
+	s := server.New("127.0.0.1:0", protocol.New(c, quotes.New()))
+	s.SetMaxChallenges(1)
+	addr := runServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	send := func(a protocol.Action, data string) *protocol.Payload {
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: a, Data: []byte(data)}, conn))
+		b, err := protocol.ReadFrame(r)
+		require.NoError(t, err)
+		p, err := protocol.Decode(b)
+		require.NoError(t, err)
+		return p
+	}
+
+	// illegal requests are rejected and the connection stays open
+	assert.Equal(t, protocol.Reject, send(protocol.Solve, "").Action)
+	assert.Equal(t, protocol.Reject, send(protocol.Transmit, "").Action)
+	header := send(protocol.Request, "")
+	assert.Equal(t, protocol.Challenge, header.Action)
+	assert.Equal(t, protocol.Reject, send(protocol.Request, "").Action)
+
+	// a challenge the connection did not ask for is not solved, even one bound to its address
+	foreign, err := c.Create(conn.LocalAddr().String())
+	require.NoError(t, err)
+	solved, err := c.Solve(foreign)
+	require.NoError(t, err)
+	p := send(protocol.Solve, solved)
+	require.Equal(t, protocol.Reject, p.Action)
+	rejection, err := protocol.ParseReject(p.Data)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ReasonUnknownNonce, rejection.Reason)
+
+	solved, err = c.Solve(string(header.Data))
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Transmit, send(protocol.Solve, solved).Action)
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	s := server.New("127.0.0.1:0", echoHandler{})
+	s.SetHeartbeat(50*time.Millisecond, 50*time.Millisecond)
+	s.SetChallengeTTL(200 * time.Millisecond)
+	addr := runServer(t, s)
+
+	read := func(r *bufio.Reader) *protocol.Payload {
+		b, err := protocol.ReadFrame(r)
+		require.NoError(t, err)
+		p, err := protocol.Decode(b)
+		require.NoError(t, err)
+		return p
+	}
+
+	t.Run("answering peer stays connected", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, protocol.Ping, read(r).Action)
+			require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Pong}, conn))
+		}
+
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+		assert.Equal(t, protocol.Challenge, read(r).Action)
+	})
+
+	t.Run("silent peer is closed", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+		assert.Equal(t, protocol.Challenge, read(r).Action)
+		assert.Equal(t, protocol.Ping, read(r).Action)
+
+		p := read(r)
+		assert.Equal(t, protocol.Close, p.Action)
+		rejection, err := protocol.ParseReject(p.Data)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.ReasonIdleTimeout, rejection.Reason)
+
+		_, err = r.ReadByte()
+		assert.Error(t, err)
+	})
+
+	t.Run("solving peer is closed once its challenge expires", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+		assert.Equal(t, protocol.Challenge, read(r).Action)
+		issued := time.Now()
+
+		// not pinged within the interval and the timeout, but once the challenge expired
+		assert.Equal(t, protocol.Ping, read(r).Action)
+		assert.GreaterOrEqual(t, time.Since(issued), 200*time.Millisecond)
+
+		p := read(r)
+		assert.Equal(t, protocol.Close, p.Action)
+		rejection, err := protocol.ParseReject(p.Data)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.ReasonIdleTimeout, rejection.Reason)
+	})
+
+	t.Run("peer says goodbye", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, protocol.Send(protocol.NewClose(protocol.Rejection{Reason: protocol.ReasonGoodbye}), conn))
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = bufio.NewReader(conn).ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+// slowHandler answers after as many milliseconds as the first byte of the data
+// and counts the requests it handles at once
+type slowHandler struct {
+	active, max atomic.Int32
+}
+
+func (h *slowHandler) Handle(_ context.Context, req []byte, _ string) (*protocol.Payload, error) {
+	p, err := protocol.Decode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	n := h.active.Add(1)
+	defer h.active.Add(-1)
+	for m := h.max.Load(); n > m && !h.max.CompareAndSwap(m, n); m = h.max.Load() {
+	}
+
+	if len(p.Data) > 0 {
+		time.Sleep(time.Duration(p.Data[0]) * time.Millisecond)
+	}
+	return &protocol.Payload{Action: protocol.Challenge, Data: p.Data}, nil
+}
+
+func TestServer_Pipeline(t *testing.T) {
+	h := &slowHandler{}
+	s := server.New("127.0.0.1:0", h)
+	s.SetPipeline(2)
+	addr := runServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	delays := []byte{80, 40, 20, 10}
+	for i, d := range delays {
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request, ID: uint32(i + 1), Data: []byte{d}}, conn))
+	}
+
+	r := bufio.NewReader(conn)
+	var ids []uint32
+	for range delays {
+		b, err := protocol.ReadFrame(r)
+		require.NoError(t, err)
+		p, err := protocol.Decode(b)
+		require.NoError(t, err)
+
+		// every response carries the ID of its request
+		require.NotZero(t, p.ID)
+		assert.Equal(t, []byte{delays[p.ID-1]}, p.Data)
+		ids = append(ids, p.ID)
+	}
+
+	assert.ElementsMatch(t, []uint32{1, 2, 3, 4}, ids)
+	assert.NotEqual(t, uint32(1), ids[0], "the slowest request is not answered first")
+	assert.Equal(t, int32(2), h.max.Load())
+
+	// untagged requests are answered untagged
+	require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+	b, err := protocol.ReadFrame(r)
+	require.NoError(t, err)
+	p, err := protocol.Decode(b)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.Challenge, p.Action)
+	assert.Zero(t, p.ID)
+	assert.False(t, protocol.IsTagged(b))
+}
+
+// slowBody yields zeroes a kilobyte a millisecond
+type slowBody struct {
+	left int
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		return 0, io.EOF
+	}
+
+	time.Sleep(time.Millisecond)
+	n := min(len(p), b.left, 1024)
+	clear(p[:n])
+	b.left -= n
+	return n, nil
+}
+
+// streamHandler answers every request with a transmission streamed in several chunks
+type streamHandler struct{}
+
+func (streamHandler) Handle(context.Context, []byte, string) (*protocol.Payload, error) {
+	size := 2*protocol.MaxDataSize + 1
+	return protocol.NewTransmitStart(protocol.Transmission{Size: int64(size), Body: &slowBody{left: size}}, ""), nil
+}
+
+func TestServer_PipelinedStreams(t *testing.T) {
+	s := server.New("127.0.0.1:0", streamHandler{})
+	s.SetPipeline(2)
+	s.SetHeartbeat(5*time.Millisecond, time.Second)
+	addr := runServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for id := uint32(1); id <= 2; id++ {
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request, ID: id}, conn))
+	}
+
+	// the frames of a streamed transmission are never interleaved with the ones of another,
+	// only the whole frames of Pings come between them
+	r := bufio.NewReader(conn)
+	var streaming uint32
+	var pings int
+	for ended := 0; ended < 2; {
+		b, err := protocol.ReadFrame(r)
+		require.NoError(t, err)
+		p, err := protocol.Decode(b)
+		require.NoError(t, err)
+
+		switch p.Action {
+		case protocol.TransmitStart:
+			require.Zero(t, streaming, "transmission %d starts within transmission %d", p.ID, streaming)
+			streaming = p.ID
+		case protocol.TransmitChunk:
+			require.Equal(t, streaming, p.ID)
+		case protocol.TransmitEnd:
+			require.Equal(t, streaming, p.ID)
+			streaming = 0
+			ended++
+		case protocol.Ping:
+			pings++
+			require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Pong}, conn))
+		default:
+			t.Fatalf("unexpected [%d] action", p.Action)
+		}
+	}
+	assert.Positive(t, pings)
+}
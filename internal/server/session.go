@@ -0,0 +1,273 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionIDSize is the amount of random bytes identifying a session
+	sessionIDSize = 16
+
+	// ipv4SessionPrefix and ipv6SessionPrefix are the networks a session can be resumed from,
+	// wide enough for clients whose address changes on reconnect, e.g. behind a carrier NAT
+	ipv4SessionPrefix = 24
+	ipv6SessionPrefix = 64
+
+	// defaultMaxSessions bounds the sessions kept at once unless SetMaxSessions says otherwise
+	defaultMaxSessions = 100_000
+)
+
+var (
+	errUnknownSession          = errors.New("unknown session")
+	errSessionOfAnotherNetwork = errors.New("session of another network")
+	errTooManySessions         = errors.New("too many sessions")
+)
+
+// session is what a client resumes on reconnect: the identity its challenges
+// are bound to, the nonces of the ones outstanding, the route it named and the ticket it was issued last
+type session struct {
+	clientID   string
+	challenges []string
+	serverName string
+	ticket     string
+
+	// expires is zero while a connection holds the session
+	expires time.Time
+}
+
+// sessions keeps the sessions of the connections and, for a grace period
+// after they are closed, the sessions waiting to be resumed
+type sessions struct {
+	grace time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	m         map[string]*session
+	lastSweep time.Time
+}
+
+func newSessions(grace time.Duration) *sessions {
+	return &sessions{
+		grace: grace,
+		now:   time.Now,
+		m:     make(map[string]*session),
+	}
+}
+
+// SetSessionGrace lets clients open a session with an empty Resume and resume it
+// with its id on another connection within grace after the former one is closed.
+// The resumed connection is identified as the former one, so the outstanding
+// challenge stays valid, and gets back the last ticket issued to it.
+// A session is resumed once, from the network of the address it was opened from.
+// A connection opens a single session, see SetMaxSessions for the sessions kept overall.
+func (s *Server) SetSessionGrace(grace time.Duration) {
+	s.sessions = newSessions(grace)
+}
+
+// SetMaxSessions limits the sessions kept at once, both the ones held by connections
+// and the ones waiting to be resumed. New sessions are rejected as overloaded above it.
+func (s *Server) SetMaxSessions(n int) {
+	s.maxSessions = n
+}
+
+// resume answers the Resume of the client with a Session, or with a Reject
+// when the session cannot be resumed
+func (s *Server) resume(conn *trackedConn, id string) (*protocol.Payload, error) {
+	var (
+		sess *session
+		err  error
+	)
+
+	conn.mu.Lock()
+	held := conn.session
+	conn.mu.Unlock()
+
+	if id == "" {
+		if held != "" {
+			slog.With("address", conn.id).Warn("server refused to open another session on the connection")
+			return protocol.NewReject(protocol.Rejection{Reason: protocol.ReasonIllegalTransition}), nil
+		}
+		sess = &session{clientID: conn.id}
+	} else if sess, err = s.sessions.take(id, conn.id); err != nil {
+		slog.With("error", err.Error()).With("address", conn.id).Warn("server refused to resume session")
+
+		reason := protocol.ReasonUnknownNonce
+		if errors.Is(err, errSessionOfAnotherNetwork) {
+			reason = protocol.ReasonBadBinding
+		}
+		return protocol.NewReject(protocol.Rejection{Reason: reason}), nil
+	}
+
+	limit := s.maxSessions
+	if limit <= 0 {
+		limit = defaultMaxSessions
+	}
+
+	newID, err := s.sessions.open(sess, limit)
+	if errors.Is(err, errTooManySessions) {
+		slog.With("error", err.Error()).With("address", conn.id).Warn("server refused to open session")
+		return protocol.NewReject(protocol.Rejection{Reason: protocol.ReasonOverloaded, RetryAfter: s.sessions.grace}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.mu.Lock()
+	if conn.session != "" {
+		s.sessions.release(conn.session)
+	}
+	conn.session = newID
+	conn.mu.Unlock()
+
+	conn.id = sess.clientID
+	if conn.machine != nil {
+		conn.machine.Restore(sess.challenges)
+	}
+	if sess.serverName != "" {
+		conn.serverName = sess.serverName
+		conn.route = s.lookupRoute(sess.serverName)
+	}
+
+	return protocol.NewSession(newID, sess.ticket), nil
+}
+
+// open keeps the session under a new id, unless limit sessions are kept already
+func (ss *sessions) open(sess *session, limit int) (string, error) {
+	b := make([]byte, sessionIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("server.sessions.open failed to generate id: %w", err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.sweep()
+	if len(ss.m) >= limit {
+		return "", fmt.Errorf("%w: %d kept", errTooManySessions, len(ss.m))
+	}
+
+	sess.expires = time.Time{}
+	ss.m[id] = sess
+	return id, nil
+}
+
+// take removes the session from the store so that it is resumed once,
+// it fails for unknown and expired sessions and for clients from another network
+func (ss *sessions) take(id, clientID string) (*session, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sess, ok := ss.m[id]
+	if !ok || (!sess.expires.IsZero() && ss.now().After(sess.expires)) {
+		return nil, errUnknownSession
+	}
+
+	if !sameNetwork(sess.clientID, clientID) {
+		return nil, fmt.Errorf("%w: session of %s resumed from %s", errSessionOfAnotherNetwork, sess.clientID, clientID)
+	}
+
+	delete(ss.m, id)
+	return sess, nil
+}
+
+// update changes the session held by a connection
+func (ss *sessions) update(id string, fn func(sess *session)) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if sess, ok := ss.m[id]; ok {
+		fn(sess)
+	}
+}
+
+// release starts the grace period of the session once its connection is closed
+func (ss *sessions) release(id string) {
+	ss.update(id, func(sess *session) {
+		sess.expires = ss.now().Add(ss.grace)
+	})
+}
+
+// sweep forgets expired sessions, at most once per grace period
+func (ss *sessions) sweep() {
+	now := ss.now()
+	if now.Sub(ss.lastSweep) < ss.grace {
+		return
+	}
+
+	ss.lastSweep = now
+	for id, sess := range ss.m {
+		if !sess.expires.IsZero() && now.After(sess.expires) {
+			delete(ss.m, id)
+		}
+	}
+}
+
+// sameNetwork tells whether both clients come from the same network,
+// clients not identified by an IP address have to match exactly
+func sameNetwork(a, b string) bool {
+	pa, okA := clientPrefix(a)
+	pb, okB := clientPrefix(b)
+	if !okA || !okB {
+		return a == b
+	}
+
+	return pa == pb
+}
+
+func clientPrefix(clientID string) (netip.Prefix, bool) {
+	host, _, err := net.SplitHostPort(clientID)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	addr = addr.Unmap()
+	bits := ipv6SessionPrefix
+	if addr.Is4() {
+		bits = ipv4SessionPrefix
+	}
+
+	p, err := addr.Prefix(bits)
+	return p, err == nil
+}
+
+// remember keeps the route and the ticket of the connection in its session
+func (s *Server) remember(conn *trackedConn, payload *protocol.Payload) {
+	conn.mu.Lock()
+	id := conn.session
+	conn.mu.Unlock()
+
+	if id == "" {
+		return
+	}
+
+	ticket, _, isTicket := protocol.SplitTicket(payload.Data)
+	isTicket = isTicket && payload.Action == protocol.Ticket
+	if payload.Action == protocol.TransmitStart {
+		_, ticket, _ = protocol.ParseTransmitStart(payload.Data)
+		isTicket = ticket != ""
+	}
+	s.sessions.update(id, func(sess *session) {
+		if conn.machine != nil {
+			sess.challenges = conn.machine.Challenges()
+		}
+		sess.serverName = conn.serverName
+		if isTicket {
+			sess.ticket = ticket
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/proxyproto"
+)
+
+var (
+	ErrEpollSniffing = errors.New("epoll engine can not serve sniffed connections")
+)
+
+const (
+	// sniffTimeout bounds waiting for the first bytes of a connection
+	sniffTimeout = 3 * time.Second
+
+	// sniffSize is how many bytes tell the protocols apart, every one of them
+	// starts with at least that many: a native frame, a TLS record header,
+	// an HTTP request line and a PROXY header
+	sniffSize = 5
+)
+
+type kind int
+
+const (
+	kindNative kind = iota
+	kindTLS
+	kindHTTP
+	kindProxy
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindTLS:
+		return "TLS"
+	case kindHTTP:
+		return "HTTP"
+	case kindProxy:
+		return "PROXY"
+	default:
+		return "native"
+	}
+}
+
+// httpMethods are the request line prefixes routed to the HTTP front end,
+// the first byte of a native frame is an action and never an ASCII letter
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "OPTIO"}
+
+// classify tells the protocol of a connection by its first sniffSize bytes
+func classify(b []byte) kind {
+	// a handshake record of TLS 1.x, the ClientHello
+	if b[0] == 0x16 && b[1] == 0x03 {
+		return kindTLS
+	}
+
+	for _, m := range httpMethods {
+		if string(b[:len(m)]) == m {
+			return kindHTTP
+		}
+	}
+
+	if proxyproto.LooksLikeHeader(b) {
+		return kindProxy
+	}
+
+	return kindNative
+}
+
+// sniffedConn replays the sniffed bytes before reading the rest of the connection
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *sniffedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// proxiedConn reports the client address from the PROXY header as its remote address
+type proxiedConn struct {
+	*trackedConn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// sniff reads the first bytes of the connection within sniffTimeout and tells its
+// protocol, the connection keeps the sniffed bytes to be read again
+func (s *Server) sniff(conn *trackedConn) (kind, error) {
+	conn.mu.Lock()
+	inner := conn.Conn
+	conn.mu.Unlock()
+
+	if err := inner.SetReadDeadline(time.Now().Add(sniffTimeout)); err != nil {
+		return kindNative, err
+	}
+
+	r := bufio.NewReader(inner)
+	b, err := r.Peek(sniffSize)
+	if err != nil {
+		return kindNative, err
+	}
+
+	if err := inner.SetReadDeadline(time.Time{}); err != nil {
+		return kindNative, err
+	}
+
+	conn.mu.Lock()
+	conn.Conn = &sniffedConn{Conn: inner, r: r}
+	conn.mu.Unlock()
+
+	return classify(b), nil
+}
+
+// serveSniffed routes the connection by its first bytes: a PROXY header from
+// a trusted proxy is parsed, TLS is terminated, and what follows is sniffed again.
+// HTTP goes to the HTTP front end and anything else to the native protocol.
+func (s *Server) serveSniffed(ctx context.Context, conn *trackedConn, serve func(context.Context, *trackedConn)) {
+	var remote net.Addr
+	trusted := s.proxies.ContainsAddr(conn.RemoteAddr())
+	secured := false
+
+	for {
+		k, err := s.sniff(conn)
+		if err != nil {
+			slog.With("error", err.Error()).With("address", conn.id).Info("server failed to sniff connection")
+			_ = conn.Close()
+			return
+		}
+
+		// trusted proxies must start with a PROXY header and nobody else may send one
+		if trusted != (k == kindProxy) {
+			slog.With("address", conn.id).With("protocol", k.String()).Warn("server rejected unexpected protocol")
+			_ = conn.Close()
+			return
+		}
+
+		switch k {
+		case kindProxy:
+			trusted = false
+			h, err := s.readProxyHeader(conn)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			if !h.Local {
+				conn.id, remote = h.Source.String(), h.Source
+			}
+		case kindTLS:
+			if s.tls == nil || secured {
+				slog.With("address", conn.id).Warn("server rejected unexpected TLS connection")
+				_ = conn.Close()
+				return
+			}
+			secured = true
+
+			if err := s.handshake(ctx, conn); err != nil {
+				_ = conn.Close()
+				return
+			}
+		case kindHTTP:
+			slog.With("address", conn.id).Info("new HTTP client")
+
+			var c net.Conn = conn
+			if remote != nil {
+				c = &proxiedConn{trackedConn: conn, remote: remote}
+			}
+			if !s.httpConns.push(c) {
+				_ = conn.Close()
+			}
+			return
+		default:
+			slog.With("address", conn.id).Info("new client")
+			serve(ctx, conn)
+			return
+		}
+	}
+}
+
+// readProxyHeader reads the PROXY protocol header at the start of the connection
+func (s *Server) readProxyHeader(conn *trackedConn) (*proxyproto.Header, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	h, err := proxyproto.ReadHeader(conn.Conn)
+	if err != nil {
+		slog.With("error", err.Error()).With("proxy", conn.id).Error("server rejected connection from trusted proxy")
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// handshake terminates TLS on the connection
+func (s *Server) handshake(ctx context.Context, conn *trackedConn) error {
+	conn.mu.Lock()
+	tc := tls.Server(conn.Conn, s.tls)
+	conn.Conn = tc
+	conn.mu.Unlock()
+
+	hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+
+	if err := tc.HandshakeContext(hsCtx); err != nil {
+		slog.With("error", err.Error()).With("address", conn.id).Error("server.Server TLS handshake failed")
+		return err
+	}
+
+	return nil
+}
+
+// connQueue is a net.Listener handing the connections sniffed as HTTP over to http.Server
+type connQueue struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push hands the connection over, it reports false once the queue is closed
+func (q *connQueue) push(conn net.Conn) bool {
+	select {
+	case q.conns <- conn:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *connQueue) Close() error {
+	q.once.Do(func() {
+		close(q.done)
+	})
+	return nil
+}
+
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
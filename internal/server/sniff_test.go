@@ -0,0 +1,150 @@
+package server_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/server"
+	"github.com/denismitr/antiddos/internal/trust"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteAddrHandler answers HTTP requests with the remote address of the client
+var remoteAddrHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.WriteString(w, r.RemoteAddr)
+})
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func httpGet(t *testing.T, url string) string {
+	t.Helper()
+
+	c := &http.Client{
+		Timeout:   3 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := c.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestServer_Sniffing(t *testing.T) {
+	s := server.New("127.0.0.1:0", echoHandler{})
+	s.SetHTTPHandler(remoteAddrHandler)
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{selfSigned(t)}})
+	addr := runServer(t, s)
+
+	t.Run("native", func(t *testing.T) {
+		p := exchange(t, addr)
+		assert.Equal(t, protocol.Challenge, p.Action)
+	})
+
+	t.Run("native over TLS", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, protocol.Send(&protocol.Payload{Action: protocol.Request}, conn))
+		b, err := protocol.ReadFrame(bufio.NewReader(conn))
+		require.NoError(t, err)
+		p, err := protocol.Decode(b)
+		require.NoError(t, err)
+		assert.Equal(t, protocol.Challenge, p.Action)
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		assert.Contains(t, httpGet(t, "http://"+addr+"/"), "127.0.0.1:")
+	})
+
+	t.Run("HTTPS", func(t *testing.T) {
+		assert.Contains(t, httpGet(t, "https://"+addr+"/"), "127.0.0.1:")
+	})
+
+	t.Run("PROXY header from untrusted peer", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("PROXY TCP4 192.0.2.10 127.0.0.1 56324 3333\r\nGET / HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestServer_SniffingBehindProxy(t *testing.T) {
+	trusted, err := trust.ParseNetworks([]string{"127.0.0.1/32"})
+	require.NoError(t, err)
+
+	s := server.New("127.0.0.1:0", echoHandler{})
+	s.SetHTTPHandler(remoteAddrHandler)
+	s.SetTrustedProxies(trusted)
+	addr := runServer(t, s)
+
+	send := func(t *testing.T, preamble, request string) string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(preamble + request))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(3*time.Second)))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+
+	t.Run("HTTP gets the client address from the header", func(t *testing.T) {
+		resp := send(t, "PROXY TCP4 192.0.2.10 127.0.0.1 56324 3333\r\n", "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		assert.Contains(t, resp, "192.0.2.10:56324")
+	})
+
+	t.Run("native gets the client address from the header", func(t *testing.T) {
+		req, err := (&protocol.Payload{Action: protocol.Request}).Encode()
+		require.NoError(t, err)
+
+		resp := send(t, "PROXY TCP4 192.0.2.10 127.0.0.1 56324 3333\r\n", string(req))
+		assert.Contains(t, resp, "192.0.2.10:56324")
+	})
+
+	t.Run("missing header", func(t *testing.T) {
+		resp := send(t, "", "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		assert.Empty(t, resp)
+	})
+}
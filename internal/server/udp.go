@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"runtime"
+	"sync"
+
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/protocol"
+)
+
+// maxDatagramSize is the largest UDP payload
+const maxDatagramSize = 1<<16 - 1
+
+// UDPServer serves the protocol over UDP, a frame per datagram: a Request is
+// answered with a Challenge, a Solve with a Transmit or a Reject. It keeps no
+// state per peer, so the challenges are expected to be signed and the protocol
+// to be strict. Since the source of a datagram can be spoofed, a response is
+// never larger than the datagram it answers, clients make room for it by padding
+// their datagrams with zero bytes after the frame.
+type UDPServer struct {
+	addr    string
+	rh      requestHandler
+	conn    net.PacketConn
+	ready   chan struct{}
+	workers int
+	metrics *metrics.Registry
+}
+
+func NewUDP(addr string, h requestHandler) *UDPServer {
+	return &UDPServer{
+		addr:    addr,
+		rh:      h,
+		ready:   make(chan struct{}),
+		workers: runtime.GOMAXPROCS(0),
+		metrics: metrics.NewRegistry(),
+	}
+}
+
+// SetWorkers sets the number of goroutines reading datagrams from the socket
+func (s *UDPServer) SetWorkers(n int) {
+	s.workers = n
+}
+
+// SetMetrics makes the server count datagrams in the given registry
+func (s *UDPServer) SetMetrics(r *metrics.Registry) {
+	s.metrics = r
+}
+
+// Addr returns the address the server listens on, it is only available after Ready is closed
+func (s *UDPServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Ready is closed as soon as the server starts reading datagrams
+func (s *UDPServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *UDPServer) Run(ctx context.Context) error {
+	conn, err := listenPacket(ctx, s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+
+	slog.With("addr", conn.LocalAddr().String()).Info("listening on UDP")
+
+	var wg sync.WaitGroup
+	wg.Add(s.workers)
+	for i := 0; i < s.workers; i++ {
+		go func() {
+			defer wg.Done()
+			s.serve(ctx)
+		}()
+	}
+	close(s.ready)
+
+	<-ctx.Done()
+	_ = conn.Close()
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (s *UDPServer) serve(ctx context.Context) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.With("error", err.Error()).Error("server.UDPServer.serve failed to read datagram")
+			continue
+		}
+
+		s.metrics.Counter("udp.received").Inc()
+
+		resp, ok := s.handle(ctx, buf[:n], addr)
+		if !ok {
+			s.metrics.Counter("udp.dropped").Inc()
+			continue
+		}
+
+		if _, err := s.conn.WriteTo(resp, addr); err != nil {
+			slog.With("error", err.Error()).Error("server.UDPServer.serve failed to write datagram")
+		}
+	}
+}
+
+// handle returns the response to a datagram, ok is false when it is dropped
+func (s *UDPServer) handle(ctx context.Context, datagram []byte, addr net.Addr) ([]byte, bool) {
+	frame, rest, err := protocol.SplitFrame(datagram)
+	if err != nil || frame == nil || !isPadding(rest) {
+		return nil, false
+	}
+
+	p, err := s.rh.Handle(ctx, frame, addr.String())
+	if err != nil {
+		slog.With("error", err.Error(), "client", addr.String()).Info("dropping datagram")
+		return nil, false
+	}
+
+	// a streamed transmission does not fit a datagram
+	if p.Body != nil {
+		p.CloseBody()
+		slog.With("client", addr.String()).Warn("dropping streamed transmission")
+		return nil, false
+	}
+
+	if req, err := protocol.Decode(frame); err == nil {
+		p = tag(p, req)
+	}
+
+	b, err := p.Encode()
+	if err != nil {
+		slog.With("error", err.Error()).Error("server.UDPServer.handle failed to encode response")
+		return nil, false
+	}
+
+	// a spoofed source must not turn the server into an amplifier,
+	// only a solution proves that the client owns its address
+	if p.Action != protocol.Transmit && p.Action != protocol.Ticket && len(b) > len(datagram) {
+		return nil, false
+	}
+
+	return b, true
+}
+
+func isPadding(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/bootstrap"
+	"github.com/denismitr/antiddos/internal/challenge"
+	"github.com/denismitr/antiddos/internal/metrics"
+	"github.com/denismitr/antiddos/internal/protocol"
+	"github.com/denismitr/antiddos/internal/store/adapters/nope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const padTo = 512
+
+func runUDPServer(t *testing.T, reg *metrics.Registry) string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := bootstrap.UdpServer(ctx, 30, 2, []byte("secret"), "127.0.0.1:0")
+	require.NoError(t, err)
+	s.SetMetrics(reg)
+
+	go func() {
+		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not get ready")
+	}
+
+	return s.Addr().String()
+}
+
+// roundTrip sends the payload padded to size and returns the response, or nil when there is none
+func roundTrip(t *testing.T, conn net.Conn, p *protocol.Payload, size int) *protocol.Payload {
+	t.Helper()
+
+	b, err := p.Encode()
+	require.NoError(t, err)
+	if len(b) < size {
+		b = append(b, make([]byte, size-len(b))...)
+	}
+
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	buf := make([]byte, 1<<16)
+	n, err := conn.Read(buf)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	require.NoError(t, err)
+
+	frame, rest, err := protocol.SplitFrame(buf[:n])
+	require.NoError(t, err)
+	require.Empty(t, rest)
+
+	resp, err := protocol.Decode(frame)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestUDPServer(t *testing.T) {
+	reg := metrics.NewRegistry()
+	addr := runUDPServer(t, reg)
+
+	dial := func(t *testing.T) net.Conn {
+		conn, err := net.Dial("udp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	t.Run("unpadded request is not answered", func(t *testing.T) {
+		resp := roundTrip(t, dial(t), &protocol.Payload{Action: protocol.Request}, 0)
+		assert.Nil(t, resp)
+		assert.Equal(t, int64(1), reg.Counter("udp.dropped").Value())
+	})
+
+	t.Run("request followed by anything but padding is dropped", func(t *testing.T) {
+		conn := dial(t)
+		b, err := (&protocol.Payload{Action: protocol.Request}).Encode()
+		require.NoError(t, err)
+
+		_, err = conn.Write(append(b, []byte(strings.Repeat("garbage", padTo))...))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		_, err = conn.Read(make([]byte, padTo))
+		assert.Error(t, err)
+	})
+
+	t.Run("solution is accepted once and only from its client", func(t *testing.T) {
+		conn := dial(t)
+
+		resp := roundTrip(t, conn, &protocol.Payload{Action: protocol.Request}, padTo)
+		require.NotNil(t, resp)
+		require.Equal(t, protocol.Challenge, resp.Action)
+
+		solved, err := challenge.New(nope.Nope{}, 2, 30).Solve(string(resp.Data))
+		require.NoError(t, err)
+		solve := &protocol.Payload{Action: protocol.Solve, Data: []byte(solved)}
+
+		resp = roundTrip(t, dial(t), solve, padTo)
+		require.NotNil(t, resp)
+		assert.Equal(t, protocol.Reject, resp.Action)
+
+		resp = roundTrip(t, conn, solve, padTo)
+		require.NotNil(t, resp)
+		assert.Equal(t, protocol.Transmit, resp.Action)
+
+		resp = roundTrip(t, conn, solve, padTo)
+		require.NotNil(t, resp)
+		assert.Equal(t, protocol.Reject, resp.Action)
+	})
+}
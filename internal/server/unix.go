@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+)
+
+// unixPrefix marks addresses served over a unix socket, e.g. unix:/run/antiddos.sock
+const unixPrefix = "unix:"
+
+// listenUnix listens on a unix socket, replacing a socket file left behind
+// by a previous run. A socket somebody still accepts on is never taken over.
+// The file is not removed when the listener gets closed,
+// since the listener may have been handed over to an upgraded process.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := checkStale(path); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+
+	return l, nil
+}
+
+// checkStale fails unless the socket at path is left behind, i.e. nobody listens on it
+func checkStale(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%w: socket %s is in use", syscall.EADDRINUSE, path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// identify returns the identity of the client the challenges are bound to,
+// which is the remote address for TCP and the peer credentials for unix sockets
+func identify(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn.RemoteAddr().String()
+	}
+
+	id, err := peerCredentials(uc)
+	if err != nil {
+		return unixPrefix + "unknown"
+	}
+
+	return id
+}
@@ -0,0 +1,84 @@
+package sni
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	ErrNotTLS       = errors.New("not a TLS handshake")
+	ErrNoServerName = errors.New("no server name in the ClientHello")
+)
+
+const (
+	// recordHeaderSize is the size of the header of a TLS record
+	recordHeaderSize = 5
+
+	// recordTypeHandshake is the content type of the records carrying the ClientHello
+	recordTypeHandshake = 0x16
+
+	// MaxRecordSize is the size of the largest TLS record, the reader passed
+	// to ServerName must be able to buffer that much to peek any ClientHello
+	MaxRecordSize = recordHeaderSize + 16384
+)
+
+// errHelloRead stops the handshake once the ClientHello is parsed
+var errHelloRead = errors.New("ClientHello read")
+
+// ServerName peeks the TLS ClientHello at the start of r and returns the server name
+// it asks for, without terminating TLS. Nothing is consumed from r, so the whole
+// handshake can be spliced to a backend afterwards.
+func ServerName(r *bufio.Reader) (string, error) {
+	header, err := r.Peek(recordHeaderSize)
+	if err != nil {
+		return "", fmt.Errorf("sni.ServerName failed to read the record header: %w", err)
+	}
+
+	if header[0] != recordTypeHandshake || header[1] != 0x03 {
+		return "", ErrNotTLS
+	}
+
+	record, err := r.Peek(recordHeaderSize + int(binary.BigEndian.Uint16(header[3:])))
+	if err != nil {
+		return "", fmt.Errorf("sni.ServerName failed to read the ClientHello: %w", err)
+	}
+
+	// crypto/tls parses the hello, the handshake is aborted right after that
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(&helloConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", fmt.Errorf("%w: %w", ErrNotTLS, err)
+	}
+
+	if hello.ServerName == "" {
+		return "", ErrNoServerName
+	}
+
+	return hello.ServerName, nil
+}
+
+// helloConn feeds the ClientHello to the TLS server and swallows what it writes back
+type helloConn struct {
+	r io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *helloConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *helloConn) Close() error                       { return nil }
+func (c *helloConn) LocalAddr() net.Addr                { return nil }
+func (c *helloConn) RemoteAddr() net.Addr               { return nil }
+func (c *helloConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *helloConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *helloConn) SetWriteDeadline(_ time.Time) error { return nil }
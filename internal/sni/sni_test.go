@@ -0,0 +1,60 @@
+package sni_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/denismitr/antiddos/internal/sni"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientHello starts a TLS handshake for serverName and returns the reader the ClientHello arrives at
+func clientHello(t *testing.T, serverName string) *bufio.Reader {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+
+	return bufio.NewReaderSize(server, sni.MaxRecordSize)
+}
+
+func TestServerName(t *testing.T) {
+	t.Run("server name is peeked", func(t *testing.T) {
+		r := clientHello(t, "api.example.com")
+
+		name, err := sni.ServerName(r)
+		require.NoError(t, err)
+		assert.Equal(t, "api.example.com", name)
+
+		// the ClientHello is still there to be spliced
+		b, err := r.Peek(1)
+		require.NoError(t, err)
+		assert.Equal(t, byte(0x16), b[0])
+	})
+
+	t.Run("no server name", func(t *testing.T) {
+		_, err := sni.ServerName(clientHello(t, ""))
+		assert.ErrorIs(t, err, sni.ErrNoServerName)
+	})
+
+	t.Run("not TLS", func(t *testing.T) {
+		_, err := sni.ServerName(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n")))
+		assert.ErrorIs(t, err, sni.ErrNotTLS)
+	})
+
+	t.Run("garbage in a handshake record", func(t *testing.T) {
+		_, err := sni.ServerName(bufio.NewReader(strings.NewReader("\x16\x03\x01\x00\x04abcd")))
+		assert.ErrorIs(t, err, sni.ErrNotTLS)
+	})
+}
@@ -2,12 +2,25 @@ package embedded
 
 import (
 	"context"
+	"encoding/binary"
 	"github.com/allegro/bigcache/v3"
+	"sync"
 	"time"
 )
 
+const (
+	// spentPrefix keeps spent keys apart from the remembered ones
+	spentPrefix = "spent:"
+
+	// usesPrefix keeps the counts of used keys apart from the other ones
+	usesPrefix = "uses:"
+)
+
 type Store struct {
 	bc *bigcache.BigCache
+
+	// mu makes checking and marking a spent or used key a single step
+	mu sync.Mutex
 }
 
 func New(ctx context.Context, eviction uint64) (*Store, error) {
@@ -32,3 +45,39 @@ func (s *Store) Validate(key string) bool {
 func (s *Store) Remember(key string) {
 	_ = s.bc.Set(key, nil)
 }
+
+// Spend marks the key as used and reports whether it was not used before.
+// Spent keys are evicted along with the remembered ones.
+func (s *Store) Spend(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = spentPrefix + key
+	if _, err := s.bc.Get(key); err == nil {
+		return false
+	}
+
+	_ = s.bc.Set(key, nil)
+	return true
+}
+
+// Use counts one more use of the key and reports whether the count is within limit.
+// Counts are evicted along with the remembered keys after the last use.
+func (s *Store) Use(key string, limit uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = usesPrefix + key
+
+	var used uint64
+	if b, err := s.bc.Get(key); err == nil && len(b) == 8 {
+		used = binary.BigEndian.Uint64(b)
+	}
+
+	if used >= limit {
+		return false
+	}
+
+	_ = s.bc.Set(key, binary.BigEndian.AppendUint64(nil, used+1))
+	return true
+}
@@ -8,3 +8,11 @@ func (n Nope) Validate(key string) bool {
 }
 
 func (n Nope) Remember(key string) {}
+
+func (n Nope) Spend(key string) bool {
+	return true
+}
+
+func (n Nope) Use(key string, limit uint64) bool {
+	return true
+}
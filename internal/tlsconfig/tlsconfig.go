@@ -0,0 +1,151 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrPinMismatch = errors.New("no certificate matches the pinned keys")
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion turns versions like 1.2 or 1.3 into tls.VersionTLS* constants
+func ParseVersion(v string) (uint16, error) {
+	version, ok := versions[v]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q", v)
+	}
+	return version, nil
+}
+
+// Server builds the TLS configuration of the server. When clientCAFile is set,
+// clients must present a certificate signed by one of the CAs in it.
+func Server(certFile, keyFile, minVersion, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tlsconfig.Server failed to load key pair: %w", err)
+	}
+
+	version, err := ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// Client builds the TLS configuration of the client. The server certificate is
+// verified against the CAs in caFile, or the system pool when it is empty.
+// With pins, the chain must also contain a key whose SPKI hash is pinned,
+// and pins without a CA file trust the pinned keys alone, e.g. self-signed ones.
+// A client certificate is sent when certFile and keyFile are set.
+func Client(caFile, serverName, minVersion string, pins []string, certFile, keyFile string) (*tls.Config, error) {
+	version, err := ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: version,
+	}
+
+	if caFile != "" {
+		pool, err := loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tlsconfig.Client failed to load key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(pins) > 0 {
+		if caFile == "" {
+			// the pins take over the verification of the chain
+			cfg.InsecureSkipVerify = true
+		}
+		cfg.VerifyConnection = verifyPins(pins, cfg.InsecureSkipVerify)
+	}
+
+	return cfg, nil
+}
+
+// SPKIHash returns the base64 encoded SHA-256 hash of the certificate public key,
+// in the same format as pin-sha256 of HPKP, e.g. for
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins checks the keys of the verified chains, or only the leaf key when
+// nothing verified the chain, since the peer proves owning the leaf key alone
+func verifyPins(pins []string, leafOnly bool) func(tls.ConnectionState) error {
+	pinned := make(map[string]struct{}, len(pins))
+	for _, pin := range pins {
+		pinned[pin] = struct{}{}
+	}
+
+	return func(cs tls.ConnectionState) error {
+		chains := cs.VerifiedChains
+		if leafOnly && len(cs.PeerCertificates) > 0 {
+			chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+		}
+
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if _, ok := pinned[SPKIHash(cert)]; ok {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("tlsconfig failed to read CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("tlsconfig found no certificates in %s", file)
+	}
+
+	return pool, nil
+}
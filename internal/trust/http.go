@@ -0,0 +1,109 @@
+package trust
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the address of the client of an HTTP request without the port,
+// since every request may come over a connection of its own. Behind trusted proxies
+// it is the rightmost forwarded address that does not belong to a proxy.
+func (n Networks) ClientIP(r *http.Request) string {
+	ip := remoteIP(r.RemoteAddr)
+	if !n.Contains(net.ParseIP(ip)) {
+		return ip
+	}
+
+	forwarded := forwardedFor(r)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		candidate := net.ParseIP(forwarded[i])
+		if candidate == nil {
+			break
+		}
+		if !n.Contains(candidate) {
+			return candidate.String()
+		}
+	}
+
+	return ip
+}
+
+// Secure tells whether the client reached the server over TLS, behind trusted proxies
+// it is whether they forwarded the https scheme in the Forwarded or X-Forwarded-Proto headers
+func (n Networks) Secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !n.Contains(net.ParseIP(remoteIP(r.RemoteAddr))) {
+		return false
+	}
+
+	return strings.EqualFold(forwardedProto(r), "https")
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// forwardedFor lists the addresses the request went through, client first,
+// taken from the Forwarded, X-Forwarded-For or X-Real-IP headers
+func forwardedFor(r *http.Request) []string {
+	var addrs []string
+
+	for _, v := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+
+				value = strings.Trim(value, `"`)
+				if host, _, err := net.SplitHostPort(value); err == nil {
+					value = host
+				}
+				addrs = append(addrs, strings.Trim(value, "[]"))
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(v, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+
+	if v := r.Header.Get("X-Real-IP"); v != "" {
+		return []string{strings.TrimSpace(v)}
+	}
+
+	return nil
+}
+
+// forwardedProto returns the scheme the client used as told by the first proxy,
+// taken from the Forwarded or X-Forwarded-Proto headers
+func forwardedProto(r *http.Request) string {
+	for _, v := range r.Header.Values("Forwarded") {
+		element, _, _ := strings.Cut(v, ",")
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "proto") {
+				return strings.Trim(value, `"`)
+			}
+		}
+	}
+
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.TrimSpace(proto)
+}
@@ -0,0 +1,61 @@
+package trust
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks lists the networks whose peers are trusted
+// to report the real address of a client, e.g. load balancers
+type Networks []*net.IPNet
+
+// ParseNetworks parses CIDRs, a bare IP address is trusted on its own
+func ParseNetworks(cidrs []string) (Networks, error) {
+	networks := make(Networks, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted address %q", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %w", cidr, err)
+		}
+		networks = append(networks, n)
+	}
+
+	return networks, nil
+}
+
+// Contains reports whether ip belongs to any of the networks
+func (n Networks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr reports whether the IP of a TCP or UDP address belongs to any of the networks
+func (n Networks) ContainsAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return n.Contains(a.IP)
+	case *net.UDPAddr:
+		return n.Contains(a.IP)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,269 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotReady = errors.New("upgraded process did not report ready")
+)
+
+const (
+	// EnvListeners holds the number of listeners handed over to the child process
+	EnvListeners = "ANTIDDOS_UPGRADE_LISTENERS"
+
+	// EnvSecret is set when a secret is handed over to the child process,
+	// it is read from the descriptor following the ready pipe
+	EnvSecret = "ANTIDDOS_UPGRADE_SECRET"
+
+	// firstFD is the descriptor of the first file in exec.Cmd.ExtraFiles
+	firstFD = 3
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrader replaces the running process with a fresh copy of the binary
+// without closing the listening sockets. The listeners are handed over
+// as inherited file descriptors followed by a pipe the child reports its
+// readiness through, and by a pipe carrying the secret, if any.
+type Upgrader struct {
+	path    string
+	args    []string
+	timeout time.Duration
+	secret  []byte
+}
+
+func New(timeout time.Duration) (*Upgrader, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.New failed to locate the executable: %w", err)
+	}
+
+	return &Upgrader{
+		path:    path,
+		args:    os.Args[1:],
+		timeout: timeout,
+	}, nil
+}
+
+// SetCommand overrides the binary and the arguments of the child process
+func (u *Upgrader) SetCommand(path string, args ...string) {
+	u.path = path
+	u.args = args
+}
+
+// SetSecret hands the secret over to the child process through a pipe,
+// so that it never shows in the environment of the process, see Secret
+func (u *Upgrader) SetSecret(secret []byte) {
+	u.secret = secret
+}
+
+// Upgrade starts the child process, hands it the listeners and waits
+// until it reports ready. After a successful upgrade the caller is expected
+// to stop accepting connections, drain the existing ones and exit.
+func (u *Upgrader) Upgrade(ctx context.Context, listeners []net.Listener) error {
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return fmt.Errorf("upgrade.Upgrader.Upgrade listener %s can not be handed over", l.Addr())
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("upgrade.Upgrader.Upgrade failed to get file of listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade.Upgrader.Upgrade failed to create ready pipe: %w", err)
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(u.path, u.args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environ(), fmt.Sprintf("%s=%d", EnvListeners, len(listeners)))
+
+	if u.secret != nil {
+		secretR, err := u.secretPipe()
+		if err != nil {
+			return err
+		}
+		defer secretR.Close()
+
+		cmd.ExtraFiles = append(files[:len(files):len(files)], secretR)
+		cmd.Env = append(cmd.Env, EnvSecret+"=1")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("upgrade.Upgrader.Upgrade failed to start %s: %w", u.path, err)
+	}
+
+	// the child holds its own copy of the write end,
+	// closing ours lets the read below end if the child dies
+	_ = readyW.Close()
+	files = files[:len(files)-1]
+
+	slog.With("pid", cmd.Process.Pid).Info("waiting for upgraded process to get ready")
+
+	if err := u.waitReady(ctx, readyR); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+// secretPipe returns the read end of a pipe holding the secret, the secret is small
+// enough for the buffer of the pipe, so it is written before the child starts
+func (u *Upgrader) secretPipe() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Upgrader.secretPipe failed to create pipe: %w", err)
+	}
+	defer w.Close()
+
+	if _, err := w.Write(u.secret); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("upgrade.Upgrader.secretPipe failed to write secret: %w", err)
+	}
+	return r, nil
+}
+
+func (u *Upgrader) waitReady(ctx context.Context, r *os.File) error {
+	if err := r.SetReadDeadline(time.Now().Add(u.timeout)); err != nil {
+		return fmt.Errorf("upgrade.Upgrader.waitReady failed to set deadline: %w", err)
+	}
+
+	readyCh := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(r, b)
+		readyCh <- err
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-readyCh:
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+		return nil
+	}
+}
+
+// Inherited returns the listeners handed over by the parent process,
+// or nil when the process was not started by an upgrade
+func Inherited() ([]net.Listener, error) {
+	v, ok := os.LookupEnv(EnvListeners)
+	if !ok {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("upgrade.Inherited invalid %s value %q", EnvListeners, v)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(firstFD+i), "listener")
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade.Inherited failed to restore listener %d: %w", i, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// Secret returns the secret handed over by the parent process, see Upgrader.SetSecret,
+// or nil when there is none. It is read once, before Ready.
+func Secret() ([]byte, error) {
+	if _, ok := os.LookupEnv(EnvSecret); !ok {
+		return nil, nil
+	}
+	_ = os.Unsetenv(EnvSecret)
+
+	v := os.Getenv(EnvListeners)
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Secret invalid %s value %q", EnvListeners, v)
+	}
+
+	f := os.NewFile(uintptr(firstFD+n+1), "secret")
+	defer f.Close()
+
+	secret, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Secret failed to read secret: %w", err)
+	}
+	return secret, nil
+}
+
+// Ready tells the parent process that it can stop accepting connections.
+// It does nothing when the process was not started by an upgrade.
+func Ready() error {
+	v, ok := os.LookupEnv(EnvListeners)
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("upgrade.Ready invalid %s value %q", EnvListeners, v)
+	}
+
+	// a process upgrading itself later must not be mistaken for a child
+	_ = os.Unsetenv(EnvListeners)
+
+	f := os.NewFile(uintptr(firstFD+n), "ready")
+	defer f.Close()
+
+	if _, err := f.Write([]byte{1}); err != nil {
+		return fmt.Errorf("upgrade.Ready failed to notify parent: %w", err)
+	}
+
+	return nil
+}
+
+// environ returns the environment of the current process
+// without the variables describing a previous upgrade
+func environ() []string {
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, EnvListeners+"=") || strings.HasPrefix(kv, EnvSecret+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,81 @@
+package upgrade_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/denismitr/antiddos/internal/upgrade"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const envHelper = "ANTIDDOS_UPGRADE_HELPER"
+
+// TestHelperChild is not a real test, it is the upgraded process started by TestUpgrader_Upgrade
+func TestHelperChild(t *testing.T) {
+	if os.Getenv(envHelper) == "" {
+		t.Skip("only runs as a child process")
+	}
+
+	listeners, err := upgrade.Inherited()
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	secret, err := upgrade.Secret()
+	require.NoError(t, err)
+	require.NoError(t, upgrade.Ready())
+
+	conn, err := listeners[0].Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the secret never shows in the environment
+	for _, kv := range os.Environ() {
+		require.NotContains(t, kv, "s3cr3t")
+	}
+
+	_, err = conn.Write(append([]byte("child:"), secret...))
+	require.NoError(t, err)
+}
+
+func TestUpgrader_Upgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+
+	u, err := upgrade.New(5 * time.Second)
+	require.NoError(t, err)
+	u.SetCommand(os.Args[0], "-test.run=^TestHelperChild$")
+	u.SetSecret([]byte("s3cr3t"))
+
+	t.Setenv(envHelper, "1")
+	require.NoError(t, u.Upgrade(context.Background(), []net.Listener{l}))
+
+	// the parent stops accepting, the socket keeps listening in the child
+	require.NoError(t, l.Close())
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "child:s3cr3t", string(b))
+}
+
+func TestUpgrader_Upgrade_ChildFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	u, err := upgrade.New(5 * time.Second)
+	require.NoError(t, err)
+	// without the helper variable the child exits without reporting ready
+	u.SetCommand(os.Args[0], "-test.run=^TestHelperChild$")
+
+	err = u.Upgrade(context.Background(), []net.Listener{l})
+	assert.ErrorIs(t, err, upgrade.ErrNotReady)
+}
@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// acceptGUID is appended to the key of the client to compute Sec-WebSocket-Accept
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	version = "13"
+
+	// keySize is the size of the random Sec-WebSocket-Key before encoding
+	keySize = 16
+)
+
+// Upgrade completes the handshake of an HTTP request and takes over its connection.
+// A request that is not a valid handshake is answered with an error status.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "websocket handshake requires GET", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("%w: method %s", ErrHandshake, r.Method)
+	}
+
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: not an upgrade request", ErrHandshake)
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != version {
+		w.Header().Set("Sec-WebSocket-Version", version)
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrHandshake, r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != keySize {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: invalid key %q", ErrHandshake, key)
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("%w: connection cannot be hijacked", ErrHandshake)
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+
+	// the server may have set deadlines for reading the request
+	_ = conn.SetDeadline(time.Time{})
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Dial opens a connection to a ws:// or wss:// URL, cfg applies to wss:// and may be nil
+func Dial(ctx context.Context, rawURL string, cfg *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+
+	addr := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrHandshake, u.Scheme)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("websocket.Dial failed to dial %s: %w", addr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if u.Scheme == "wss" {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("websocket.Dial TLS handshake with %s failed: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+
+	c, err := handshake(conn, u)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func handshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, keySize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("websocket.Dial failed to generate key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {version},
+		},
+		Host: u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: unexpected status %s", ErrHandshake, resp.Status)
+	}
+
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: invalid response headers", ErrHandshake)
+	}
+
+	return newConn(conn, br, true), nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether the comma separated values of the header contain token
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,363 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrHandshake       = errors.New("websocket handshake failed")
+	ErrProtocol        = errors.New("websocket protocol violation")
+	ErrMessageTooLarge = errors.New("websocket message is too large")
+	ErrUnsupportedData = errors.New("websocket text messages are not supported")
+	ErrCloseSent       = errors.New("websocket close frame already sent")
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	// maxControlSize is the longest payload of close, ping and pong frames
+	maxControlSize = 125
+
+	// DefaultReadLimit bounds the size of a message until SetReadLimit is called
+	DefaultReadLimit = 64 << 10
+
+	// closeTimeout bounds writing a close frame to a peer that does not read
+	closeTimeout = time.Second
+)
+
+// Close codes of RFC 6455 section 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseMessageTooBig   = 1009
+)
+
+// Conn is a WebSocket connection carrying binary messages. Besides ReadMessage
+// and WriteMessage it implements net.Conn: Read streams the data of the received
+// messages, and every Write is sent as a message of its own, so that protocol
+// code written for TCP works over WebSocket as long as it writes whole frames.
+// Pings are answered while reading.
+type Conn struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	client    bool
+	readLimit int
+
+	// pending is what is left of the last message for Read
+	pending []byte
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		conn:      conn,
+		br:        br,
+		client:    client,
+		readLimit: DefaultReadLimit,
+	}
+}
+
+// SetReadLimit bounds the size of a message, a larger one closes the connection
+func (c *Conn) SetReadLimit(limit int) {
+	c.readLimit = limit
+}
+
+// ReadMessage returns the data of the next binary message, reassembling fragments.
+// It returns io.EOF once the peer closes the connection.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, c.fail(err)
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.replyClose(payload)
+			return nil, io.EOF
+		case opText:
+			return nil, c.fail(ErrUnsupportedData)
+		case opBinary:
+			if started {
+				return nil, c.fail(fmt.Errorf("%w: new message before the end of the previous one", ErrProtocol))
+			}
+			started = true
+			msg = payload
+		case opContinuation:
+			if !started {
+				return nil, c.fail(fmt.Errorf("%w: continuation without a message", ErrProtocol))
+			}
+			if len(msg)+len(payload) > c.readLimit {
+				return nil, c.fail(ErrMessageTooLarge)
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, c.fail(fmt.Errorf("%w: unexpected opcode %d", ErrProtocol, op))
+		}
+
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// WriteMessage sends b as a single binary message
+func (c *Conn) WriteMessage(b []byte) error {
+	return c.writeFrame(opBinary, b)
+}
+
+// WriteClose starts the closing handshake, the peer is expected to answer
+// with a close frame of its own, which ends ReadMessage with io.EOF
+func (c *Conn) WriteClose(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason...)
+	if len(payload) > maxControlSize {
+		payload = payload[:maxControlSize]
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	c.closeSent = true
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	return c.writeFrameLocked(opClose, payload)
+}
+
+// Read implements net.Conn reading the data of the messages as a stream
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = msg
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write implements net.Conn sending p as a single message
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a normal close frame, unless one was sent already, and closes the connection
+func (c *Conn) Close() error {
+	if err := c.WriteClose(CloseNormal, ""); err != nil && !errors.Is(err, ErrCloseSent) {
+		slog.With("error", err.Error()).Debug("websocket.Conn.Close failed to send close frame")
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&finBit != 0
+	op := head[0] & 0x0f
+	masked := head[1]&maskBit != 0
+
+	if head[0]&rsvBits != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits are set", ErrProtocol)
+	}
+
+	// clients mask every frame they send and servers never do
+	if masked == c.client {
+		return false, 0, nil, fmt.Errorf("%w: unexpected masking", ErrProtocol)
+	}
+
+	size := uint64(head[1] &^ maskBit)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+
+	isControl := op&0x8 != 0
+	if isControl && (!fin || size > maxControlSize) {
+		return false, 0, nil, fmt.Errorf("%w: fragmented or oversized control frame", ErrProtocol)
+	}
+
+	if size > uint64(c.readLimit) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		applyMask(payload, mask)
+	}
+
+	return fin, op, payload, nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *Conn) writeFrameLocked(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|op)
+
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+
+	switch size := len(payload); {
+	case size < 126:
+		frame = append(frame, maskFlag|byte(size))
+	case size <= 0xffff:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+
+	start := len(frame)
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("websocket.Conn failed to generate mask: %w", err)
+		}
+		frame = append(frame, mask[:]...)
+		start = len(frame)
+		frame = append(frame, payload...)
+		applyMask(frame[start:], mask)
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("websocket.Conn failed to write frame: %w", err)
+	}
+
+	return nil
+}
+
+// replyClose answers the close frame of the peer with the same code
+func (c *Conn) replyClose(payload []byte) {
+	code := uint16(CloseNormal)
+	if len(payload) >= 2 {
+		code = binary.BigEndian.Uint16(payload)
+	}
+
+	// the peer may be answering our own close frame
+	_ = c.WriteClose(code, "")
+}
+
+// fail closes the connection with the code matching err, and returns err
+func (c *Conn) fail(err error) error {
+	var code uint16
+	switch {
+	case errors.Is(err, ErrMessageTooLarge):
+		code = CloseMessageTooBig
+	case errors.Is(err, ErrUnsupportedData):
+		code = CloseUnsupportedData
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	default:
+		return err
+	}
+
+	_ = c.WriteClose(code, "")
+	_ = c.conn.Close()
+	return err
+}
+
+func applyMask(b []byte, mask [4]byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
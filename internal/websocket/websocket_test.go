@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialAndUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadLimit(1 << 20)
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadLimit(1 << 20)
+
+	// payload lengths of all three encodings
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		require.NoError(t, conn.WriteMessage(msg))
+
+		echo, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, msg, echo, "size %d", size)
+	}
+
+	// the close handshake ends reading on both sides
+	require.NoError(t, conn.WriteClose(CloseNormal, ""))
+	_, err = conn.ReadMessage()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConn_ReadMessage(t *testing.T) {
+	frame := func(head byte, payload string) []byte {
+		mask := [4]byte{1, 2, 3, 4}
+		b := []byte{head, maskBit | byte(len(payload))}
+		b = append(b, mask[:]...)
+		masked := []byte(payload)
+		applyMask(masked, mask)
+		return append(b, masked...)
+	}
+
+	tt := []struct {
+		name    string
+		frames  [][]byte
+		want    string
+		wantErr error
+		reply   []byte
+	}{
+		{
+			name:   "fragmented message with a ping in between",
+			frames: [][]byte{frame(opBinary, "he"), frame(finBit|opPing, "p"), frame(finBit|opContinuation, "llo")},
+			want:   "hello",
+			reply:  []byte{finBit | opPong, 1, 'p'},
+		},
+		{
+			name:    "text message",
+			frames:  [][]byte{frame(finBit|opText, "hello")},
+			wantErr: ErrUnsupportedData,
+			reply:   []byte{finBit | opClose, 2, 0x03, 0xeb},
+		},
+		{
+			name:    "unmasked frame of a client",
+			frames:  [][]byte{{finBit | opBinary, 1, 'a'}},
+			wantErr: ErrProtocol,
+			reply:   []byte{finBit | opClose, 2, 0x03, 0xea},
+		},
+		{
+			name:    "continuation without a message",
+			frames:  [][]byte{frame(finBit|opContinuation, "a")},
+			wantErr: ErrProtocol,
+			reply:   []byte{finBit | opClose, 2, 0x03, 0xea},
+		},
+		{
+			name:    "message over the limit",
+			frames:  [][]byte{frame(opBinary, "hello"), frame(finBit|opContinuation, " world")},
+			wantErr: ErrMessageTooLarge,
+			reply:   []byte{finBit | opClose, 2, 0x03, 0xf1},
+		},
+		{
+			name:    "close",
+			frames:  [][]byte{frame(finBit|opClose, "\x03\xe8")},
+			wantErr: io.EOF,
+			reply:   []byte{finBit | opClose, 2, 0x03, 0xe8},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := tcpPair(t)
+			defer client.Close()
+
+			conn := newConn(server, bufio.NewReader(server), false)
+			conn.SetReadLimit(8)
+
+			replies := make(chan []byte, 1)
+			go func() {
+				for _, f := range tc.frames {
+					if _, err := client.Write(f); err != nil {
+						break
+					}
+				}
+				b := make([]byte, len(tc.reply))
+				_, _ = io.ReadFull(client, b)
+				replies <- b
+			}()
+
+			msg, err := conn.ReadMessage()
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.want, string(msg))
+				_ = conn.Close()
+			}
+
+			select {
+			case reply := <-replies:
+				assert.Equal(t, tc.reply, reply)
+			case <-time.After(time.Second):
+				t.Fatal("no reply")
+			}
+			_ = server.Close()
+		})
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection, unlike net.Pipe
+// its writes do not wait for the other end to read
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	server, err := l.Accept()
+	require.NoError(t, err)
+
+	return server, client
+}